@@ -0,0 +1,359 @@
+// Tideland Common Go Library - Redis - Cluster
+//
+// Copyright (C) 2009-2013 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package redis
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bytes"
+	"cgl.tideland.biz/applog"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//--------------------
+// CONST
+//--------------------
+
+const (
+	clusterSlots           = 16384
+	clusterMaxRedirections = 5
+)
+
+// keylessCommands contains the commands without a key
+// as first argument. They can be sent to any node.
+var keylessCommands = map[string]bool{
+	"dbsize":    true,
+	"echo":      true,
+	"info":      true,
+	"ping":      true,
+	"publish":   true,
+	"randomkey": true,
+	"script":    true,
+	"time":      true,
+}
+
+//--------------------
+// CLUSTER
+//--------------------
+
+// Cluster manages the access to a Redis Cluster. Commands are sent
+// to the node serving the slot of their key, redirections are followed.
+type Cluster struct {
+	mutex         sync.RWMutex
+	configuration *Configuration
+	slots         []string
+	nodes         map[string]*Database
+	refreshChan   chan bool
+	stopChan      chan bool
+	closed        bool
+}
+
+// ConnectCluster connects a Redis Cluster based on the configuration.
+// The slot mapping is loaded from one of the cluster addresses.
+func ConnectCluster(c Configuration) *Cluster {
+	checkConfiguration(&c)
+	if len(c.ClusterAddresses) == 0 {
+		c.ClusterAddresses = []string{c.Address}
+	}
+	cl := &Cluster{
+		configuration: &c,
+		slots:         make([]string, clusterSlots),
+		nodes:         make(map[string]*Database),
+		refreshChan:   make(chan bool, 1),
+		stopChan:      make(chan bool),
+	}
+	if err := cl.refresh(); err != nil {
+		applog.Errorf("redis: cannot load slots of cluster: %v", err)
+	}
+	go cl.backend()
+	return cl
+}
+
+// Close the cluster and the connections to all nodes.
+func (cl *Cluster) Close() {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	if cl.closed {
+		return
+	}
+	cl.closed = true
+	close(cl.stopChan)
+	for _, db := range cl.nodes {
+		db.Close()
+	}
+}
+
+// Command performs a Redis command on the node serving the key
+// of the command.
+func (cl *Cluster) Command(cmd string, args ...interface{}) *ResultSet {
+	address := cl.address(cmd, args)
+	asking := false
+	for i := 0; ; i++ {
+		db, err := cl.node(address)
+		if err != nil {
+			rs := newResultSet(cmd)
+			rs.err = err
+			return rs
+		}
+		var rs *ResultSet
+		if asking {
+			// Asking has to be sent on the same connection.
+			prs := db.Pipeline(func(p *Pipeline) {
+				p.Command("asking")
+				p.Command(cmd, args...)
+			})
+			rs = prs
+			if prs.IsOK() {
+				rs = prs.ResultSetAt(1)
+			}
+		} else {
+			rs = db.Command(cmd, args...)
+		}
+		if rs.IsOK() || i == clusterMaxRedirections {
+			return rs
+		}
+		kind, slot, target := parseRedirection(rs.Error())
+		switch kind {
+		case "MOVED":
+			// Slot has permanently moved.
+			cl.mutex.Lock()
+			cl.slots[slot] = target
+			cl.mutex.Unlock()
+			cl.triggerRefresh()
+			address = target
+			asking = false
+		case "ASK":
+			// Slot is migrating.
+			address = target
+			asking = true
+		default:
+			switch {
+			case IsConnectionError(rs.Error()):
+				cl.triggerRefresh()
+			case IsDatabaseClosedError(rs.Error()):
+				// Node has been removed by a refresh.
+				address = cl.address(cmd, args)
+				asking = false
+				continue
+			}
+			return rs
+		}
+	}
+}
+
+// AsyncCommand performs a Redis command asynchronously.
+func (cl *Cluster) AsyncCommand(cmd string, args ...interface{}) *Future {
+	fut := newFuture()
+	go func() {
+		fut.setResultSet(cl.Command(cmd, args...))
+	}()
+	return fut
+}
+
+// address returns the address of the node serving the key of
+// the command or any node if there is no key.
+func (cl *Cluster) address(cmd string, args []interface{}) string {
+	cl.mutex.RLock()
+	defer cl.mutex.RUnlock()
+	if len(args) > 0 && !keylessCommands[strings.ToLower(cmd)] {
+		if address := cl.slots[keySlot(valueToBytes(args[0]))]; address != "" {
+			return address
+		}
+	}
+	for address := range cl.nodes {
+		return address
+	}
+	return cl.configuration.ClusterAddresses[0]
+}
+
+// node returns the database for a node address.
+func (cl *Cluster) node(address string) (*Database, error) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	if cl.closed {
+		return nil, &DatabaseClosedError{&Database{configuration: cl.configuration}}
+	}
+	db, ok := cl.nodes[address]
+	if !ok {
+		db = cl.connectNode(address)
+		cl.nodes[address] = db
+	}
+	return db, nil
+}
+
+// connectNode connects the node with the address. Database, sentinel
+// and cluster settings don't apply to single nodes.
+func (cl *Cluster) connectNode(address string) *Database {
+	c := *cl.configuration
+	c.Address = address
+	c.Database = 0
+	c.SentinelAddresses = nil
+	c.MasterName = ""
+	c.ReplicaReads = false
+	c.ClusterAddresses = nil
+	return Connect(c)
+}
+
+// triggerRefresh tells the backend to reload the slot mapping.
+func (cl *Cluster) triggerRefresh() {
+	select {
+	case cl.refreshChan <- true:
+	default:
+		// Refresh is already pending.
+	}
+}
+
+// refresh loads the slot mapping from the first answering node.
+// The connected nodes are asked first. The cluster addresses are
+// only connected if none of them answers, and the connection is
+// kept if the answering address is a node of the cluster.
+func (cl *Cluster) refresh() error {
+	cl.mutex.RLock()
+	if cl.closed {
+		cl.mutex.RUnlock()
+		return &DatabaseClosedError{&Database{configuration: cl.configuration}}
+	}
+	nodes := []*Database{}
+	for _, db := range cl.nodes {
+		nodes = append(nodes, db)
+	}
+	cl.mutex.RUnlock()
+	rs, answering := cl.clusterSlots(nodes)
+	if !rs.IsOK() {
+		for _, address := range cl.configuration.ClusterAddresses {
+			db := cl.connectNode(address)
+			if rs = db.Command("cluster", "slots"); rs.IsOK() {
+				answering = db
+				break
+			}
+			db.Close()
+		}
+	}
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+	// Each reply contains the first and last slot
+	// followed by the master and the replicas.
+	slots := make([]string, clusterSlots)
+	known := map[string]bool{}
+	rs.ResultSetsDo(func(srs *ResultSet) {
+		first, ferr := srs.ValueAt(0).Int()
+		last, lerr := srs.ValueAt(1).Int()
+		master := srs.ResultSetAt(2)
+		if ferr != nil || lerr != nil || master.ValueCount() < 2 || first < 0 || last >= clusterSlots {
+			return
+		}
+		address := net.JoinHostPort(master.ValueAt(0).String(), master.ValueAt(1).String())
+		known[address] = true
+		for slot := first; slot <= last; slot++ {
+			slots[slot] = address
+		}
+	})
+	// Set the slots, add the answering node and
+	// remove unknown nodes.
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	cl.slots = slots
+	if address := answering.configuration.Address; cl.nodes[address] != answering {
+		if known[address] && cl.nodes[address] == nil && !cl.closed {
+			cl.nodes[address] = answering
+		} else {
+			answering.Close()
+		}
+	}
+	for address, db := range cl.nodes {
+		if !known[address] {
+			db.Close()
+			delete(cl.nodes, address)
+		}
+	}
+	return nil
+}
+
+// clusterSlots requests the slot mapping from the first answering
+// node and returns its result set and database.
+func (cl *Cluster) clusterSlots(nodes []*Database) (*ResultSet, *Database) {
+	rs := newResultSet("cluster")
+	rs.err = &ConnectionError{errors.New("no connected cluster node")}
+	for _, db := range nodes {
+		if rs = db.Command("cluster", "slots"); rs.IsOK() {
+			return rs, db
+		}
+	}
+	return rs, nil
+}
+
+// backend refreshes the slot mapping when triggered.
+func (cl *Cluster) backend() {
+	for {
+		select {
+		case <-cl.refreshChan:
+			if err := cl.refresh(); err != nil {
+				applog.Errorf("redis: cannot refresh slots of cluster: %v", err)
+			}
+		case <-cl.stopChan:
+			return
+		}
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// parseRedirection checks if an error is a redirection
+// and returns its kind, slot and target address.
+func parseRedirection(err error) (string, int, string) {
+	if err == nil {
+		return "", 0, ""
+	}
+	parts := strings.Fields(strings.TrimPrefix(err.Error(), "redis: "))
+	if len(parts) != 3 || (parts[0] != "MOVED" && parts[0] != "ASK") {
+		return "", 0, ""
+	}
+	slot, serr := strconv.Atoi(parts[1])
+	if serr != nil || slot < 0 || slot >= clusterSlots {
+		return "", 0, ""
+	}
+	return parts[0], slot, parts[2]
+}
+
+// keySlot returns the slot of a key. If the key contains a
+// hash tag in braces only the tag is hashed.
+func keySlot(key []byte) int {
+	if start := bytes.IndexByte(key, '{'); start >= 0 {
+		if end := bytes.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// crc16 calculates the CRC16 (XMODEM) checksum used by Redis Cluster.
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// EOF
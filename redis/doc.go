@@ -12,7 +12,31 @@
 // returns a ResultSet with different methods for success testing and access
 // to the retrieved values. The method MultiCommand() can be used for
 // transactions. The passed function gets a MultiCommand instance as
-// argument for calling the inner Command() methods.
+// argument for calling the inner Command() methods. Pipeline() works
+// the same way but sends all commands at once without a transaction
+// and returns one result set per command. Lua scripts are created with
+// NewScript() and executed by their hash, they are loaded when needed.
+// Streams are read by consumer groups with XReadGroup() or continuously
+// with a StreamConsumer returned by ConsumeStream(), its Handle() method
+// acknowledges the successfully handled entries. NewMutex() and
+// NewRateLimiter() provide locks and rate limits shared by all clients.
+// CommandContext(), MultiCommandContext(), SubscribeContext() and
+// Future.ResultSetContext() take a context for deadlines and
+// cancellation, they return a TimeoutError when it is done.
+//
+// Subscribe() and PSubscribe() return a Subscription receiving the values
+// published to channels or patterns. Keyspace notifications are received
+// with SubscribeKeyspace() and SubscribeKeyevent().
+//
+// Instead of a fixed address a list of Sentinels and a master name can
+// be configured. Then the master is discovered and followed on failovers.
+// A Redis Cluster is accessed with ConnectCluster(). The returned Cluster
+// sends each command to the node serving the key and follows redirections.
+// Connections can be encrypted with TLS, see NewTLSConfig(), and
+// authenticated with a password or an ACL user.
+//
+// Tests not needing a real Redis can use the in-memory server of the
+// package redistest.
 package redis
 
 // EOF
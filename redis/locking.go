@@ -0,0 +1,209 @@
+// Tideland Common Go Library - Redis - Locking and Rate Limiting
+//
+// Copyright (C) 2009-2013 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package redis
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"cgl.tideland.biz/identifier"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//--------------------
+// SCRIPTS
+//--------------------
+
+// unlockScript deletes the lock only if it is held with the token.
+var unlockScript = NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+
+// extendScript sets a new expiration of the lock only if it
+// is held with the token.
+var extendScript = NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0`)
+
+//--------------------
+// MUTEX
+//--------------------
+
+// Mutex is a lock shared by all clients using the same key. It is
+// held for a limited time, the lease, so that a crashed holder
+// doesn't block the others forever. Each locking uses a new random
+// token, so only the holder can unlock or extend the lock.
+type Mutex struct {
+	mutex    sync.Mutex
+	database *Database
+	key      string
+	lease    time.Duration
+	token    string
+}
+
+// NewMutex creates a mutex for the key. The lock will be released
+// automatically after the lease if not unlocked or extended before.
+func (db *Database) NewMutex(key string, lease time.Duration) *Mutex {
+	return &Mutex{
+		database: db,
+		key:      key,
+		lease:    lease,
+	}
+}
+
+// TryLock tries to acquire the lock once. It returns true
+// if the lock has been acquired.
+func (m *Mutex) TryLock() (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	token := identifier.NewUUID().String()
+	rs := m.database.Command("set", m.key, token, "nx", "px", durationToMilliseconds(m.lease))
+	if !rs.IsOK() {
+		if rs.Error() == errKeyNotFound {
+			// Lock is held by someone else.
+			return false, nil
+		}
+		return false, rs.Error()
+	}
+	m.token = token
+	return true, nil
+}
+
+// Lock acquires the lock. If it is held by someone else it is
+// retried after the retry delay of the database configuration
+// until the context is done.
+func (m *Mutex) Lock(ctx context.Context) error {
+	for {
+		ok, err := m.TryLock()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(m.database.configuration.RetryDelay):
+		}
+	}
+}
+
+// Unlock releases the lock if it is still held.
+func (m *Mutex) Unlock() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.token == "" {
+		return &LockNotHeldError{m.key}
+	}
+	rs := unlockScript.Do(m.database, []string{m.key}, m.token)
+	m.token = ""
+	return m.checkHeld(rs)
+}
+
+// Extend sets the lease of the held lock to the passed duration.
+func (m *Mutex) Extend(lease time.Duration) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.token == "" {
+		return &LockNotHeldError{m.key}
+	}
+	rs := extendScript.Do(m.database, []string{m.key}, m.token, durationToMilliseconds(lease))
+	return m.checkHeld(rs)
+}
+
+// checkHeld checks the result of the scripts.
+func (m *Mutex) checkHeld(rs *ResultSet) error {
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+	if done, _ := rs.ValueAsInt(); done == 0 {
+		// Lease expired before.
+		m.token = ""
+		return &LockNotHeldError{m.key}
+	}
+	return nil
+}
+
+//--------------------
+// RATE LIMITER
+//--------------------
+
+// RateLimiter allows a limited number of events per identifier
+// in a sliding time window. The events are stored in a sorted set
+// per identifier scored by their time.
+type RateLimiter struct {
+	database *Database
+	prefix   string
+	limit    int
+	window   time.Duration
+}
+
+// NewRateLimiter creates a rate limiter allowing limit events in
+// the window. The prefix is used for the keys of the sorted sets.
+func (db *Database) NewRateLimiter(prefix string, limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		database: db,
+		prefix:   prefix,
+		limit:    limit,
+		window:   window,
+	}
+}
+
+// Allow records an event for the identifier and returns true if it
+// is within the limit. Denied events are not counted.
+func (rl *RateLimiter) Allow(id string) (bool, error) {
+	key := rl.key(id)
+	now := time.Now()
+	score := durationToMilliseconds(time.Duration(now.UnixNano()))
+	window := durationToMilliseconds(rl.window)
+	member := fmt.Sprintf("%d:%s", now.UnixNano(), identifier.NewUUID())
+	rs := rl.database.MultiCommand(func(mc *MultiCommand) {
+		mc.Command("zremrangebyscore", key, "-inf", fmt.Sprintf("(%d", score-window))
+		mc.Command("zadd", key, score, member)
+		mc.Command("zcard", key)
+		mc.Command("pexpire", key, window+1)
+	})
+	if !rs.IsOK() {
+		return false, rs.Error()
+	}
+	count, err := rs.ResultSetAt(2).ValueAsInt()
+	if err != nil {
+		return false, err
+	}
+	if count > rl.limit {
+		// Remove the denied event.
+		if rs = rl.database.Command("zrem", key, member); !rs.IsOK() {
+			return false, rs.Error()
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// Reset removes all events of the identifier.
+func (rl *RateLimiter) Reset(id string) error {
+	rs := rl.database.Command("del", rl.key(id))
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+	return nil
+}
+
+// key returns the key of the sorted set for the identifier.
+func (rl *RateLimiter) key(id string) string {
+	return rl.prefix + ":" + id
+}
+
+// EOF
@@ -12,7 +12,12 @@ package redis
 //--------------------
 
 import (
+	"cgl.tideland.biz/applog"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"time"
 )
 
@@ -20,22 +25,82 @@ import (
 // CONFIGURATION
 //--------------------
 
-// Configuration of a database client.
+// Configuration of a database client. Retries is the number
+// of additional connection attempts, the delay between them
+// starts with RetryDelay and doubles up to MaxRetryDelay. If
+// PingInterval is set pooled connections idle for a longer
+// time are checked with a ping before reusing them.
+//
+// If SentinelAddresses are set the address of the master named
+// MasterName is retrieved from the Sentinels instead of using
+// Address. With ReplicaReads read-only commands are sent to
+// the replicas of the master.
+//
+// ClusterAddresses are the initial nodes of a cluster connected
+// with ConnectCluster.
+//
+// Auth is the password for the authentication, together with a
+// Username the ACL user is authenticated. If TLSConfig is set the
+// connections are encrypted, see NewTLSConfig(). Without a server
+// name in the TLS configuration the host of the address is verified.
 type Configuration struct {
-	Address     string
-	Timeout     time.Duration
-	Database    int
-	Auth        string
-	PoolSize    int
-	LogCommands bool
+	Address           string
+	Timeout           time.Duration
+	Database          int
+	Username          string
+	Auth              string
+	TLSConfig         *tls.Config
+	PoolSize          int
+	LogCommands       bool
+	Retries           int
+	RetryDelay        time.Duration
+	MaxRetryDelay     time.Duration
+	PingInterval      time.Duration
+	SentinelAddresses []string
+	MasterName        string
+	ReplicaReads      bool
+	ClusterAddresses  []string
 }
 
 // String returns the configured address and
 // database as string.
 func (c *Configuration) String() string {
+	if len(c.SentinelAddresses) > 0 {
+		return fmt.Sprintf("%s/%d", c.MasterName, c.Database)
+	}
 	return fmt.Sprintf("%s/%d", c.Address, c.Database)
 }
 
+// NewTLSConfig creates a TLS configuration for the connections.
+// The certificates of the servers are verified with the CA
+// certificates in the PEM file caFile, if it is empty with the
+// ones of the system. If certFile and keyFile are set the client
+// certificate is loaded from those PEM files. An empty serverName
+// means the host of the address.
+func NewTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName: serverName,
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("redis: no CA certificates in %q", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
 //--------------------
 // DATABASE
 //--------------------
@@ -44,6 +109,8 @@ func (c *Configuration) String() string {
 type Database struct {
 	configuration *Configuration
 	pool          chan *unifiedRequestProtocol
+	replicaPool   chan *unifiedRequestProtocol
+	sentinel      *sentinel
 	connections   int
 	dbClosed      bool
 }
@@ -51,31 +118,46 @@ type Database struct {
 // Connect connects a Redis database based on the configuration.
 func Connect(c Configuration) *Database {
 	checkConfiguration(&c)
-	return &Database{
+	db := &Database{
 		configuration: &c,
 		pool:          make(chan *unifiedRequestProtocol, c.PoolSize),
+		replicaPool:   make(chan *unifiedRequestProtocol, c.PoolSize),
 	}
+	if len(c.SentinelAddresses) > 0 {
+		db.sentinel = newSentinel(db)
+	}
+	return db
 }
 
 // Close the database.
 func (db *Database) Close() {
 	db.dbClosed = true
+	if db.sentinel != nil {
+		db.sentinel.stop()
+	}
+	db.resetPools()
 }
 
 // Command performs a Redis command.
 func (db *Database) Command(cmd string, args ...interface{}) *ResultSet {
+	return db.CommandContext(context.Background(), cmd, args...)
+}
+
+// CommandContext performs a Redis command. If the context is done
+// before the reply is received the result set contains a TimeoutError.
+func (db *Database) CommandContext(ctx context.Context, cmd string, args ...interface{}) *ResultSet {
 	rs := newResultSet(cmd)
 	if db.dbClosed {
 		rs.err = &DatabaseClosedError{db}
 		return rs
 	}
-	urp, err := db.pullURP()
+	urp, err := db.pullURP(ctx, db.configuration.ReplicaReads && isReadOnlyCommand(cmd))
 	defer db.pushURP(urp)
 	if err != nil {
 		rs.err = err
 		return rs
 	}
-	urp.command(rs, false, cmd, args...)
+	urp.commandContext(ctx, rs, false, cmd, args...)
 	return rs
 }
 
@@ -91,16 +173,23 @@ func (db *Database) AsyncCommand(cmd string, args ...interface{}) *Future {
 // MultiCommand executes a function for the performing
 // of multiple commands in one call.
 func (db *Database) MultiCommand(f func(*MultiCommand)) *ResultSet {
+	return db.MultiCommandContext(context.Background(), f)
+}
+
+// MultiCommandContext executes a function for the performing of
+// multiple commands in one call. If the context is done before
+// the transaction is executed the result set contains a TimeoutError.
+func (db *Database) MultiCommandContext(ctx context.Context, f func(*MultiCommand)) *ResultSet {
 	// Create result set.
 	rs := newResultSet("multi")
 	rs.resultSets = []*ResultSet{}
-	urp, err := db.pullURP()
+	urp, err := db.pullURP(ctx, false)
 	defer db.pushURP(urp)
 	if err != nil {
 		rs.err = err
 		return rs
 	}
-	mc := newMultiCommand(rs, urp)
+	mc := newMultiCommand(ctx, rs, urp)
 	mc.process(f)
 	return rs
 }
@@ -115,15 +204,113 @@ func (db *Database) AsyncMultiCommand(f func(*MultiCommand)) *Future {
 	return fut
 }
 
+// Pipeline executes a function for the collecting of multiple
+// commands which are then sent in one call without waiting for
+// the individual replies. The returned result set contains one
+// result set per command.
+func (db *Database) Pipeline(f func(*Pipeline)) *ResultSet {
+	// Create result set.
+	rs := newResultSet("pipeline")
+	rs.resultSets = []*ResultSet{}
+	if db.dbClosed {
+		rs.err = &DatabaseClosedError{db}
+		return rs
+	}
+	urp, err := db.pullURP(context.Background(), false)
+	defer db.pushURP(urp)
+	if err != nil {
+		rs.err = err
+		return rs
+	}
+	p := newPipeline(rs, urp)
+	p.process(f)
+	return rs
+}
+
+// AsyncPipeline executes a function for the collecting of multiple
+// commands which are then sent in one call asynchronously.
+func (db *Database) AsyncPipeline(f func(*Pipeline)) *Future {
+	fut := newFuture()
+	go func() {
+		fut.setResultSet(db.Pipeline(f))
+	}()
+	return fut
+}
+
+// SubscribeContext subscribes to one or more channels. Connecting
+// ends and the subscription is stopped when the context is done.
+func (db *Database) SubscribeContext(ctx context.Context, channel ...string) (*Subscription, error) {
+	if ctx.Err() != nil {
+		return nil, &TimeoutError{0}
+	}
+	urp, err := db.connect(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	sub := newSubscription(db, urp, channel...)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sub.Stop()
+		case <-sub.stopChan:
+		}
+	}()
+	return sub, nil
+}
+
 // Subscribe to one or more channels.
 func (db *Database) Subscribe(channel ...string) (*Subscription, error) {
 	// URP handling.
-	urp, err := newUnifiedRequestProtocol(db)
+	urp, err := db.connect(context.Background(), false)
 	if err != nil {
 		return nil, err
 	}
 	// Now return new subscription.
-	return newSubscription(urp, channel...), nil
+	return newSubscription(db, urp, channel...), nil
+}
+
+// PSubscribe to one or more patterns.
+func (db *Database) PSubscribe(pattern ...string) (*Subscription, error) {
+	urp, err := db.connect(context.Background(), false)
+	if err != nil {
+		return nil, err
+	}
+	sub := newSubscription(db, urp)
+	sub.PSubscribe(pattern...)
+	return sub, nil
+}
+
+// EnableKeyspaceNotifications configures the events Redis notifies
+// about, e.g. "KEA" for all keyspace and keyevent notifications.
+// See the Redis documentation of 'notify-keyspace-events'.
+func (db *Database) EnableKeyspaceNotifications(events string) error {
+	rs := db.Command("config", "set", "notify-keyspace-events", events)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+	return nil
+}
+
+// SubscribeKeyspace subscribes to the keyspace notifications of
+// the keys matching the patterns in the configured database. The
+// events can be retrieved with SubscriptionValue.KeyspaceEvent().
+func (db *Database) SubscribeKeyspace(keyPattern ...string) (*Subscription, error) {
+	return db.PSubscribe(db.notificationChannels(keyspacePrefix, keyPattern)...)
+}
+
+// SubscribeKeyevent subscribes to the keyevent notifications of
+// the operations, e.g. "del" or "expired", in the configured database.
+func (db *Database) SubscribeKeyevent(operation ...string) (*Subscription, error) {
+	return db.PSubscribe(db.notificationChannels(keyeventPrefix, operation)...)
+}
+
+// notificationChannels returns the channel patterns of notifications.
+func (db *Database) notificationChannels(prefix string, suffixes []string) []string {
+	channels := make([]string, len(suffixes))
+	for i, suffix := range suffixes {
+		channels[i] = fmt.Sprintf("%s%d__:%s", prefix, db.configuration.Database, suffix)
+	}
+	return channels
 }
 
 // Publish a message to a channel.
@@ -140,19 +327,27 @@ func (db *Database) Publish(channel string, message interface{}) (int, error) {
 }
 
 // pullURP retrieves a unified request protocol managing the
-// communication with Redis out of the pool.
-func (db *Database) pullURP() (*unifiedRequestProtocol, error) {
-	select {
-	case urp := <-db.pool:
-		return urp, nil
-	default:
-		urp, err := newUnifiedRequestProtocol(db)
-		if err != nil {
-			return nil, err
+// communication with Redis out of the pool. Broken connections
+// in the pool are discarded. If a replica is wanted but none is
+// available the master is used. New connections are established
+// until the context is done.
+func (db *Database) pullURP(ctx context.Context, replica bool) (*unifiedRequestProtocol, error) {
+	pool := db.pool
+	if replica {
+		pool = db.replicaPool
+	}
+	for {
+		select {
+		case urp := <-pool:
+			if urp.isHealthy() && db.isCurrent(urp) {
+				return urp, nil
+			}
+			applog.Warningf("redis: discarding connection to %s of %v", urp.address, db.configuration)
+			urp.stop()
+		default:
+			return db.connect(ctx, replica)
 		}
-		return urp, nil
 	}
-	panic("unreachable")
 }
 
 // pushURP returns a unified request protocol back to the pool.
@@ -160,12 +355,17 @@ func (db *Database) pushURP(urp *unifiedRequestProtocol) {
 	if urp == nil {
 		return
 	}
-	if urp.err != nil || db.dbClosed {
+	if urp.isBroken() || db.dbClosed || !db.isCurrent(urp) {
 		urp.stop()
 		return
 	}
+	urp.lastUsed = time.Now()
+	pool := db.pool
+	if urp.replica {
+		pool = db.replicaPool
+	}
 	select {
-	case db.pool <- urp:
+	case pool <- urp:
 		// Everything ok.
 	default:
 		// Pool is full, stop it.
@@ -173,6 +373,81 @@ func (db *Database) pushURP(urp *unifiedRequestProtocol) {
 	}
 }
 
+// resetPools stops all pooled unified request protocols.
+func (db *Database) resetPools() {
+	for _, pool := range []chan *unifiedRequestProtocol{db.pool, db.replicaPool} {
+		draining := true
+		for draining {
+			select {
+			case urp := <-pool:
+				urp.stop()
+			default:
+				draining = false
+			}
+		}
+	}
+}
+
+// isCurrent checks if the protocol is still connected to a
+// valid address, which only may change when using Sentinel.
+func (db *Database) isCurrent(urp *unifiedRequestProtocol) bool {
+	if db.sentinel == nil {
+		return true
+	}
+	return db.sentinel.isCurrent(urp.address, urp.replica)
+}
+
+// address returns the address to connect to and if it is the
+// one of a replica.
+func (db *Database) address(replica bool) (string, bool, error) {
+	if db.sentinel == nil {
+		return db.configuration.Address, false, nil
+	}
+	if replica {
+		if address, ok := db.sentinel.replicaAddress(); ok {
+			return address, true, nil
+		}
+	}
+	address, err := db.sentinel.masterAddress()
+	return address, false, err
+}
+
+// connect creates a new unified request protocol. Failing
+// connections are retried with an exponential backoff until
+// the context is done, then a TimeoutError is returned.
+func (db *Database) connect(ctx context.Context, replica bool) (*unifiedRequestProtocol, error) {
+	start := time.Now()
+	delay := db.configuration.RetryDelay
+	for i := 0; ; i++ {
+		address, isReplica, err := db.address(replica)
+		if err == nil {
+			var urp *unifiedRequestProtocol
+			urp, err = newUnifiedRequestProtocol(ctx, db, address, isReplica)
+			if err == nil {
+				return urp, nil
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, &TimeoutError{time.Now().Sub(start)}
+		}
+		if !IsConnectionError(err) || i >= db.configuration.Retries || db.dbClosed {
+			return nil, err
+		}
+		applog.Warningf("redis: connecting %v failed, retrying in %v: %v", db.configuration, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, &TimeoutError{time.Now().Sub(start)}
+		}
+		delay *= 2
+		if delay > db.configuration.MaxRetryDelay {
+			delay = db.configuration.MaxRetryDelay
+		}
+	}
+}
+
 //--------------------
 // MULTI COMMAND
 //--------------------
@@ -180,14 +455,16 @@ func (db *Database) pushURP(urp *unifiedRequestProtocol) {
 // MultiCommand enables the user to perform multiple commands
 // in one call.
 type MultiCommand struct {
+	ctx       context.Context
 	urp       *unifiedRequestProtocol
 	rs        *ResultSet
 	discarded bool
 }
 
 // newMultiCommand creates a new multi command helper.
-func newMultiCommand(rs *ResultSet, urp *unifiedRequestProtocol) *MultiCommand {
+func newMultiCommand(ctx context.Context, rs *ResultSet, urp *unifiedRequestProtocol) *MultiCommand {
 	return &MultiCommand{
+		ctx: ctx,
 		urp: urp,
 		rs:  rs,
 	}
@@ -196,11 +473,15 @@ func newMultiCommand(rs *ResultSet, urp *unifiedRequestProtocol) *MultiCommand {
 // process executes the multi command function.
 func (mc *MultiCommand) process(f func(*MultiCommand)) {
 	// Send the multi command.
-	mc.urp.command(mc.rs, false, "multi")
+	mc.urp.commandContext(mc.ctx, mc.rs, false, "multi")
 	if mc.rs.IsOK() {
 		// Execute multi command function.
 		f(mc)
-		mc.urp.command(mc.rs, true, "exec")
+		mc.urp.commandContext(mc.ctx, mc.rs, true, "exec")
+		if !mc.rs.IsOK() && mc.ctx.Err() != nil {
+			// Transaction may still be open, so don't reuse the protocol.
+			mc.urp.err = mc.rs.err
+		}
 	}
 }
 
@@ -209,16 +490,73 @@ func (mc *MultiCommand) process(f func(*MultiCommand)) {
 func (mc *MultiCommand) Command(cmd string, args ...interface{}) {
 	rs := newResultSet(cmd)
 	mc.rs.resultSets = append(mc.rs.resultSets, rs)
-	mc.urp.command(rs, false, cmd, args...)
+	mc.urp.commandContext(mc.ctx, rs, false, cmd, args...)
 }
 
 // Discard throws all so far queued commands away.
 func (mc *MultiCommand) Discard() {
 	// Send the discard command and empty result sets.
-	mc.urp.command(mc.rs, false, "discard")
+	mc.urp.commandContext(mc.ctx, mc.rs, false, "discard")
 	mc.rs.resultSets = []*ResultSet{}
 	// Now send the new multi command.
-	mc.urp.command(mc.rs, false, "multi")
+	mc.urp.commandContext(mc.ctx, mc.rs, false, "multi")
+}
+
+//--------------------
+// PIPELINE
+//--------------------
+
+// Pipeline enables the user to send multiple commands in one
+// call without wrapping them into a transaction.
+type Pipeline struct {
+	urp      *unifiedRequestProtocol
+	rs       *ResultSet
+	commands []*envCommand
+	scripts  []*Script
+}
+
+// newPipeline creates a new pipeline helper.
+func newPipeline(rs *ResultSet, urp *unifiedRequestProtocol) *Pipeline {
+	return &Pipeline{
+		urp: urp,
+		rs:  rs,
+	}
+}
+
+// process executes the pipeline function and sends the
+// collected commands.
+func (p *Pipeline) process(f func(*Pipeline)) {
+	f(p)
+	if err := p.loadScripts(); err != nil {
+		p.rs.err = err
+		return
+	}
+	if len(p.commands) > 0 {
+		p.urp.pipeline(p.commands)
+	}
+	// The pipeline itself is ok if the commands could be sent.
+	p.rs.err = nil
+	for _, rs := range p.rs.resultSets {
+		if IsConnectionError(rs.err) {
+			p.rs.err = rs.err
+			return
+		}
+	}
+}
+
+// Command adds a command to the pipeline. It will be
+// sent when the pipeline function returns.
+func (p *Pipeline) Command(cmd string, args ...interface{}) {
+	rs := newResultSet(cmd)
+	p.rs.resultSets = append(p.rs.resultSets, rs)
+	p.commands = append(p.commands, &envCommand{rs, false, cmd, args, nil, nil})
+}
+
+// Discard throws all so far collected commands away.
+func (p *Pipeline) Discard() {
+	p.rs.resultSets = []*ResultSet{}
+	p.commands = nil
+	p.scripts = nil
 }
 
 //--------------------
@@ -244,6 +582,25 @@ func checkConfiguration(c *Configuration) {
 		// Default is 10.
 		c.PoolSize = 10
 	}
+	if c.Retries == 0 {
+		// Default is 3, negative values disable retries.
+		c.Retries = 3
+	}
+	if c.RetryDelay <= 0 {
+		// First retry after 100 milliseconds.
+		c.RetryDelay = 100 * time.Millisecond
+	}
+	if c.MaxRetryDelay < c.RetryDelay {
+		// Delay grows up to 5 seconds.
+		c.MaxRetryDelay = 5 * time.Second
+		if c.MaxRetryDelay < c.RetryDelay {
+			c.MaxRetryDelay = c.RetryDelay
+		}
+	}
+	if c.PingInterval < 0 {
+		// Negative is the same as no ping.
+		c.PingInterval = 0
+	}
 }
 
 // EOF
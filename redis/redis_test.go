@@ -12,11 +12,21 @@ package redis
 //--------------------
 
 import (
+	"bufio"
 	"cgl.tideland.biz/applog"
 	"cgl.tideland.biz/asserts"
 	"cgl.tideland.biz/monitoring"
+	"cgl.tideland.biz/redis/redistest"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -54,6 +64,160 @@ func (htt *hashableTestType) SetHash(h Hash) {
 	htt.d, _ = h.Float64("hashable:field:d")
 }
 
+// scriptedServer is a server on loopback answering the
+// commands with the replies returned by a script.
+type scriptedServer struct {
+	mutex       sync.Mutex
+	listener    net.Listener
+	script      func(args []string) string
+	subscribers []net.Conn
+}
+
+// newScriptedServer starts a new scripted server.
+func newScriptedServer(script func(args []string) string) *scriptedServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	ss := &scriptedServer{
+		listener: l,
+		script:   script,
+	}
+	go ss.accept()
+	return ss
+}
+
+// Address returns the address of the server.
+func (ss *scriptedServer) Address() string {
+	return ss.listener.Addr().String()
+}
+
+// HostPort returns host and port of the server.
+func (ss *scriptedServer) HostPort() (string, string) {
+	host, port, _ := net.SplitHostPort(ss.Address())
+	return host, port
+}
+
+// Publish sends a message to all subscribed connections.
+func (ss *scriptedServer) Publish(channel, message string) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	for _, conn := range ss.subscribers {
+		conn.Write([]byte(multiBulkReply("message", channel, message)))
+	}
+}
+
+// Close stops the server.
+func (ss *scriptedServer) Close() {
+	ss.listener.Close()
+}
+
+// accept handles the incoming connections.
+func (ss *scriptedServer) accept() {
+	for {
+		conn, err := ss.listener.Accept()
+		if err != nil {
+			return
+		}
+		go ss.serve(conn)
+	}
+}
+
+// serve reads the commands of one connection and writes the replies.
+func (ss *scriptedServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			line, _ = reader.ReadString('\n')
+			l, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			buf := make([]byte, l+2)
+			if _, err = io.ReadFull(reader, buf); err != nil {
+				return
+			}
+			args[i] = string(buf[:l])
+		}
+		args[0] = strings.ToLower(args[0])
+		ss.mutex.Lock()
+		if args[0] == "subscribe" {
+			ss.subscribers = append(ss.subscribers, conn)
+			conn.Write([]byte(fmt.Sprintf("*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1])))
+		} else {
+			conn.Write([]byte(ss.script(args)))
+		}
+		ss.mutex.Unlock()
+	}
+}
+
+// bulkReply creates the reply for one value.
+func bulkReply(value string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+}
+
+// multiBulkReply creates the reply for multiple values.
+func multiBulkReply(values ...string) string {
+	reply := fmt.Sprintf("*%d\r\n", len(values))
+	for _, value := range values {
+		reply += bulkReply(value)
+	}
+	return reply
+}
+
+// namedServerScript returns a script answering all commands
+// except ping with the name of the server.
+func namedServerScript(name string) func(args []string) string {
+	return func(args []string) string {
+		if args[0] == "ping" {
+			return "+PONG\r\n"
+		}
+		return bulkReply(name)
+	}
+}
+
+// StructTestAddress is embedded in the struct test type.
+type StructTestAddress struct {
+	Street string `redis:"street"`
+	City   string `redis:"city,omitempty"`
+}
+
+// structTestType is a struct for the mapping into hashes.
+type structTestType struct {
+	StructTestAddress
+	Name     string            `redis:"name"`
+	Age      int               `redis:"age"`
+	Height   float64           `redis:"height"`
+	Weight   float32           `redis:"weight"`
+	Active   bool              `redis:"active"`
+	Count    uint16            `redis:"count,omitempty"`
+	Raw      []byte            `redis:"raw"`
+	Born     time.Time         `redis:"born"`
+	Timeout  time.Duration     `redis:"timeout"`
+	Tags     []string          `redis:"tags"`
+	Labels   map[string]string `redis:"labels,omitempty"`
+	Nickname *string           `redis:"nickname"`
+	Ignored  string            `redis:"-"`
+	Untagged string
+	hidden   string
+}
+
+// connectLocal connects the Redis server on the default address
+// for the tests needing features the test server doesn't provide,
+// like scripts or streams. The test is skipped if no server runs.
+func connectLocal(t *testing.T, c Configuration) *Database {
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:6379", 100*time.Millisecond)
+	if err != nil {
+		t.Skipf("no redis server on 127.0.0.1:6379: %v", err)
+	}
+	conn.Close()
+	return Connect(c)
+}
+
 //--------------------
 // TESTS
 //--------------------
@@ -81,7 +245,10 @@ func TestErrorChecking(t *testing.T) {
 
 func TestConnection(t *testing.T) {
 	assert := asserts.NewTestingAsserts(t, true)
-	db := Connect(Configuration{})
+	srv := redistest.NewServer()
+	defer srv.Close()
+	db := Connect(Configuration{Address: srv.Address()})
+	defer db.Close()
 
 	// Connection commands.
 	assert.Equal(db.Command("echo", "Hello, World!").ValueAsString(), "Hello, World!", "Echo of a string.")
@@ -90,7 +257,10 @@ func TestConnection(t *testing.T) {
 
 func TestSimpleSingleValue(t *testing.T) {
 	assert := asserts.NewTestingAsserts(t, true)
-	db := Connect(Configuration{})
+	srv := redistest.NewServer()
+	defer srv.Close()
+	db := Connect(Configuration{Address: srv.Address()})
+	defer db.Close()
 
 	rs := db.Command("del", "single-value")
 	assert.True(rs.IsOK(), "'del' is ok.")
@@ -114,7 +284,10 @@ func TestSimpleSingleValue(t *testing.T) {
 
 func TestSimpleMultipleValues(t *testing.T) {
 	assert := asserts.NewTestingAsserts(t, true)
-	db := Connect(Configuration{})
+	srv := redistest.NewServer()
+	defer srv.Close()
+	db := Connect(Configuration{Address: srv.Address()})
+	defer db.Close()
 
 	// Simple read of multiple keys.
 	db.Command("del", "multiple-value:1")
@@ -162,7 +335,10 @@ func TestSimpleMultipleValues(t *testing.T) {
 
 func TestHash(t *testing.T) {
 	assert := asserts.NewTestingAsserts(t, true)
-	db := Connect(Configuration{})
+	srv := redistest.NewServer()
+	defer srv.Close()
+	db := Connect(Configuration{Address: srv.Address()})
+	defer db.Close()
 
 	db.Command("del", "hash:manual")
 	db.Command("del", "hash:hashable")
@@ -207,9 +383,121 @@ func TestHash(t *testing.T) {
 	assert.Equal(htOut.d, 8.15, "Hash field 'd' is ok.")
 }
 
+func TestStructMapping(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+
+	nickname := "Jonny"
+	born := time.Date(1970, time.January, 1, 12, 30, 0, 0, time.UTC)
+	in := structTestType{
+		StructTestAddress: StructTestAddress{Street: "Main Street 1"},
+		Name:              "John",
+		Age:               42,
+		Height:            1.85,
+		Weight:            72.3,
+		Active:            true,
+		Raw:               []byte{1, 2, 3},
+		Born:              born,
+		Timeout:           5 * time.Second,
+		Tags:              []string{"a", "b"},
+		Nickname:          &nickname,
+		Ignored:           "ignored",
+		Untagged:          "untagged",
+		hidden:            "hidden",
+	}
+	h, err := StructToHash(&in)
+	assert.Nil(err, "Converting struct into hash.")
+	assert.Equal(h.Len(), 12, "Hash contains the right number of fields.")
+	v, _ := h.String("street")
+	assert.Equal(v, "Main Street 1", "Embedded field has been flattened.")
+	v, _ = h.String("weight")
+	assert.Equal(v, "72.3", "Float32 has been formatted with its precision.")
+	v, _ = h.String("tags")
+	assert.Equal(v, `["a","b"]`, "Slice has been encoded as JSON.")
+	v, _ = h.String("Untagged")
+	assert.Equal(v, "untagged", "Untagged field uses the field name.")
+	_, err = h.String("count")
+	assert.True(IsInvalidKeyError(err), "Empty field has been omitted.")
+	_, err = h.String("Ignored")
+	assert.True(IsInvalidKeyError(err), "Ignored field is not in the hash.")
+
+	var out structTestType
+	err = HashToStruct(h, &out)
+	assert.Nil(err, "Converting hash into struct.")
+	in.Ignored = ""
+	in.hidden = ""
+	assert.Equal(out, in, "Struct has been restored.")
+
+	h.Set("age", "forty-two")
+	err = HashToStruct(h, &out)
+	assert.True(IsInvalidTypeError(err), "Invalid integer is detected.")
+	_, err = StructToHash("foo")
+	assert.True(IsInvalidTypeError(err), "Only structs can be converted.")
+	err = HashToStruct(h, out)
+	assert.True(IsInvalidTypeError(err), "Only pointers to structs can be set.")
+
+	hs := NewHashableStruct(&in)
+	assert.Equal(hs.GetHash().Len(), 12, "Hashable struct returns the hash.")
+	assert.Nil(hs.Error(), "Hashable struct has no error.")
+}
+
+func TestStructHash(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	srv := redistest.NewServer()
+	defer srv.Close()
+	db := Connect(Configuration{Address: srv.Address()})
+	defer db.Close()
+
+	db.Command("del", "hash:struct")
+
+	in := structTestType{Name: "John", Age: 42, Tags: []string{"a", "b"}}
+	rs := db.StoreStruct("hash:struct", &in)
+	assert.True(rs.IsOK(), "Storing the struct is ok.")
+	rs = db.Command("hincrby", "hash:struct", "age", 8)
+	assert.True(rs.IsOK(), "Incrementing a struct field is ok.")
+
+	var out structTestType
+	err := db.LoadStruct("hash:struct", &out)
+	assert.Nil(err, "Loading the struct is ok.")
+	assert.Equal(out.Name, "John", "Loaded name is ok.")
+	assert.Equal(out.Age, 50, "Loaded age is ok.")
+	assert.Equal(out.Tags, []string{"a", "b"}, "Loaded tags are ok.")
+
+	hs := NewHashableStruct(&out)
+	db.Command("hgetall", "hash:struct").SetHashable(hs)
+	assert.Nil(hs.Error(), "Setting the hashable struct is ok.")
+
+	err = db.LoadStruct("hash:not-existing", &out)
+	assert.True(IsInvalidKeyError(err), "Loading a not existing struct fails.")
+
+	// Fields becoming empty are removed.
+	nickname := "Jonny"
+	in = structTestType{Name: "John", Count: 3, Nickname: &nickname}
+	assert.True(db.StoreStruct("hash:struct", &in).IsOK(), "Storing the struct is ok.")
+	in.Count = 0
+	in.Nickname = nil
+	assert.True(db.StoreStruct("hash:struct", &in).IsOK(), "Storing the cleared struct is ok.")
+	out = structTestType{}
+	err = db.LoadStruct("hash:struct", &out)
+	assert.Nil(err, "Loading the cleared struct is ok.")
+	assert.Equal(out.Name, "John", "Loaded name is ok.")
+	assert.Equal(out.Count, uint16(0), "Omitted field has been removed.")
+	assert.Nil(out.Nickname, "Nil pointer has been removed.")
+
+	// Struct without fields to store.
+	empty := struct {
+		City string `redis:"city,omitempty"`
+	}{}
+	assert.True(db.StoreStruct("hash:struct", &empty).IsOK(), "Storing an empty struct is ok.")
+	err = db.LoadStruct("hash:struct", &out)
+	assert.True(IsInvalidKeyError(err), "Empty struct removed the hash.")
+}
+
 func TestFuture(t *testing.T) {
 	assert := asserts.NewTestingAsserts(t, true)
-	db := Connect(Configuration{})
+	srv := redistest.NewServer()
+	defer srv.Close()
+	db := Connect(Configuration{Address: srv.Address()})
+	defer db.Close()
 
 	db.Command("del", "future")
 
@@ -223,7 +511,10 @@ func TestFuture(t *testing.T) {
 
 func TestStringMap(t *testing.T) {
 	assert := asserts.NewTestingAsserts(t, true)
-	db := Connect(Configuration{})
+	srv := redistest.NewServer()
+	defer srv.Close()
+	db := Connect(Configuration{Address: srv.Address()})
+	defer db.Close()
 
 	db.Command("del", "string:map")
 
@@ -246,7 +537,10 @@ func TestStringMap(t *testing.T) {
 
 func TestStringSlice(t *testing.T) {
 	assert := asserts.NewTestingAsserts(t, true)
-	db := Connect(Configuration{})
+	srv := redistest.NewServer()
+	defer srv.Close()
+	db := Connect(Configuration{Address: srv.Address()})
+	defer db.Close()
 
 	db.Command("del", "string:slice")
 
@@ -263,7 +557,10 @@ func TestStringSlice(t *testing.T) {
 
 func TestMultiCommand(t *testing.T) {
 	assert := asserts.NewTestingAsserts(t, true)
-	db := Connect(Configuration{})
+	srv := redistest.NewServer()
+	defer srv.Close()
+	db := Connect(Configuration{Address: srv.Address()})
+	defer db.Close()
 
 	db.Command("del", "multi-command:1")
 	db.Command("del", "multi-command:2")
@@ -288,9 +585,777 @@ func TestMultiCommand(t *testing.T) {
 	assert.Equal(rs.ResultSetAt(5).ValueAsString(), "three", "Sixth result set contained right value 'three'.")
 }
 
+func TestPipeline(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	srv := redistest.NewServer()
+	defer srv.Close()
+	db := Connect(Configuration{Address: srv.Address()})
+	defer db.Close()
+
+	db.Command("del", "pipeline:counter")
+
+	rs := db.Pipeline(func(p *Pipeline) {
+		p.Command("set", "pipeline:1", "one")
+		p.Command("set", "pipeline:1", "two")
+		p.Discard()
+		for i := 0; i < 100; i++ {
+			p.Command("incr", "pipeline:counter")
+		}
+		p.Command("get", "pipeline:counter")
+		p.Command("lpush", "pipeline:counter", "wrong")
+	})
+	assert.True(rs.IsOK(), "Executing the pipeline has been ok.")
+	assert.Equal(rs.ResultSetCount(), 102, "Pipeline returned 102 result sets.")
+	v, err := rs.ResultSetAt(99).ValueAsInt()
+	assert.Nil(err, "No error retrieving the counter.")
+	assert.Equal(v, 100, "Hundredth increment returned 100.")
+	assert.Equal(rs.ResultSetAt(100).ValueAsString(), "100", "'get' in pipeline returned the right value.")
+	assert.False(rs.ResultSetAt(101).IsOK(), "Wrong type operation in pipeline failed.")
+
+	rs = db.Pipeline(func(p *Pipeline) {})
+	assert.True(rs.IsOK(), "Executing an empty pipeline has been ok.")
+	assert.Equal(rs.ResultSetCount(), 0, "Empty pipeline returned no result sets.")
+}
+
+func TestScan(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	srv := redistest.NewServer()
+	defer srv.Close()
+	db := Connect(Configuration{Address: srv.Address()})
+	defer db.Close()
+
+	db.Command("del", "scan:hash", "scan:set", "scan:sorted-set")
+	for i := 0; i < 50; i++ {
+		db.Command("set", fmt.Sprintf("scan:key:%d", i), i)
+		db.Command("hset", "scan:hash", fmt.Sprintf("field:%d", i), i)
+		db.Command("sadd", "scan:set", fmt.Sprintf("member:%d", i))
+		db.Command("zadd", "scan:sorted-set", i, fmt.Sprintf("member:%d", i))
+	}
+
+	// Scan keys.
+	keys := map[string]bool{}
+	scanner := db.Scan(ScanOptions{Match: "scan:key:*", Count: 10, Type: "string"})
+	for scanner.Next() {
+		keys[scanner.Value().String()] = true
+	}
+	assert.Nil(scanner.Error(), "No error scanning the keys.")
+	assert.Length(keys, 50, "All keys have been scanned.")
+
+	// Scan hash.
+	fields := map[string]string{}
+	scanner = db.HScan("scan:hash", ScanOptions{Count: 10})
+	for scanner.Next() {
+		kv := scanner.KeyValue()
+		fields[kv.Key] = kv.Value.String()
+	}
+	assert.Nil(scanner.Error(), "No error scanning the hash.")
+	assert.Length(fields, 50, "All fields have been scanned.")
+	assert.Equal(fields["field:42"], "42", "Field value is ok.")
+
+	// Scan set via channel.
+	members := map[string]bool{}
+	for value := range db.SScan("scan:set", ScanOptions{Match: "member:1*"}).Values() {
+		members[value.String()] = true
+	}
+	assert.Length(members, 11, "All matching members have been scanned.")
+
+	// Scan sorted set via channel.
+	scores := map[string]int{}
+	for sv := range db.ZScan("scan:sorted-set", ScanOptions{}).ScoredValues() {
+		scores[sv.Value.String()] = sv.Score
+	}
+	assert.Length(scores, 50, "All sorted set members have been scanned.")
+	assert.Equal(scores["member:42"], 42, "Score is ok.")
+
+	// Stop scanning.
+	scanner = db.HScan("scan:hash", ScanOptions{Count: 5})
+	kvChan := scanner.KeyValues()
+	<-kvChan
+	scanner.Stop()
+	count := 0
+	for range kvChan {
+		count++
+	}
+	assert.True(count <= 1, "Scanning has been stopped.")
+	assert.False(scanner.Next(), "Stopped scanner returns no more elements.")
+}
+
+func TestScript(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	script := NewScript(`return redis.call("incrby", KEYS[1], ARGV[1])`)
+	assert.Equal(script.Hash(), "208fcfb6f0c4ef427e3c331b4876da5300f44b2e", "Script hash is ok.")
+
+	// Server emulates the script cache and the script.
+	loaded := map[string]bool{}
+	counter := 0
+	multi := false
+	queued := []string{}
+	transaction := []string{}
+	incr := func(by string) string {
+		n, _ := strconv.Atoi(by)
+		counter += n
+		return fmt.Sprintf(":%d\r\n", counter)
+	}
+	ss := newScriptedServer(func(args []string) string {
+		reply := ""
+		switch {
+		case args[0] == "multi":
+			multi = true
+			return "+OK\r\n"
+		case args[0] == "exec":
+			multi = false
+			reply = fmt.Sprintf("*%d\r\n", len(queued)) + strings.Join(queued, "")
+			queued = []string{}
+			return reply
+		case args[0] == "script" && args[1] == "load":
+			loaded[NewScript(args[2]).Hash()] = true
+			return bulkReply(NewScript(args[2]).Hash())
+		case args[0] == "script" && args[1] == "exists":
+			reply = fmt.Sprintf("*%d\r\n", len(args)-2)
+			for _, hash := range args[2:] {
+				if loaded[hash] {
+					reply += ":1\r\n"
+				} else {
+					reply += ":0\r\n"
+				}
+			}
+			return reply
+		case args[0] == "evalsha" && !loaded[args[1]]:
+			reply = "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+		case args[0] == "evalsha" || args[0] == "eval":
+			reply = incr(args[4])
+		default:
+			reply = "+OK\r\n"
+		}
+		if multi {
+			queued = append(queued, reply)
+			transaction = append(transaction, args[0])
+			return "+QUEUED\r\n"
+		}
+		return reply
+	})
+	defer ss.Close()
+	db := Connect(Configuration{Address: ss.Address()})
+	defer db.Close()
+
+	// Script is not yet known.
+	rs := script.Do(db, []string{"script:counter"}, 5)
+	assert.True(rs.IsOK(), "First script execution is ok.")
+	v, err := rs.ValueAsInt()
+	assert.Nil(err, "Script returned an integer.")
+	assert.Equal(v, 5, "Script returned the right value.")
+	assert.True(loaded[script.Hash()], "Script has been loaded.")
+
+	// Script is known now.
+	rs = script.Do(db, []string{"script:counter"}, 10)
+	v, _ = rs.ValueAsInt()
+	assert.Equal(v, 15, "Second script execution returned the right value.")
+
+	// Scripts in transactions and pipelines.
+	loaded = map[string]bool{}
+	rs = db.MultiCommand(func(mc *MultiCommand) {
+		mc.Script(script, []string{"script:counter"}, 1)
+	})
+	assert.True(rs.IsOK(), "Script in multi command is ok.")
+	v, _ = rs.ResultSetAt(0).ValueAsInt()
+	assert.Equal(v, 16, "Multi command returned the right value.")
+	assert.Equal(transaction, []string{"evalsha"}, "Multi command used the hash.")
+	assert.True(loaded[script.Hash()], "Script has been loaded before the transaction.")
+
+	rs = db.Pipeline(func(p *Pipeline) {
+		p.Script(script, []string{"script:counter"}, 1)
+		p.Script(script, []string{"script:counter"}, 1)
+	})
+	assert.True(rs.IsOK(), "Script in pipeline is ok.")
+	v, _ = rs.ResultSetAt(1).ValueAsInt()
+	assert.Equal(v, 18, "Pipeline returned the right value.")
+}
+
+func TestStreams(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	db := connectLocal(t, Configuration{})
+	defer db.Close()
+
+	db.Command("del", "streams:stream")
+
+	// Direct usage of the commands.
+	err := db.XGroupCreate("streams:stream", "direct", "$")
+	assert.Nil(err, "Group has been created.")
+	err = db.XGroupCreate("streams:stream", "direct", "$")
+	assert.Nil(err, "Existing group is no error.")
+
+	h := NewHash()
+	h.Set("a", 1)
+	h.Set("b", "two")
+	id, err := db.XAdd("streams:stream", "", h)
+	assert.Nil(err, "Entry has been added.")
+	assert.True(id != "", "Entry has an ID.")
+
+	entries, err := db.XReadGroup("direct", "alpha", 10, 100*time.Millisecond, "streams:stream")
+	assert.Nil(err, "Entries have been read.")
+	assert.Length(entries, 1, "One entry has been read.")
+	assert.Equal(entries[0].ID, id, "Entry has the right ID.")
+	assert.Equal(entries[0].Stream, "streams:stream", "Entry has the right stream.")
+	b, _ := entries[0].Fields.String("b")
+	assert.Equal(b, "two", "Entry has the right fields.")
+
+	entries, err = db.XReadGroup("direct", "alpha", 10, 100*time.Millisecond, "streams:stream")
+	assert.Nil(err, "Blocking read without new entries is no error.")
+	assert.Empty(entries, "No new entries.")
+
+	pending, err := db.XPending("streams:stream", "direct", 10, "")
+	assert.Nil(err, "Pending entries have been retrieved.")
+	assert.Length(pending, 1, "One entry is pending.")
+	assert.Equal(pending[0].Consumer, "alpha", "Entry is pending for the consumer.")
+
+	time.Sleep(50 * time.Millisecond)
+	entries, err = db.XClaim("streams:stream", "direct", "beta", 10*time.Millisecond, id)
+	assert.Nil(err, "Entry has been claimed.")
+	assert.Length(entries, 1, "One entry has been claimed.")
+	pending, _ = db.XPending("streams:stream", "direct", 10, "beta")
+	assert.Length(pending, 1, "Entry is pending for the new consumer.")
+
+	n, err := db.XAck("streams:stream", "direct", id)
+	assert.Nil(err, "Entry has been acknowledged.")
+	assert.Equal(n, 1, "One entry has been acknowledged.")
+
+	// Multiple entries and streams.
+	db.Command("del", "streams:other")
+	err = db.XGroupCreate("streams:other", "direct", "$")
+	assert.Nil(err, "Group of the other stream has been created.")
+	idA, _ := db.XAdd("streams:stream", "", h)
+	idB, _ := db.XAdd("streams:stream", "", h)
+	idC, _ := db.XAdd("streams:other", "", h)
+	entries, err = db.XReadGroup("direct", "alpha", 10, 0, "streams:stream", "streams:other")
+	assert.Nil(err, "Entries of both streams have been read.")
+	assert.Length(entries, 3, "All entries have been read.")
+	assert.Equal(entries[2].ID, idC, "Entry of the other stream has the right ID.")
+	assert.Equal(entries[2].Stream, "streams:other", "Entry of the other stream has the right stream.")
+	entries, err = db.XClaim("streams:stream", "direct", "beta", 0, idA, idB)
+	assert.Nil(err, "Entries have been claimed.")
+	assert.Length(entries, 2, "Two entries have been claimed.")
+	n, err = db.XAck("streams:stream", "direct", idA, idB)
+	assert.Nil(err, "Entries have been acknowledged.")
+	assert.Equal(n, 2, "Two entries have been acknowledged.")
+	db.XAck("streams:other", "direct", idC)
+
+	// Consumer acknowledging only some entries.
+	options := StreamConsumerOptions{
+		Block:   50 * time.Millisecond,
+		MinIdle: 200 * time.Millisecond,
+	}
+	sc, err := db.ConsumeStream("streams:stream", "consumers", "first", options)
+	assert.Nil(err, "First consumer has been started.")
+	for i := 0; i < 3; i++ {
+		h := NewHash()
+		h.Set("index", i)
+		db.XAdd("streams:stream", "", h)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case sd := <-sc.Deliveries():
+			index, _ := sd.Fields.Int("index")
+			assert.Equal(index, i, "Entry has been delivered in order.")
+			if i < 2 {
+				assert.Nil(sd.Ack(), "Entry has been acknowledged.")
+			}
+		case <-time.After(time.Second):
+			assert.Fail("Entry has not been delivered.")
+		}
+	}
+	sc.Stop()
+	for range sc.Deliveries() {
+	}
+
+	// Second consumer claims the unacknowledged entry.
+	sc, err = db.ConsumeStream("streams:stream", "consumers", "second", options)
+	assert.Nil(err, "Second consumer has been started.")
+	defer sc.Stop()
+	select {
+	case sd := <-sc.Deliveries():
+		index, _ := sd.Fields.Int("index")
+		assert.Equal(index, 2, "Unacknowledged entry has been claimed.")
+		assert.Nil(sd.Ack(), "Claimed entry has been acknowledged.")
+	case <-time.After(2 * time.Second):
+		assert.Fail("Unacknowledged entry has not been claimed.")
+	}
+	pending, _ = db.XPending("streams:stream", "consumers", 10, "")
+	assert.Empty(pending, "No more pending entries.")
+}
+
+func TestStreamArguments(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	entry := func(id, index string) string {
+		return "*2\r\n" + bulkReply(id) + multiBulkReply("index", index)
+	}
+	var mutex sync.Mutex
+	commands := map[string][]string{}
+	acked := []string{}
+	ss := newScriptedServer(func(args []string) string {
+		mutex.Lock()
+		commands[args[0]] = args[1:]
+		mutex.Unlock()
+		switch args[0] {
+		case "xack":
+			mutex.Lock()
+			acked = append(acked, args[3:]...)
+			mutex.Unlock()
+			return fmt.Sprintf(":%d\r\n", len(args)-3)
+		case "xclaim":
+			reply := fmt.Sprintf("*%d\r\n", len(args)-5)
+			for _, id := range args[5:] {
+				reply += entry(id, id[:1])
+			}
+			return reply
+		case "xpending":
+			// Pages of two pending entries.
+			switch args[3] {
+			case "-":
+				return "*2\r\n" + multiBulkReply("1-0", "dead", "60000", "1") + multiBulkReply("2-0", "dead", "60000", "1")
+			case "2-1":
+				return "*2\r\n" + multiBulkReply("3-0", "dead", "60000", "1") + multiBulkReply("4-0", "dead", "60000", "1")
+			}
+			return "*0\r\n"
+		case "xreadgroup":
+			if args[2] == "consumers" {
+				time.Sleep(10 * time.Millisecond)
+				return "*-1\r\n"
+			}
+			return "*2\r\n*2\r\n" + bulkReply("stream:a") + "*1\r\n" + entry("1-0", "1") +
+				"*2\r\n" + bulkReply("stream:b") + "*1\r\n" + entry("2-0", "2")
+		}
+		return "+OK\r\n"
+	})
+	defer ss.Close()
+	db := Connect(Configuration{Address: ss.Address()})
+	defer db.Close()
+	sent := func(cmd string) []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return commands[cmd]
+	}
+
+	n, err := db.XAck("stream:a", "direct", "1-0", "2-0")
+	assert.Nil(err, "Entries have been acknowledged.")
+	assert.Equal(n, 2, "Two entries have been acknowledged.")
+	assert.Equal(sent("xack"), []string{"stream:a", "direct", "1-0", "2-0"}, "IDs have been sent as arguments.")
+
+	entries, err := db.XClaim("stream:a", "direct", "beta", time.Second, "1-0", "2-0")
+	assert.Nil(err, "Entries have been claimed.")
+	assert.Length(entries, 2, "Two entries have been claimed.")
+	assert.Equal(sent("xclaim"), []string{"stream:a", "direct", "beta", "1000", "1-0", "2-0"}, "IDs have been sent as arguments.")
+
+	entries, err = db.XReadGroup("direct", "alpha", 10, 0, "stream:a", "stream:b")
+	assert.Nil(err, "Entries have been read.")
+	assert.Length(entries, 2, "Entries of both streams have been read.")
+	assert.Equal(entries[1].Stream, "stream:b", "Entry of the second stream has the right stream.")
+	assert.Equal(sent("xreadgroup"), []string{"group", "direct", "alpha", "count", "10", "streams", "stream:a", "stream:b", ">", ">"},
+		"Streams and IDs have been sent as arguments.")
+
+	// Consumer claims all pages of stale entries.
+	mutex.Lock()
+	acked = []string{}
+	mutex.Unlock()
+	sc, err := db.ConsumeStream("stream:a", "consumers", "gamma", StreamConsumerOptions{Count: 2, Block: 10 * time.Millisecond, MinIdle: time.Second})
+	assert.Nil(err, "Consumer has been started.")
+	for i := 1; i <= 2; i++ {
+		select {
+		case sd := <-sc.Deliveries():
+			index, _ := sd.Fields.Int("index")
+			assert.Equal(index, i, "Claimed entry has been delivered.")
+		case <-time.After(time.Second):
+			assert.Fail("Claimed entry has not been delivered.")
+		}
+	}
+	assert.Equal(sent("xclaim"), []string{"stream:a", "consumers", "gamma", "1000", "1-0", "2-0"}, "Stale IDs have been claimed.")
+
+	// Handled entries are acknowledged.
+	handled := []int{}
+	done := make(chan bool)
+	go func() {
+		sc.Handle(func(entry *StreamEntry) error {
+			index, _ := entry.Fields.Int("index")
+			handled = append(handled, index)
+			if index == 3 {
+				return errors.New("cannot handle entry")
+			}
+			sc.Stop()
+			return nil
+		})
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail("Consumer has not been stopped.")
+	}
+	assert.Equal(handled, []int{3, 4}, "Entries of the second page have been handled.")
+	assert.Equal(sent("xclaim"), []string{"stream:a", "consumers", "gamma", "1000", "3-0", "4-0"}, "Stale IDs of the second page have been claimed.")
+	mutex.Lock()
+	assert.Equal(acked, []string{"4-0"}, "Only the successfully handled entry has been acknowledged.")
+	mutex.Unlock()
+}
+
+func TestMutex(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	db := connectLocal(t, Configuration{RetryDelay: 10 * time.Millisecond})
+	defer db.Close()
+
+	db.Command("del", "mutex:a")
+
+	ma := db.NewMutex("mutex:a", time.Second)
+	mb := db.NewMutex("mutex:a", time.Second)
+
+	ok, err := ma.TryLock()
+	assert.Nil(err, "First mutex tried to lock.")
+	assert.True(ok, "First mutex acquired the lock.")
+	ok, err = mb.TryLock()
+	assert.Nil(err, "Second mutex tried to lock.")
+	assert.False(ok, "Second mutex didn't acquire the lock.")
+
+	// Waiting for the lock.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	err = mb.Lock(ctx)
+	cancel()
+	assert.Equal(err, context.DeadlineExceeded, "Waiting for the held lock timed out.")
+	err = mb.Unlock()
+	assert.True(IsLockNotHeldError(err), "Unlocking without holding the lock fails.")
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ma.Unlock()
+	}()
+	err = mb.Lock(context.Background())
+	assert.Nil(err, "Second mutex acquired the released lock.")
+
+	// Extending and expiring the lease.
+	err = mb.Extend(100 * time.Millisecond)
+	assert.Nil(err, "Lease has been extended.")
+	ttl, _ := db.Command("pttl", "mutex:a").ValueAsInt()
+	assert.True(ttl > 0 && ttl <= 100, "Lease has the new duration.")
+	time.Sleep(150 * time.Millisecond)
+	err = mb.Extend(time.Second)
+	assert.True(IsLockNotHeldError(err), "Expired lock cannot be extended.")
+
+	ok, _ = ma.TryLock()
+	assert.True(ok, "Expired lock can be acquired again.")
+	err = mb.Unlock()
+	assert.True(IsLockNotHeldError(err), "Expired lock cannot be unlocked.")
+	assert.Nil(ma.Unlock(), "Current holder unlocked.")
+}
+
+func TestMutexLocking(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	var mutex sync.Mutex
+	var token string
+	var expires time.Time
+	held := func() bool {
+		if token != "" && time.Now().After(expires) {
+			token = ""
+		}
+		return token != ""
+	}
+	ss := newScriptedServer(func(args []string) string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch args[0] {
+		case "set":
+			if held() {
+				return "$-1\r\n"
+			}
+			ms, _ := strconv.Atoi(args[5])
+			token, expires = args[2], time.Now().Add(time.Duration(ms)*time.Millisecond)
+			return "+OK\r\n"
+		case "evalsha":
+			if !held() || args[4] != token {
+				return ":0\r\n"
+			}
+			switch args[1] {
+			case unlockScript.Hash():
+				token = ""
+			case extendScript.Hash():
+				ms, _ := strconv.Atoi(args[5])
+				expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			}
+			return ":1\r\n"
+		case "pttl":
+			if !held() {
+				return ":-2\r\n"
+			}
+			return fmt.Sprintf(":%d\r\n", time.Until(expires)/time.Millisecond)
+		}
+		return "+OK\r\n"
+	})
+	defer ss.Close()
+	db := Connect(Configuration{Address: ss.Address(), RetryDelay: 10 * time.Millisecond})
+	defer db.Close()
+
+	ma := db.NewMutex("mutex:a", time.Second)
+	mb := db.NewMutex("mutex:a", time.Second)
+
+	ok, err := ma.TryLock()
+	assert.Nil(err, "First mutex tried to lock.")
+	assert.True(ok, "First mutex acquired the lock.")
+	ok, err = mb.TryLock()
+	assert.Nil(err, "Second mutex tried to lock.")
+	assert.False(ok, "Second mutex didn't acquire the lock.")
+
+	// Waiting for the lock.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	err = mb.Lock(ctx)
+	cancel()
+	assert.Equal(err, context.DeadlineExceeded, "Waiting for the held lock timed out.")
+	err = mb.Unlock()
+	assert.True(IsLockNotHeldError(err), "Unlocking without holding the lock fails.")
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ma.Unlock()
+	}()
+	err = mb.Lock(context.Background())
+	assert.Nil(err, "Second mutex acquired the released lock.")
+	err = ma.Unlock()
+	assert.True(IsLockNotHeldError(err), "Former holder cannot unlock again.")
+
+	// Extending and expiring the lease.
+	err = mb.Extend(100 * time.Millisecond)
+	assert.Nil(err, "Lease has been extended.")
+	ttl, _ := db.Command("pttl", "mutex:a").ValueAsInt()
+	assert.True(ttl > 0 && ttl <= 100, "Lease has the new duration.")
+	time.Sleep(150 * time.Millisecond)
+	err = mb.Extend(time.Second)
+	assert.True(IsLockNotHeldError(err), "Expired lock cannot be extended.")
+
+	ok, _ = ma.TryLock()
+	assert.True(ok, "Expired lock can be acquired again.")
+	err = mb.Unlock()
+	assert.True(IsLockNotHeldError(err), "Expired lock cannot be unlocked.")
+	ok, _ = mb.TryLock()
+	assert.False(ok, "Lock of the current holder is kept.")
+	assert.Nil(ma.Unlock(), "Current holder unlocked.")
+	ok, _ = mb.TryLock()
+	assert.True(ok, "Released lock can be acquired again.")
+}
+
+func TestRateLimiter(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	srv := redistest.NewServer()
+	defer srv.Close()
+	db := Connect(Configuration{Address: srv.Address()})
+	defer db.Close()
+
+	rl := db.NewRateLimiter("limiter", 3, 100*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		ok, err := rl.Allow("a")
+		assert.Nil(err, "Event has been recorded.")
+		assert.True(ok, "Event is within the limit.")
+	}
+	ok, err := rl.Allow("a")
+	assert.Nil(err, "Event has been recorded.")
+	assert.False(ok, "Event exceeds the limit.")
+	ok, _ = rl.Allow("b")
+	assert.True(ok, "Other identifier has its own limit.")
+
+	// Window slides.
+	time.Sleep(120 * time.Millisecond)
+	ok, _ = rl.Allow("a")
+	assert.True(ok, "Event is allowed after the window.")
+
+	assert.Nil(rl.Reset("a"), "Events have been reset.")
+	n, _ := db.Command("exists", "limiter:a").ValueAsInt()
+	assert.Equal(n, 0, "Events are removed.")
+}
+
+func TestPatternSubscription(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	srv := redistest.NewServer()
+	defer srv.Close()
+	db := Connect(Configuration{Address: srv.Address()})
+	defer db.Close()
+
+	sub, err := db.PSubscribe("psub:a:*")
+	assert.Nil(err, "Pattern subscription has been created.")
+	defer sub.Stop()
+	assert.Equal(sub.Subscribe("psub:plain", "psub:b:?"), 3, "Channel and pattern have been subscribed.")
+
+	receive := func() *SubscriptionValue {
+		select {
+		case sv := <-sub.Values():
+			return sv
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+	db.Publish("psub:a:1", "one")
+	sv := receive()
+	assert.Equal(sv.ChannelPattern, "psub:a:*", "Value has the pattern.")
+	assert.Equal(sv.Channel, "psub:a:1", "Value has the channel.")
+	assert.Equal(sv.String(), "one", "Value has been received.")
+	db.Publish("psub:b:2", "two")
+	assert.Equal(receive().ChannelPattern, "psub:b:?", "Value has been received by detected pattern.")
+	db.Publish("psub:plain", "three")
+	assert.Equal(receive().ChannelPattern, "*", "Value has been received by channel.")
+
+	assert.Equal(sub.PUnsubscribe(), 1, "All patterns have been unsubscribed.")
+	n, _ := db.Publish("psub:a:1", "four")
+	assert.Equal(n, 0, "Unsubscribed pattern has no receivers.")
+	assert.Equal(sub.Unsubscribe(), 0, "All channels have been unsubscribed.")
+}
+
+func TestKeyspaceNotifications(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	srv := redistest.NewServer()
+	defer srv.Close()
+	db := Connect(Configuration{Address: srv.Address(), Database: 3})
+	defer db.Close()
+
+	ke, ok := ParseKeyspaceEvent("__keyspace@5__:foo:bar", "hset")
+	assert.True(ok, "Keyspace notification has been parsed.")
+	assert.Equal(*ke, KeyspaceEvent{5, "foo:bar", "hset"}, "Keyspace notification is ok.")
+	ke, ok = ParseKeyspaceEvent("__keyevent@0__:expired", "foo")
+	assert.True(ok, "Keyevent notification has been parsed.")
+	assert.Equal(*ke, KeyspaceEvent{0, "foo", "expired"}, "Keyevent notification is ok.")
+	_, ok = ParseKeyspaceEvent("keyspace:foo", "set")
+	assert.False(ok, "Other channel is no notification.")
+
+	err := db.EnableKeyspaceNotifications("KEA")
+	assert.Nil(err, "Notifications have been enabled.")
+	ksub, err := db.SubscribeKeyspace("notify:*")
+	assert.Nil(err, "Keyspace has been subscribed.")
+	defer ksub.Stop()
+	esub, err := db.SubscribeKeyevent("del")
+	assert.Nil(err, "Keyevent has been subscribed.")
+	defer esub.Stop()
+
+	receive := func(sub *Subscription) *KeyspaceEvent {
+		select {
+		case sv := <-sub.Values():
+			ke, _ := sv.KeyspaceEvent()
+			return ke
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+	db.Command("set", "notify:a", "a")
+	db.Command("set", "other", "a")
+	db.Command("del", "notify:a", "other")
+	assert.Equal(*receive(ksub), KeyspaceEvent{3, "notify:a", "set"}, "Setting has been notified.")
+	assert.Equal(*receive(ksub), KeyspaceEvent{3, "notify:a", "del"}, "Deleting has been notified.")
+	assert.Equal(*receive(esub), KeyspaceEvent{3, "notify:a", "del"}, "First deletion has been notified.")
+	assert.Equal(*receive(esub), KeyspaceEvent{3, "other", "del"}, "Second deletion has been notified.")
+}
+
+// Test TLS connections with ACL authentication.
+func TestTLSAuthentication(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	srv := redistest.NewTLSServer()
+	defer srv.Close()
+	srv.AddUser("tester", "secret")
+	tc := &tls.Config{RootCAs: x509.NewCertPool()}
+	tc.RootCAs.AddCert(srv.Certificate())
+
+	db := Connect(Configuration{Address: srv.Address(), Username: "tester", Auth: "secret", TLSConfig: tc})
+	defer db.Close()
+	assert.True(db.Command("set", "tls:a", "foo").IsOK(), "'set' via TLS is ok.")
+	assert.Equal(db.Command("get", "tls:a").ValueAsString(), "foo", "'get' via TLS returns the value.")
+
+	wrong := Connect(Configuration{Address: srv.Address(), Username: "tester", Auth: "wrong", TLSConfig: tc, Retries: -1})
+	defer wrong.Close()
+	rs := wrong.Command("get", "tls:a")
+	assert.ErrorMatch(rs.Error(), "redis: WRONGPASS.*", "Wrong password is rejected.")
+
+	plain := Connect(Configuration{Address: srv.Address(), Username: "tester", Auth: "secret", Retries: -1})
+	defer plain.Close()
+	assert.False(plain.Command("get", "tls:a").IsOK(), "Connection without TLS fails.")
+
+	unknown := Connect(Configuration{Address: srv.Address(), Username: "tester", Auth: "secret", TLSConfig: &tls.Config{}, Retries: -1})
+	defer unknown.Close()
+	assert.False(unknown.Command("get", "tls:a").IsOK(), "Unknown certificate authority fails.")
+
+	tc.ServerName = "redis.example.com"
+	other := Connect(Configuration{Address: srv.Address(), Username: "tester", Auth: "secret", TLSConfig: tc, Retries: -1})
+	defer other.Close()
+	assert.False(other.Command("get", "tls:a").IsOK(), "Wrong server name fails.")
+}
+
+// Test deadlines and cancellation with contexts.
+func TestContext(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	srv := redistest.NewServer()
+	defer srv.Close()
+	db := Connect(Configuration{Address: srv.Address(), PoolSize: 1})
+	defer db.Close()
+
+	// Command with deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	rs := db.CommandContext(ctx, "blpop", "context:list", 5)
+	assert.True(IsTimeoutError(rs.Error()), "Blocking command timed out.")
+	assert.True(time.Now().Sub(start) < time.Second, "Command returned at the deadline.")
+	assert.Length(db.pool, 0, "Broken connection has not been pooled.")
+	assert.True(db.Command("set", "context:a", "a").IsOK(), "Next command is ok.")
+	assert.Length(db.pool, 1, "Connection has been pooled.")
+	rs = db.CommandContext(ctx, "get", "context:a")
+	assert.True(IsTimeoutError(rs.Error()), "Command with done context is not performed.")
+	assert.Length(db.pool, 1, "Connection is still pooled.")
+
+	// Cancelled transaction.
+	ctx, cancel = context.WithCancel(context.Background())
+	rs = db.MultiCommandContext(ctx, func(mc *MultiCommand) {
+		mc.Command("set", "context:b", "b")
+		cancel()
+		mc.Command("set", "context:c", "c")
+	})
+	assert.True(IsTimeoutError(rs.Error()), "Transaction has been cancelled.")
+	assert.False(db.Command("get", "context:b").IsOK(), "Transaction hasn't been executed.")
+
+	// Future.
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	fut := db.AsyncCommand("blpop", "context:future", 1)
+	rs = fut.ResultSetContext(ctx)
+	assert.True(IsTimeoutError(rs.Error()), "Waiting for the future timed out.")
+	db.Command("rpush", "context:future", "x")
+	rs = fut.ResultSetContext(context.Background())
+	assert.Equal(rs.ValuesAsStrings(), []string{"context:future", "x"}, "Future returns the result set later.")
+
+	// Subscription.
+	ctx, cancel = context.WithCancel(context.Background())
+	sub, err := db.SubscribeContext(ctx, "context:channel")
+	assert.Nil(err, "Subscription has been created.")
+	cancel()
+	select {
+	case _, ok := <-sub.Values():
+		assert.False(ok, "Subscription has been stopped.")
+	case <-time.After(time.Second):
+		assert.Fail("Subscription has not been stopped.")
+	}
+	_, err = db.SubscribeContext(ctx, "context:channel")
+	assert.True(IsTimeoutError(err), "Subscription with done context fails.")
+
+	// Connecting ends at the deadline.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err, "Listener has been created.")
+	address := l.Addr().String()
+	l.Close()
+	down := Connect(Configuration{Address: address, Retries: 10, RetryDelay: 500 * time.Millisecond})
+	defer down.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	rs = down.CommandContext(ctx, "ping")
+	assert.True(IsTimeoutError(rs.Error()), "Connecting timed out.")
+	assert.True(time.Now().Sub(start) < 400*time.Millisecond, "Connecting ended at the deadline.")
+	_, err = down.SubscribeContext(ctx, "context:channel")
+	assert.True(IsTimeoutError(err), "Connecting the subscription timed out.")
+}
+
 func TestBlockingPop(t *testing.T) {
 	assert := asserts.NewTestingAsserts(t, true)
-	db := Connect(Configuration{})
+	srv := redistest.NewServer()
+	defer srv.Close()
+	db := Connect(Configuration{Address: srv.Address()})
 
 	db.Command("del", "queue")
 
@@ -318,7 +1383,9 @@ func TestBlockingPop(t *testing.T) {
 
 func TestPubSub(t *testing.T) {
 	assert := asserts.NewTestingAsserts(t, true)
-	db := Connect(Configuration{})
+	srv := redistest.NewServer()
+	defer srv.Close()
+	db := Connect(Configuration{Address: srv.Address()})
 
 	sub, err := db.Subscribe("pubsub:1", "pubsub:2", "pubsub:3")
 	assert.Nil(err, "No error when subscribing.")
@@ -384,6 +1451,236 @@ func TestPubSub(t *testing.T) {
 	}
 }
 
+// Test the reconnecting of pooled connections and subscriptions.
+func TestReconnect(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	srv := redistest.NewServer()
+	defer srv.Close()
+	db := Connect(Configuration{Address: srv.Address(), PingInterval: time.Millisecond})
+	defer db.Close()
+
+	// Pooled connection gets lost.
+	rs := db.Command("ping")
+	assert.True(rs.IsOK(), "First ping is ok.")
+	srv.CloseConnections()
+	time.Sleep(50 * time.Millisecond)
+	rs = db.Command("ping")
+	assert.True(rs.IsOK(), "Ping after losing the connection is ok.")
+
+	// Subscription connection gets lost.
+	sub, err := db.Subscribe("reconnect")
+	assert.Nil(err, "No error when subscribing.")
+	srv.CloseConnections()
+	time.Sleep(500 * time.Millisecond)
+	db.Publish("reconnect", "foo")
+
+	select {
+	case value := <-sub.Values():
+		assert.Equal(value.Channel, "reconnect", "Value channel after reconnect has been ok.")
+		assert.Equal(value.Value.String(), "foo", "Value after reconnect has been ok.")
+	case <-time.After(time.Second):
+		assert.Fail("Timeout receiving a value after reconnect.")
+	}
+	assert.Nil(sub.Error(), "Subscription has no error.")
+	sub.Stop()
+}
+
+func TestErrorReply(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	srv := redistest.NewServer()
+	defer srv.Close()
+	db := Connect(Configuration{Address: srv.Address(), PoolSize: 1})
+	defer db.Close()
+
+	assert.True(db.Command("set", "error-reply", "a").IsOK(), "'set' is ok.")
+	assert.Length(db.pool, 1, "Connection has been pooled.")
+	urp := <-db.pool
+	db.pool <- urp
+	rs := db.Command("lpush", "error-reply", "b")
+	assert.ErrorMatch(rs.Error(), "redis: WRONGTYPE.*", "Wrong type is reported.")
+	assert.Length(db.pool, 1, "Connection is still pooled.")
+	assert.Equal(<-db.pool, urp, "Connection has not been replaced.")
+}
+
+func TestSubscriptionReconnect(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	srv := redistest.NewServer()
+	db := Connect(Configuration{Address: srv.Address(), Retries: 10, RetryDelay: 200 * time.Millisecond})
+	defer db.Close()
+
+	sub, err := db.Subscribe("reconnect:a", "reconnect:b")
+	assert.Nil(err, "No error when subscribing.")
+	srv.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	// Subscription is retrying to connect.
+	start := time.Now()
+	sub.Unsubscribe("reconnect:a")
+	sub.Subscribe("reconnect:c")
+	sub.Stop()
+	assert.True(time.Now().Sub(start) < 100*time.Millisecond, "Subscription is not blocked while reconnecting.")
+	select {
+	case _, ok := <-sub.Values():
+		assert.False(ok, "Subscription has been stopped.")
+	case <-time.After(time.Second):
+		assert.Fail("Reconnecting has not been stopped.")
+	}
+}
+
+// Test the retrieval of the master and the replicas via Sentinel.
+func TestSentinel(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+
+	masterA := newScriptedServer(namedServerScript("master-a"))
+	defer masterA.Close()
+	masterB := newScriptedServer(namedServerScript("master-b"))
+	defer masterB.Close()
+	replica := newScriptedServer(namedServerScript("replica"))
+	defer replica.Close()
+
+	var mutex sync.Mutex
+	master := masterA
+	sentinel := newScriptedServer(func(args []string) string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if len(args) < 3 || args[0] != "sentinel" || args[2] != "mymaster" {
+			return "-ERR unknown command\r\n"
+		}
+		switch args[1] {
+		case "get-master-addr-by-name":
+			return multiBulkReply(master.HostPort())
+		case "replicas":
+			host, port := replica.HostPort()
+			return "*1\r\n" + multiBulkReply("ip", host, "port", port, "flags", "slave")
+		}
+		return "-ERR unknown subcommand\r\n"
+	})
+	defer sentinel.Close()
+	dead := newScriptedServer(nil)
+	dead.Close()
+
+	db := Connect(Configuration{
+		SentinelAddresses: []string{dead.Address(), sentinel.Address()},
+		MasterName:        "mymaster",
+		ReplicaReads:      true,
+		Retries:           -1,
+	})
+	defer db.Close()
+
+	assert.Equal(db.Command("echo", "foo").ValueAsString(), "master-a", "Command sent to the first master.")
+	assert.Equal(db.Command("get", "foo").ValueAsString(), "replica", "Read-only command sent to the replica.")
+
+	// Announce the failover.
+	mutex.Lock()
+	master = masterB
+	mutex.Unlock()
+	hostA, portA := masterA.HostPort()
+	hostB, portB := masterB.HostPort()
+	time.Sleep(100 * time.Millisecond)
+	sentinel.Publish("+switch-master", strings.Join([]string{"mymaster", hostA, portA, hostB, portB}, " "))
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(db.Command("echo", "foo").ValueAsString(), "master-b", "Command sent to the new master.")
+	assert.Equal(db.Command("get", "foo").ValueAsString(), "replica", "Read-only command still sent to the replica.")
+}
+
+// Test the calculation of cluster slots.
+func TestClusterSlots(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+
+	assert.Equal(crc16([]byte("123456789")), uint16(0x31c3), "CRC16 of the check value is ok.")
+	assert.Equal(keySlot([]byte("foo")), 12182, "Slot of 'foo' is ok.")
+	assert.Equal(keySlot([]byte("{user1000}.following")), keySlot([]byte("{user1000}.followers")), "Hash tags lead to the same slot.")
+	assert.Equal(keySlot([]byte("{user1000}.following")), keySlot([]byte("user1000")), "Only the hash tag is hashed.")
+	assert.Equal(keySlot([]byte("foo{}{bar}")), keySlot([]byte("foo{}{bar}")), "Empty hash tags are ignored.")
+	assert.Different(keySlot([]byte("foo{}{bar}")), keySlot([]byte("bar")), "Empty hash tag leads to hashing the whole key.")
+
+	kind, slot, address := parseRedirection(errors.New("redis: MOVED 3999 127.0.0.1:6381"))
+	assert.Equal(kind, "MOVED", "Redirection kind is ok.")
+	assert.Equal(slot, 3999, "Redirection slot is ok.")
+	assert.Equal(address, "127.0.0.1:6381", "Redirection address is ok.")
+	kind, _, _ = parseRedirection(errors.New("redis: WRONGTYPE Operation against a key"))
+	assert.Equal(kind, "", "No redirection detected.")
+}
+
+// Test the following of cluster redirections.
+func TestCluster(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+
+	var mutex sync.Mutex
+	migrated := false
+	lastCommand := ""
+	var nodeA, nodeB *scriptedServer
+	slotsReply := func() string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		hostA, portA := nodeA.HostPort()
+		hostB, portB := nodeB.HostPort()
+		if !migrated {
+			return fmt.Sprintf("*1\r\n*3\r\n:0\r\n:16383\r\n%s", multiBulkReply(hostA, portA))
+		}
+		return fmt.Sprintf("*2\r\n*3\r\n:0\r\n:8191\r\n%s*3\r\n:8192\r\n:16383\r\n%s",
+			multiBulkReply(hostA, portA), multiBulkReply(hostB, portB))
+	}
+	nodeA = newScriptedServer(func(args []string) string {
+		switch {
+		case args[0] == "cluster":
+			return slotsReply()
+		case args[0] == "get" && args[1] == "foo":
+			mutex.Lock()
+			defer mutex.Unlock()
+			migrated = true
+			return fmt.Sprintf("-MOVED 12182 %s\r\n", nodeB.Address())
+		case args[0] == "get" && args[1] == "{bar}":
+			return fmt.Sprintf("-ASK %d %s\r\n", keySlot([]byte("bar")), nodeB.Address())
+		}
+		return bulkReply("node-a")
+	})
+	defer nodeA.Close()
+	nodeB = newScriptedServer(func(args []string) string {
+		mutex.Lock()
+		previous := lastCommand
+		lastCommand = args[0]
+		mutex.Unlock()
+		switch {
+		case args[0] == "cluster":
+			return slotsReply()
+		case args[0] == "asking":
+			return "+OK\r\n"
+		case args[0] == "get" && args[1] == "{bar}" && previous != "asking":
+			return fmt.Sprintf("-MOVED %d %s\r\n", keySlot([]byte("bar")), nodeA.Address())
+		}
+		return bulkReply("node-b")
+	})
+	defer nodeB.Close()
+
+	seed := nodeA.Address()
+	cl := ConnectCluster(Configuration{ClusterAddresses: []string{seed}, SentinelAddresses: []string{seed}, ReplicaReads: true})
+	defer cl.Close()
+
+	// Node configurations have no sentinel or cluster settings.
+	dbA := cl.nodes[seed]
+	assert.NotNil(dbA, "Seed connection is kept as node.")
+	assert.Length(cl.nodes, 1, "Only the reported node is connected.")
+	assert.Nil(dbA.configuration.SentinelAddresses, "Node has no sentinels.")
+	assert.False(dbA.configuration.ReplicaReads, "Node has no replica reads.")
+	assert.Nil(dbA.configuration.ClusterAddresses, "Node has no cluster addresses.")
+
+	assert.Equal(cl.Command("get", "baz").ValueAsString(), "node-a", "Command sent to the only node.")
+	assert.Equal(cl.Command("get", "foo").ValueAsString(), "node-b", "MOVED redirection has been followed.")
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(cl.Command("get", "yadda").ValueAsString(), "node-b", "Refreshed slots are used.")
+	assert.Equal(cl.Command("get", "baz").ValueAsString(), "node-a", "Other slots are still served by the first node.")
+	assert.Equal(cl.Command("get", "{bar}").ValueAsString(), "node-b", "ASK redirection has been followed.")
+	assert.Nil(cl.refresh(), "Slots have been refreshed.")
+	cl.mutex.RLock()
+	assert.Length(cl.nodes, 2, "Both nodes are connected.")
+	assert.Equal(cl.nodes[nodeA.Address()], dbA, "Existing connection has been reused.")
+	cl.mutex.RUnlock()
+	node := cl.AsyncCommand("ping").ResultSet().ValueAsString()
+	assert.True(node == "node-a" || node == "node-b", "Asynchronous command without key has been sent to any node.")
+}
+
 // Test illegal databases.
 func TestIllegalDatabases(t *testing.T) {
 	if testing.Short() {
@@ -392,7 +1689,7 @@ func TestIllegalDatabases(t *testing.T) {
 
 	// Test illegal database number.
 	assert := asserts.NewTestingAsserts(t, true)
-	db := Connect(Configuration{Database: 4711})
+	db := connectLocal(t, Configuration{Database: 4711})
 
 	rs := db.Command("ping")
 	assert.ErrorMatch(rs.Error(), "redis: invalid DB index", "Error message for invalid DB index is ok.")
@@ -412,7 +1709,7 @@ func TestLongRun(t *testing.T) {
 	}
 
 	assert := asserts.NewTestingAsserts(t, true)
-	db := Connect(Configuration{})
+	db := connectLocal(t, Configuration{})
 	wait := make(chan bool)
 
 	for i := 0; i < 100; i++ {
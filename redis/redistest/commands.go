@@ -0,0 +1,1453 @@
+// Tideland Common Go Library - Redis / Test Server
+//
+// Copyright (C) 2009-2013 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package redistest
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//--------------------
+// ERRORS
+//--------------------
+
+var (
+	errWrongType   = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	errNotInteger  = errors.New("ERR value is not an integer or out of range")
+	errNotFloat    = errors.New("ERR value is not a valid float")
+	errSyntax      = errors.New("ERR syntax error")
+	errNoSuchKey   = errors.New("ERR no such key")
+	errInvalidDB   = errors.New("ERR DB index is out of range")
+	errMinMaxFloat = errors.New("ERR min or max is not a float")
+	errWrongPass   = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+)
+
+//--------------------
+// DATABASE
+//--------------------
+
+// Types of the stored values.
+const (
+	typeString = "string"
+	typeHash   = "hash"
+	typeList   = "list"
+	typeSet    = "set"
+	typeZSet   = "zset"
+)
+
+// item is a stored value with its optional expiration.
+type item struct {
+	kind    string
+	value   interface{}
+	expires time.Time
+}
+
+// database contains the items of one database.
+type database struct {
+	server *Server
+	index  int
+	items  map[string]*item
+}
+
+// newDatabase creates an empty database.
+func newDatabase(s *Server, index int) *database {
+	return &database{s, index, make(map[string]*item)}
+}
+
+// notify publishes the keyspace and keyevent notifications
+// of an event if they are enabled.
+func (d *database) notify(event, key string) {
+	events := d.server.notifications
+	if strings.Contains(events, "K") {
+		d.server.publish([]byte(fmt.Sprintf("__keyspace@%d__:%s", d.index, key)), []byte(event))
+	}
+	if strings.Contains(events, "E") {
+		d.server.publish([]byte(fmt.Sprintf("__keyevent@%d__:%s", d.index, event)), []byte(key))
+	}
+}
+
+// get returns the item for the key if it exists and
+// has not yet expired.
+func (d *database) get(key string) *item {
+	it, ok := d.items[key]
+	if !ok {
+		return nil
+	}
+	if !it.expires.IsZero() && !time.Now().Before(it.expires) {
+		delete(d.items, key)
+		d.notify("expired", key)
+		return nil
+	}
+	return it
+}
+
+// lookup returns the item for the key if it has the kind. If
+// it doesn't exist and create is true a new one is created.
+func (d *database) lookup(key, kind string, create bool) (*item, error) {
+	it := d.get(key)
+	if it == nil {
+		if !create {
+			return nil, nil
+		}
+		it = &item{kind: kind}
+		switch kind {
+		case typeString:
+			it.value = []byte{}
+		case typeHash:
+			it.value = map[string][]byte{}
+		case typeList:
+			it.value = [][]byte{}
+		case typeSet:
+			it.value = map[string]bool{}
+		case typeZSet:
+			it.value = map[string]float64{}
+		}
+		d.items[key] = it
+		return it, nil
+	}
+	if it.kind != kind {
+		return nil, errWrongType
+	}
+	return it, nil
+}
+
+// cleanup removes the key if its container is empty.
+func (d *database) cleanup(key string) {
+	it := d.items[key]
+	if it == nil {
+		return
+	}
+	empty := false
+	switch v := it.value.(type) {
+	case map[string][]byte:
+		empty = len(v) == 0
+	case [][]byte:
+		empty = len(v) == 0
+	case map[string]bool:
+		empty = len(v) == 0
+	case map[string]float64:
+		empty = len(v) == 0
+	}
+	if empty {
+		delete(d.items, key)
+	}
+}
+
+// keys returns the sorted keys of all items not yet expired.
+func (d *database) keys() []string {
+	keys := []string{}
+	for key := range d.items {
+		if d.get(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//--------------------
+// COMMANDS
+//--------------------
+
+// handler performs a command. The server is locked.
+type handler func(c *connection, args [][]byte) interface{}
+
+// command describes a supported command with its minimum
+// and maximum number of arguments, -1 means unlimited.
+type command struct {
+	min      int
+	max      int
+	handler  handler
+	pubsub   bool
+	blocking bool
+}
+
+// commands contains all supported commands.
+var commands = map[string]*command{
+	// Connection.
+	"auth":   {1, 2, cmdAuth, false, false},
+	"echo":   {1, 1, cmdEcho, false, false},
+	"ping":   {0, 1, cmdPing, false, false},
+	"quit":   {0, 0, cmdOK, false, false},
+	"select": {1, 1, cmdSelect, false, false},
+	// Keys.
+	"dbsize":   {0, 0, cmdDBSize, false, false},
+	"del":      {1, -1, cmdDel, false, false},
+	"exists":   {1, -1, cmdExists, false, false},
+	"expire":   {2, 2, cmdExpire, false, false},
+	"flushall": {0, 1, cmdFlushAll, false, false},
+	"flushdb":  {0, 1, cmdFlushDB, false, false},
+	"keys":     {1, 1, cmdKeys, false, false},
+	"persist":  {1, 1, cmdPersist, false, false},
+	"pexpire":  {2, 2, cmdExpire, false, false},
+	"pttl":     {1, 1, cmdTTL, false, false},
+	"rename":   {2, 2, cmdRename, false, false},
+	"scan":     {1, -1, cmdScan, false, false},
+	"ttl":      {1, 1, cmdTTL, false, false},
+	"type":     {1, 1, cmdType, false, false},
+	// Strings.
+	"append": {2, 2, cmdAppend, false, false},
+	"decr":   {1, 1, cmdIncr, false, false},
+	"decrby": {2, 2, cmdIncr, false, false},
+	"get":    {1, 1, cmdGet, false, false},
+	"getset": {2, 2, cmdGetSet, false, false},
+	"incr":   {1, 1, cmdIncr, false, false},
+	"incrby": {2, 2, cmdIncr, false, false},
+	"mget":   {1, -1, cmdMGet, false, false},
+	"mset":   {2, -1, cmdMSet, false, false},
+	"psetex": {3, 3, cmdSetEx, false, false},
+	"set":    {2, -1, cmdSet, false, false},
+	"setex":  {3, 3, cmdSetEx, false, false},
+	"setnx":  {2, 2, cmdSetNX, false, false},
+	"strlen": {1, 1, cmdStrLen, false, false},
+	// Hashes.
+	"hdel":    {2, -1, cmdHDel, false, false},
+	"hexists": {2, 2, cmdHExists, false, false},
+	"hget":    {2, 2, cmdHGet, false, false},
+	"hgetall": {1, 1, cmdHGetAll, false, false},
+	"hincrby": {3, 3, cmdHIncrBy, false, false},
+	"hkeys":   {1, 1, cmdHKeys, false, false},
+	"hlen":    {1, 1, cmdHLen, false, false},
+	"hmget":   {2, -1, cmdHMGet, false, false},
+	"hmset":   {3, -1, cmdHSet, false, false},
+	"hscan":   {2, -1, cmdScan, false, false},
+	"hset":    {3, -1, cmdHSet, false, false},
+	"hvals":   {1, 1, cmdHVals, false, false},
+	// Lists.
+	"blpop":  {2, -1, cmdBPop, false, true},
+	"brpop":  {2, -1, cmdBPop, false, true},
+	"lindex": {2, 2, cmdLIndex, false, false},
+	"llen":   {1, 1, cmdLLen, false, false},
+	"lpop":   {1, 1, cmdPop, false, false},
+	"lpush":  {2, -1, cmdPush, false, false},
+	"lrange": {3, 3, cmdLRange, false, false},
+	"rpop":   {1, 1, cmdPop, false, false},
+	"rpush":  {2, -1, cmdPush, false, false},
+	// Sets.
+	"sadd":      {2, -1, cmdSAdd, false, false},
+	"scard":     {1, 1, cmdSCard, false, false},
+	"sismember": {2, 2, cmdSIsMember, false, false},
+	"smembers":  {1, 1, cmdSMembers, false, false},
+	"srem":      {2, -1, cmdSRem, false, false},
+	"sscan":     {2, -1, cmdScan, false, false},
+	// Sorted sets.
+	"zadd":             {3, -1, cmdZAdd, false, false},
+	"zcard":            {1, 1, cmdZCard, false, false},
+	"zcount":           {3, 3, cmdZCount, false, false},
+	"zincrby":          {3, 3, cmdZIncrBy, false, false},
+	"zrange":           {3, 4, cmdZRange, false, false},
+	"zrangebyscore":    {3, -1, cmdZRangeByScore, false, false},
+	"zrem":             {2, -1, cmdZRem, false, false},
+	"zremrangebyscore": {3, 3, cmdZRemRangeByScore, false, false},
+	"zrevrange":        {3, 4, cmdZRange, false, false},
+	"zscan":            {2, -1, cmdScan, false, false},
+	"zscore":           {2, 2, cmdZScore, false, false},
+	// Server.
+	"config": {2, 3, cmdConfig, false, false},
+	// Pub/sub.
+	"psubscribe":   {1, -1, nil, true, false},
+	"publish":      {2, 2, cmdPublish, false, false},
+	"punsubscribe": {0, -1, nil, true, false},
+	"subscribe":    {1, -1, nil, true, false},
+	"unsubscribe":  {0, -1, nil, true, false},
+}
+
+// events maps the commands to the events of their keyspace
+// notifications. The conditional events are only notified if
+// the command changed something.
+var events = map[string]struct {
+	event       string
+	conditional bool
+}{
+	"append":           {"append", false},
+	"decr":             {"decrby", false},
+	"decrby":           {"decrby", false},
+	"expire":           {"expire", true},
+	"getset":           {"set", false},
+	"hdel":             {"hdel", true},
+	"hincrby":          {"hincrby", false},
+	"hmset":            {"hset", false},
+	"hset":             {"hset", false},
+	"incr":             {"incrby", false},
+	"incrby":           {"incrby", false},
+	"lpop":             {"lpop", false},
+	"lpush":            {"lpush", false},
+	"persist":          {"persist", true},
+	"pexpire":          {"expire", true},
+	"psetex":           {"set", false},
+	"rpop":             {"rpop", false},
+	"rpush":            {"rpush", false},
+	"sadd":             {"sadd", true},
+	"set":              {"set", false},
+	"setex":            {"set", false},
+	"setnx":            {"set", true},
+	"srem":             {"srem", true},
+	"zadd":             {"zadd", false},
+	"zincrby":          {"zincr", false},
+	"zrem":             {"zrem", true},
+	"zremrangebyscore": {"zremrangebyscore", true},
+}
+
+// notify publishes the notifications for a performed
+// command based on its reply.
+func notify(c *connection, name string, args [][]byte, reply interface{}) {
+	e, ok := events[name]
+	if !ok {
+		return
+	}
+	switch r := reply.(type) {
+	case nil, error:
+		return
+	case int:
+		if e.conditional && r == 0 {
+			return
+		}
+	}
+	c.database().notify(e.event, string(args[0]))
+}
+
+// lookupCommand returns the command with the name after
+// checking the number of arguments.
+func lookupCommand(name string, args [][]byte) (*command, error) {
+	cmd, ok := commands[name]
+	if !ok {
+		return nil, fmt.Errorf("ERR unknown command '%s'", name)
+	}
+	if len(args) < cmd.min || (cmd.max >= 0 && len(args) > cmd.max) {
+		return nil, fmt.Errorf("ERR wrong number of arguments for '%s' command", name)
+	}
+	return cmd, nil
+}
+
+//--------------------
+// CONNECTION COMMANDS
+//--------------------
+
+func cmdOK(c *connection, args [][]byte) interface{} {
+	return okReply
+}
+
+func cmdEcho(c *connection, args [][]byte) interface{} {
+	return args[0]
+}
+
+func cmdAuth(c *connection, args [][]byte) interface{} {
+	username, password := "default", string(args[0])
+	if len(args) == 2 {
+		username, password = string(args[0]), string(args[1])
+	}
+	if !c.server.authenticate(username, password) {
+		return errWrongPass
+	}
+	c.authenticated = true
+	return okReply
+}
+
+func cmdPing(c *connection, args [][]byte) interface{} {
+	if len(args) == 1 {
+		return args[0]
+	}
+	return status("PONG")
+}
+
+func cmdSelect(c *connection, args [][]byte) interface{} {
+	index, err := strconv.Atoi(string(args[0]))
+	if err != nil || index < 0 || index > 15 {
+		return errInvalidDB
+	}
+	c.index = index
+	return okReply
+}
+
+//--------------------
+// KEY COMMANDS
+//--------------------
+
+func cmdDBSize(c *connection, args [][]byte) interface{} {
+	return len(c.database().keys())
+}
+
+func cmdDel(c *connection, args [][]byte) interface{} {
+	d := c.database()
+	deleted := 0
+	for _, key := range args {
+		if d.get(string(key)) != nil {
+			delete(d.items, string(key))
+			d.notify("del", string(key))
+			deleted++
+		}
+	}
+	return deleted
+}
+
+func cmdExists(c *connection, args [][]byte) interface{} {
+	d := c.database()
+	existing := 0
+	for _, key := range args {
+		if d.get(string(key)) != nil {
+			existing++
+		}
+	}
+	return existing
+}
+
+func cmdExpire(c *connection, args [][]byte) interface{} {
+	it := c.database().get(string(args[0]))
+	timeout, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	if it == nil {
+		return 0
+	}
+	unit := time.Second
+	if len(c.current) > 0 && c.current[0] == 'p' {
+		unit = time.Millisecond
+	}
+	it.expires = time.Now().Add(time.Duration(timeout) * unit)
+	return 1
+}
+
+func cmdFlushAll(c *connection, args [][]byte) interface{} {
+	c.server.databases = make(map[int]*database)
+	return okReply
+}
+
+func cmdFlushDB(c *connection, args [][]byte) interface{} {
+	delete(c.server.databases, c.index)
+	return okReply
+}
+
+func cmdKeys(c *connection, args [][]byte) interface{} {
+	keys := []interface{}{}
+	for _, key := range c.database().keys() {
+		if match(string(args[0]), key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func cmdPersist(c *connection, args [][]byte) interface{} {
+	it := c.database().get(string(args[0]))
+	if it == nil || it.expires.IsZero() {
+		return 0
+	}
+	it.expires = time.Time{}
+	return 1
+}
+
+func cmdRename(c *connection, args [][]byte) interface{} {
+	d := c.database()
+	it := d.get(string(args[0]))
+	if it == nil {
+		return errNoSuchKey
+	}
+	delete(d.items, string(args[0]))
+	d.items[string(args[1])] = it
+	return okReply
+}
+
+func cmdTTL(c *connection, args [][]byte) interface{} {
+	it := c.database().get(string(args[0]))
+	switch {
+	case it == nil:
+		return -2
+	case it.expires.IsZero():
+		return -1
+	}
+	ttl := it.expires.Sub(time.Now())
+	if c.current == "pttl" {
+		return int64(ttl / time.Millisecond)
+	}
+	return int64((ttl + time.Second/2) / time.Second)
+}
+
+func cmdType(c *connection, args [][]byte) interface{} {
+	it := c.database().get(string(args[0]))
+	if it == nil {
+		return status("none")
+	}
+	return status(it.kind)
+}
+
+// cmdScan returns all matching elements at once, so the
+// returned cursor is always 0.
+func cmdScan(c *connection, args [][]byte) interface{} {
+	d := c.database()
+	var elements [][]byte
+	options := args[1:]
+	if c.current != "scan" {
+		options = args[2:]
+	}
+	pattern, kind := "*", ""
+	for i := 0; i < len(options); i += 2 {
+		if i+1 >= len(options) {
+			return errSyntax
+		}
+		switch strings.ToLower(string(options[i])) {
+		case "match":
+			pattern = string(options[i+1])
+		case "type":
+			kind = string(options[i+1])
+		case "count":
+		default:
+			return errSyntax
+		}
+	}
+	switch c.current {
+	case "scan":
+		for _, key := range d.keys() {
+			if match(pattern, key) && (kind == "" || d.get(key).kind == kind) {
+				elements = append(elements, []byte(key))
+			}
+		}
+	case "hscan":
+		it, err := d.lookup(string(args[0]), typeHash, false)
+		if err != nil {
+			return err
+		}
+		if it != nil {
+			h := it.value.(map[string][]byte)
+			for _, field := range sortedKeys(h) {
+				if match(pattern, field) {
+					elements = append(elements, []byte(field), h[field])
+				}
+			}
+		}
+	case "sscan":
+		it, err := d.lookup(string(args[0]), typeSet, false)
+		if err != nil {
+			return err
+		}
+		if it != nil {
+			for _, member := range sortedKeys(it.value) {
+				if match(pattern, member) {
+					elements = append(elements, []byte(member))
+				}
+			}
+		}
+	case "zscan":
+		it, err := d.lookup(string(args[0]), typeZSet, false)
+		if err != nil {
+			return err
+		}
+		if it != nil {
+			for _, sm := range sortedMembers(it.value.(map[string]float64)) {
+				if match(pattern, sm.member) {
+					elements = append(elements, []byte(sm.member), formatFloat(sm.score))
+				}
+			}
+		}
+	}
+	if elements == nil {
+		elements = [][]byte{}
+	}
+	return []interface{}{"0", elements}
+}
+
+//--------------------
+// STRING COMMANDS
+//--------------------
+
+// getString returns the string value of the key or nil.
+func getString(c *connection, key []byte) ([]byte, error) {
+	it, err := c.database().lookup(string(key), typeString, false)
+	if it == nil || err != nil {
+		return nil, err
+	}
+	return it.value.([]byte), nil
+}
+
+// setString sets the string value of the key and resets
+// an expiration.
+func setString(c *connection, key, value []byte) {
+	c.database().items[string(key)] = &item{
+		kind:  typeString,
+		value: append([]byte{}, value...),
+	}
+}
+
+func cmdAppend(c *connection, args [][]byte) interface{} {
+	it, err := c.database().lookup(string(args[0]), typeString, true)
+	if err != nil {
+		return err
+	}
+	it.value = append(it.value.([]byte), args[1]...)
+	return len(it.value.([]byte))
+}
+
+func cmdGet(c *connection, args [][]byte) interface{} {
+	value, err := getString(c, args[0])
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return nil
+	}
+	return value
+}
+
+func cmdGetSet(c *connection, args [][]byte) interface{} {
+	value, err := getString(c, args[0])
+	if err != nil {
+		return err
+	}
+	setString(c, args[0], args[1])
+	if value == nil {
+		return nil
+	}
+	return value
+}
+
+func cmdIncr(c *connection, args [][]byte) interface{} {
+	by := int64(1)
+	if len(args) == 2 {
+		var err error
+		if by, err = strconv.ParseInt(string(args[1]), 10, 64); err != nil {
+			return errNotInteger
+		}
+	}
+	if strings.HasPrefix(c.current, "decr") {
+		by = -by
+	}
+	it, err := c.database().lookup(string(args[0]), typeString, true)
+	if err != nil {
+		return err
+	}
+	current := int64(0)
+	if len(it.value.([]byte)) > 0 {
+		if current, err = strconv.ParseInt(string(it.value.([]byte)), 10, 64); err != nil {
+			return errNotInteger
+		}
+	}
+	current += by
+	it.value = []byte(strconv.FormatInt(current, 10))
+	return current
+}
+
+func cmdMGet(c *connection, args [][]byte) interface{} {
+	values := []interface{}{}
+	for _, key := range args {
+		value, err := getString(c, key)
+		if err != nil || value == nil {
+			values = append(values, nil)
+			continue
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+func cmdMSet(c *connection, args [][]byte) interface{} {
+	if len(args)%2 != 0 {
+		return fmt.Errorf("ERR wrong number of arguments for 'mset' command")
+	}
+	for i := 0; i < len(args); i += 2 {
+		setString(c, args[i], args[i+1])
+	}
+	return okReply
+}
+
+func cmdSet(c *connection, args [][]byte) interface{} {
+	var ttl time.Duration
+	nx, xx := false, false
+	for i := 2; i < len(args); i++ {
+		switch option := strings.ToLower(string(args[i])); option {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "ex", "px":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			timeout, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil || timeout <= 0 {
+				return errors.New("ERR invalid expire time in 'set' command")
+			}
+			ttl = time.Duration(timeout) * time.Second
+			if option == "px" {
+				ttl = time.Duration(timeout) * time.Millisecond
+			}
+			i++
+		default:
+			return errSyntax
+		}
+	}
+	exists := c.database().get(string(args[0])) != nil
+	if (nx && exists) || (xx && !exists) {
+		return nil
+	}
+	setString(c, args[0], args[1])
+	if ttl > 0 {
+		c.database().items[string(args[0])].expires = time.Now().Add(ttl)
+	}
+	return okReply
+}
+
+func cmdSetEx(c *connection, args [][]byte) interface{} {
+	timeout, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil || timeout <= 0 {
+		return errors.New("ERR invalid expire time in 'setex' command")
+	}
+	unit := time.Second
+	if c.current == "psetex" {
+		unit = time.Millisecond
+	}
+	setString(c, args[0], args[2])
+	c.database().items[string(args[0])].expires = time.Now().Add(time.Duration(timeout) * unit)
+	return okReply
+}
+
+func cmdSetNX(c *connection, args [][]byte) interface{} {
+	if c.database().get(string(args[0])) != nil {
+		return 0
+	}
+	setString(c, args[0], args[1])
+	return 1
+}
+
+func cmdStrLen(c *connection, args [][]byte) interface{} {
+	value, err := getString(c, args[0])
+	if err != nil {
+		return err
+	}
+	return len(value)
+}
+
+//--------------------
+// HASH COMMANDS
+//--------------------
+
+// getHash returns the hash of the key or nil.
+func getHash(c *connection, key []byte, create bool) (map[string][]byte, error) {
+	it, err := c.database().lookup(string(key), typeHash, create)
+	if it == nil || err != nil {
+		return nil, err
+	}
+	return it.value.(map[string][]byte), nil
+}
+
+func cmdHDel(c *connection, args [][]byte) interface{} {
+	h, err := getHash(c, args[0], false)
+	if err != nil {
+		return err
+	}
+	deleted := 0
+	for _, field := range args[1:] {
+		if _, ok := h[string(field)]; ok {
+			delete(h, string(field))
+			deleted++
+		}
+	}
+	c.database().cleanup(string(args[0]))
+	return deleted
+}
+
+func cmdHExists(c *connection, args [][]byte) interface{} {
+	h, err := getHash(c, args[0], false)
+	if err != nil {
+		return err
+	}
+	if _, ok := h[string(args[1])]; ok {
+		return 1
+	}
+	return 0
+}
+
+func cmdHGet(c *connection, args [][]byte) interface{} {
+	h, err := getHash(c, args[0], false)
+	if err != nil {
+		return err
+	}
+	if value, ok := h[string(args[1])]; ok {
+		return value
+	}
+	return nil
+}
+
+func cmdHGetAll(c *connection, args [][]byte) interface{} {
+	h, err := getHash(c, args[0], false)
+	if err != nil {
+		return err
+	}
+	values := [][]byte{}
+	for _, field := range sortedKeys(h) {
+		values = append(values, []byte(field), h[field])
+	}
+	return values
+}
+
+func cmdHIncrBy(c *connection, args [][]byte) interface{} {
+	by, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	h, err := getHash(c, args[0], true)
+	if err != nil {
+		return err
+	}
+	current := int64(0)
+	if value, ok := h[string(args[1])]; ok {
+		if current, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+			return errors.New("ERR hash value is not an integer")
+		}
+	}
+	current += by
+	h[string(args[1])] = []byte(strconv.FormatInt(current, 10))
+	return current
+}
+
+func cmdHKeys(c *connection, args [][]byte) interface{} {
+	h, err := getHash(c, args[0], false)
+	if err != nil {
+		return err
+	}
+	fields := [][]byte{}
+	for _, field := range sortedKeys(h) {
+		fields = append(fields, []byte(field))
+	}
+	return fields
+}
+
+func cmdHLen(c *connection, args [][]byte) interface{} {
+	h, err := getHash(c, args[0], false)
+	if err != nil {
+		return err
+	}
+	return len(h)
+}
+
+func cmdHMGet(c *connection, args [][]byte) interface{} {
+	h, err := getHash(c, args[0], false)
+	if err != nil {
+		return err
+	}
+	values := []interface{}{}
+	for _, field := range args[1:] {
+		if value, ok := h[string(field)]; ok {
+			values = append(values, value)
+		} else {
+			values = append(values, nil)
+		}
+	}
+	return values
+}
+
+func cmdHSet(c *connection, args [][]byte) interface{} {
+	if len(args)%2 != 1 {
+		return fmt.Errorf("ERR wrong number of arguments for '%s' command", c.current)
+	}
+	h, err := getHash(c, args[0], true)
+	if err != nil {
+		return err
+	}
+	added := 0
+	for i := 1; i < len(args); i += 2 {
+		if _, ok := h[string(args[i])]; !ok {
+			added++
+		}
+		h[string(args[i])] = append([]byte{}, args[i+1]...)
+	}
+	if c.current == "hmset" {
+		return okReply
+	}
+	return added
+}
+
+func cmdHVals(c *connection, args [][]byte) interface{} {
+	h, err := getHash(c, args[0], false)
+	if err != nil {
+		return err
+	}
+	values := [][]byte{}
+	for _, field := range sortedKeys(h) {
+		values = append(values, h[field])
+	}
+	return values
+}
+
+//--------------------
+// LIST COMMANDS
+//--------------------
+
+// getList returns the list item of the key or nil.
+func getList(c *connection, key []byte, create bool) (*item, [][]byte, error) {
+	it, err := c.database().lookup(string(key), typeList, create)
+	if it == nil || err != nil {
+		return nil, nil, err
+	}
+	return it, it.value.([][]byte), nil
+}
+
+// pop removes the first or last element of a list.
+func pop(c *connection, key []byte, left bool) ([]byte, error) {
+	it, l, err := getList(c, key, false)
+	if it == nil || err != nil {
+		return nil, err
+	}
+	var value []byte
+	if left {
+		value, it.value = l[0], l[1:]
+	} else {
+		value, it.value = l[len(l)-1], l[:len(l)-1]
+	}
+	c.database().cleanup(string(key))
+	return value, nil
+}
+
+func cmdBPop(c *connection, args [][]byte) interface{} {
+	for _, key := range args[:len(args)-1] {
+		value, err := pop(c, key, c.current == "blpop")
+		if err != nil {
+			return err
+		}
+		if value != nil {
+			return [][]byte{key, value}
+		}
+	}
+	return nilArray{}
+}
+
+func cmdLIndex(c *connection, args [][]byte) interface{} {
+	_, l, err := getList(c, args[0], false)
+	if err != nil {
+		return err
+	}
+	index, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return errNotInteger
+	}
+	if index < 0 {
+		index += len(l)
+	}
+	if index < 0 || index >= len(l) {
+		return nil
+	}
+	return l[index]
+}
+
+func cmdLLen(c *connection, args [][]byte) interface{} {
+	_, l, err := getList(c, args[0], false)
+	if err != nil {
+		return err
+	}
+	return len(l)
+}
+
+func cmdPop(c *connection, args [][]byte) interface{} {
+	value, err := pop(c, args[0], c.current == "lpop")
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return nil
+	}
+	return value
+}
+
+func cmdPush(c *connection, args [][]byte) interface{} {
+	it, l, err := getList(c, args[0], true)
+	if err != nil {
+		return err
+	}
+	for _, value := range args[1:] {
+		value = append([]byte{}, value...)
+		if c.current == "lpush" {
+			l = append([][]byte{value}, l...)
+		} else {
+			l = append(l, value)
+		}
+	}
+	it.value = l
+	return len(l)
+}
+
+func cmdLRange(c *connection, args [][]byte) interface{} {
+	_, l, err := getList(c, args[0], false)
+	if err != nil {
+		return err
+	}
+	start, stop, err := parseRange(args[1], args[2], len(l))
+	if err != nil {
+		return err
+	}
+	if start > stop {
+		return [][]byte{}
+	}
+	return l[start : stop+1]
+}
+
+//--------------------
+// SET COMMANDS
+//--------------------
+
+// getSet returns the set of the key or nil.
+func getSet(c *connection, key []byte, create bool) (map[string]bool, error) {
+	it, err := c.database().lookup(string(key), typeSet, create)
+	if it == nil || err != nil {
+		return nil, err
+	}
+	return it.value.(map[string]bool), nil
+}
+
+func cmdSAdd(c *connection, args [][]byte) interface{} {
+	s, err := getSet(c, args[0], true)
+	if err != nil {
+		return err
+	}
+	added := 0
+	for _, member := range args[1:] {
+		if !s[string(member)] {
+			s[string(member)] = true
+			added++
+		}
+	}
+	return added
+}
+
+func cmdSCard(c *connection, args [][]byte) interface{} {
+	s, err := getSet(c, args[0], false)
+	if err != nil {
+		return err
+	}
+	return len(s)
+}
+
+func cmdSIsMember(c *connection, args [][]byte) interface{} {
+	s, err := getSet(c, args[0], false)
+	if err != nil {
+		return err
+	}
+	if s[string(args[1])] {
+		return 1
+	}
+	return 0
+}
+
+func cmdSMembers(c *connection, args [][]byte) interface{} {
+	s, err := getSet(c, args[0], false)
+	if err != nil {
+		return err
+	}
+	members := [][]byte{}
+	for _, member := range sortedKeys(s) {
+		members = append(members, []byte(member))
+	}
+	return members
+}
+
+func cmdSRem(c *connection, args [][]byte) interface{} {
+	s, err := getSet(c, args[0], false)
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, member := range args[1:] {
+		if s[string(member)] {
+			delete(s, string(member))
+			removed++
+		}
+	}
+	c.database().cleanup(string(args[0]))
+	return removed
+}
+
+//--------------------
+// SORTED SET COMMANDS
+//--------------------
+
+// scoredMember is a member of a sorted set with its score.
+type scoredMember struct {
+	member string
+	score  float64
+}
+
+// getZSet returns the sorted set of the key or nil.
+func getZSet(c *connection, key []byte, create bool) (map[string]float64, error) {
+	it, err := c.database().lookup(string(key), typeZSet, create)
+	if it == nil || err != nil {
+		return nil, err
+	}
+	return it.value.(map[string]float64), nil
+}
+
+func cmdZAdd(c *connection, args [][]byte) interface{} {
+	if len(args)%2 != 1 {
+		return errSyntax
+	}
+	scores := make([]float64, 0, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		score, err := parseFloat(args[i])
+		if err != nil {
+			return err
+		}
+		scores = append(scores, score)
+	}
+	z, err := getZSet(c, args[0], true)
+	if err != nil {
+		return err
+	}
+	added := 0
+	for i, score := range scores {
+		member := string(args[2+i*2])
+		if _, ok := z[member]; !ok {
+			added++
+		}
+		z[member] = score
+	}
+	return added
+}
+
+func cmdZCard(c *connection, args [][]byte) interface{} {
+	z, err := getZSet(c, args[0], false)
+	if err != nil {
+		return err
+	}
+	return len(z)
+}
+
+func cmdZCount(c *connection, args [][]byte) interface{} {
+	z, err := getZSet(c, args[0], false)
+	if err != nil {
+		return err
+	}
+	in, err := parseScoreRange(args[1], args[2])
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, score := range z {
+		if in(score) {
+			count++
+		}
+	}
+	return count
+}
+
+func cmdZIncrBy(c *connection, args [][]byte) interface{} {
+	by, err := parseFloat(args[1])
+	if err != nil {
+		return err
+	}
+	z, err := getZSet(c, args[0], true)
+	if err != nil {
+		return err
+	}
+	z[string(args[2])] += by
+	return formatFloat(z[string(args[2])])
+}
+
+func cmdZRange(c *connection, args [][]byte) interface{} {
+	withScores := false
+	if len(args) == 4 {
+		if strings.ToLower(string(args[3])) != "withscores" {
+			return errSyntax
+		}
+		withScores = true
+	}
+	z, err := getZSet(c, args[0], false)
+	if err != nil {
+		return err
+	}
+	members := sortedMembers(z)
+	if c.current == "zrevrange" {
+		for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+			members[i], members[j] = members[j], members[i]
+		}
+	}
+	start, stop, err := parseRange(args[1], args[2], len(members))
+	if err != nil {
+		return err
+	}
+	if start > stop {
+		return [][]byte{}
+	}
+	return membersReply(members[start:stop+1], withScores)
+}
+
+func cmdZRangeByScore(c *connection, args [][]byte) interface{} {
+	withScores := false
+	offset, count := 0, -1
+	for i := 3; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "withscores":
+			withScores = true
+		case "limit":
+			if i+2 >= len(args) {
+				return errSyntax
+			}
+			var oerr, cerr error
+			offset, oerr = strconv.Atoi(string(args[i+1]))
+			count, cerr = strconv.Atoi(string(args[i+2]))
+			if oerr != nil || cerr != nil {
+				return errNotInteger
+			}
+			i += 2
+		default:
+			return errSyntax
+		}
+	}
+	z, err := getZSet(c, args[0], false)
+	if err != nil {
+		return err
+	}
+	in, err := parseScoreRange(args[1], args[2])
+	if err != nil {
+		return err
+	}
+	members := []*scoredMember{}
+	for _, sm := range sortedMembers(z) {
+		if in(sm.score) {
+			members = append(members, sm)
+		}
+	}
+	if offset < 0 || offset >= len(members) {
+		return [][]byte{}
+	}
+	members = members[offset:]
+	if count >= 0 && count < len(members) {
+		members = members[:count]
+	}
+	return membersReply(members, withScores)
+}
+
+func cmdZRem(c *connection, args [][]byte) interface{} {
+	z, err := getZSet(c, args[0], false)
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, member := range args[1:] {
+		if _, ok := z[string(member)]; ok {
+			delete(z, string(member))
+			removed++
+		}
+	}
+	c.database().cleanup(string(args[0]))
+	return removed
+}
+
+func cmdZRemRangeByScore(c *connection, args [][]byte) interface{} {
+	z, err := getZSet(c, args[0], false)
+	if err != nil {
+		return err
+	}
+	in, err := parseScoreRange(args[1], args[2])
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for member, score := range z {
+		if in(score) {
+			delete(z, member)
+			removed++
+		}
+	}
+	c.database().cleanup(string(args[0]))
+	return removed
+}
+
+func cmdZScore(c *connection, args [][]byte) interface{} {
+	z, err := getZSet(c, args[0], false)
+	if err != nil {
+		return err
+	}
+	if score, ok := z[string(args[1])]; ok {
+		return formatFloat(score)
+	}
+	return nil
+}
+
+//--------------------
+// SERVER COMMANDS
+//--------------------
+
+// cmdConfig supports only the parameter notify-keyspace-events,
+// others are accepted but ignored. The notification classes are
+// not evaluated, 'K' and 'E' enable all notifications.
+func cmdConfig(c *connection, args [][]byte) interface{} {
+	parameter := strings.ToLower(string(args[1]))
+	switch strings.ToLower(string(args[0])) {
+	case "get":
+		if match(parameter, "notify-keyspace-events") {
+			return []interface{}{"notify-keyspace-events", c.server.notifications}
+		}
+		return []interface{}{}
+	case "set":
+		if len(args) != 3 {
+			return errSyntax
+		}
+		if parameter == "notify-keyspace-events" {
+			c.server.notifications = string(args[2])
+		}
+		return okReply
+	}
+	return errSyntax
+}
+
+//--------------------
+// PUB/SUB COMMANDS
+//--------------------
+
+func cmdPublish(c *connection, args [][]byte) interface{} {
+	return c.server.publish(args[0], args[1])
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// sortedKeys returns the sorted keys of a hash or set.
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	switch tm := m.(type) {
+	case map[string][]byte:
+		for key := range tm {
+			keys = append(keys, key)
+		}
+	case map[string]bool:
+		for key := range tm {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// scoredMembers allows the sorting of sorted set members.
+type scoredMembers []*scoredMember
+
+func (sms scoredMembers) Len() int      { return len(sms) }
+func (sms scoredMembers) Swap(i, j int) { sms[i], sms[j] = sms[j], sms[i] }
+func (sms scoredMembers) Less(i, j int) bool {
+	if sms[i].score == sms[j].score {
+		return sms[i].member < sms[j].member
+	}
+	return sms[i].score < sms[j].score
+}
+
+// sortedMembers returns the members of a sorted set ordered
+// by score and member.
+func sortedMembers(z map[string]float64) []*scoredMember {
+	sms := scoredMembers{}
+	for member, score := range z {
+		sms = append(sms, &scoredMember{member, score})
+	}
+	sort.Sort(sms)
+	return sms
+}
+
+// membersReply returns the members, optionally with their scores.
+func membersReply(members []*scoredMember, withScores bool) [][]byte {
+	reply := [][]byte{}
+	for _, sm := range members {
+		reply = append(reply, []byte(sm.member))
+		if withScores {
+			reply = append(reply, formatFloat(sm.score))
+		}
+	}
+	return reply
+}
+
+// parseRange converts start and stop of a range into positive
+// indices of a sequence with the length.
+func parseRange(startArg, stopArg []byte, length int) (int, int, error) {
+	start, serr := strconv.Atoi(string(startArg))
+	stop, perr := strconv.Atoi(string(stopArg))
+	if serr != nil || perr != nil {
+		return 0, 0, errNotInteger
+	}
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	return start, stop, nil
+}
+
+// parseFloat parses a float argument.
+func parseFloat(arg []byte) (float64, error) {
+	f, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, errNotFloat
+	}
+	return f, nil
+}
+
+// parseScoreRange parses minimum and maximum of a score range like
+// "-inf", "(1.5" or "+inf" and returns a function checking a score.
+func parseScoreRange(minArg, maxArg []byte) (func(float64) bool, error) {
+	parse := func(arg []byte) (float64, bool, error) {
+		s := string(arg)
+		exclusive := strings.HasPrefix(s, "(")
+		if exclusive {
+			s = s[1:]
+		}
+		switch strings.ToLower(s) {
+		case "-inf":
+			return math.Inf(-1), exclusive, nil
+		case "+inf", "inf":
+			return math.Inf(1), exclusive, nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, false, errMinMaxFloat
+		}
+		return f, exclusive, nil
+	}
+	min, minExclusive, err := parse(minArg)
+	if err != nil {
+		return nil, err
+	}
+	max, maxExclusive, err := parse(maxArg)
+	if err != nil {
+		return nil, err
+	}
+	return func(score float64) bool {
+		if score < min || (minExclusive && score == min) {
+			return false
+		}
+		if score > max || (maxExclusive && score == max) {
+			return false
+		}
+		return true
+	}, nil
+}
+
+// formatFloat formats a score like Redis does.
+func formatFloat(f float64) []byte {
+	switch {
+	case math.IsInf(f, 1):
+		return []byte("inf")
+	case math.IsInf(f, -1):
+		return []byte("-inf")
+	case f == math.Trunc(f) && math.Abs(f) < 1e17:
+		return []byte(strconv.FormatFloat(f, 'f', -1, 64))
+	}
+	return []byte(strconv.FormatFloat(f, 'g', -1, 64))
+}
+
+// EOF
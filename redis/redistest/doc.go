@@ -0,0 +1,25 @@
+// Tideland Common Go Library - Redis / Test Server
+//
+// Copyright (C) 2009-2013 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+// The package redistest provides an in-memory server speaking the
+// Redis protocol on a loopback listener. It is intended for tests
+// of code using the Redis client without a running Redis.
+//
+// NewServer() starts a server, its address can be used in the
+// configuration of the client. Strings, hashes, lists, sets and
+// sorted sets with their most important commands are supported as
+// well as key expiration, MULTI/EXEC, pub/sub, keyspace notifications
+// and multiple databases. The server doesn't persist any data and is
+// not tuned for speed. CloseConnections() drops all clients, e.g. to
+// test their reconnecting.
+//
+// NewTLSServer() starts a server accepting only TLS connections with
+// a self-signed certificate, it is returned by Certificate(). Users
+// added with AddUser() have to authenticate with AUTH.
+package redistest
+
+// EOF
@@ -0,0 +1,297 @@
+// Tideland Common Go Library - Redis / Test Server - Unit Tests
+//
+// Copyright (C) 2009-2013 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package redistest_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"cgl.tideland.biz/asserts"
+	"cgl.tideland.biz/redis"
+	"cgl.tideland.biz/redis/redistest"
+	"testing"
+	"time"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+func TestStrings(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	srv, db := connect()
+	defer srv.Close()
+	defer db.Close()
+
+	rs := db.Command("set", "string:a", "foo")
+	assert.True(rs.IsOK(), "'set' is ok.")
+	assert.Equal(db.Command("get", "string:a").ValueAsString(), "foo", "'get' returns the value.")
+	assert.False(db.Command("get", "string:none").IsOK(), "'get' of missing key finds nothing.")
+
+	db.Command("append", "string:a", "bar")
+	assert.Equal(db.Command("get", "string:a").ValueAsString(), "foobar", "'append' appended the value.")
+
+	v, _ := db.Command("incrby", "string:counter", 5).ValueAsInt()
+	assert.Equal(v, 5, "'incrby' returns the new value.")
+	v, _ = db.Command("decr", "string:counter").ValueAsInt()
+	assert.Equal(v, 4, "'decr' returns the new value.")
+	rs = db.Command("incr", "string:a")
+	assert.False(rs.IsOK(), "'incr' of a non-integer fails.")
+
+	rs = db.Command("set", "string:a", "baz", "nx")
+	assert.False(rs.IsOK(), "'set' with 'nx' of existing key returns nil.")
+	assert.Equal(db.Command("get", "string:a").ValueAsString(), "foobar", "'set' with 'nx' didn't change the value.")
+
+	db.Command("mset", "string:b", "b", "string:c", "c")
+	assert.Equal(db.Command("mget", "string:b", "string:none", "string:c").ValuesAsStrings(),
+		[]string{"b", "", "c"}, "'mget' returns the values.")
+	assert.Equal(db.Command("keys", "string:[a-b]").ValuesAsStrings(), []string{"string:a", "string:b"}, "'keys' returns the matching keys.")
+	assert.Equal(db.Command("type", "string:a").ValueAsString(), "string", "'type' returns the type.")
+
+	v, _ = db.Command("del", "string:a", "string:b", "string:none").ValueAsInt()
+	assert.Equal(v, 2, "'del' returns the number of deleted keys.")
+	v, _ = db.Command("exists", "string:a").ValueAsInt()
+	assert.Equal(v, 0, "Deleted key doesn't exist anymore.")
+
+	rs = db.Command("lpush", "string:c", "x")
+	assert.ErrorMatch(rs.Error(), "redis: WRONGTYPE.*", "Wrong type is reported.")
+	rs = db.Command("nonsense", "foo")
+	assert.ErrorMatch(rs.Error(), "redis: unknown command.*", "Unknown command is reported.")
+
+	srv.CloseConnections()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(db.Command("get", "string:c").ValueAsString(), "c", "Client reconnected, data is kept.")
+}
+
+func TestExpiry(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	srv, db := connect()
+	defer srv.Close()
+	defer db.Close()
+
+	db.Command("set", "expiry:a", "a", "px", 50)
+	db.Command("set", "expiry:b", "b")
+	db.Command("expire", "expiry:b", 10)
+	db.Command("set", "expiry:c", "c")
+
+	ttl, _ := db.Command("ttl", "expiry:b").ValueAsInt()
+	assert.Equal(ttl, 10, "'ttl' returns the remaining time.")
+	ttl, _ = db.Command("ttl", "expiry:c").ValueAsInt()
+	assert.Equal(ttl, -1, "'ttl' of key without expiration is -1.")
+	ttl, _ = db.Command("ttl", "expiry:none").ValueAsInt()
+	assert.Equal(ttl, -2, "'ttl' of missing key is -2.")
+
+	time.Sleep(100 * time.Millisecond)
+
+	assert.False(db.Command("get", "expiry:a").IsOK(), "Key has expired.")
+	assert.Equal(db.Command("get", "expiry:b").ValueAsString(), "b", "Key has not yet expired.")
+	db.Command("persist", "expiry:b")
+	ttl, _ = db.Command("ttl", "expiry:b").ValueAsInt()
+	assert.Equal(ttl, -1, "'persist' removed the expiration.")
+}
+
+func TestHashes(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	srv, db := connect()
+	defer srv.Close()
+	defer db.Close()
+
+	h := redis.NewHash()
+	h.Set("a", "foo")
+	h.Set("b", 42)
+	v, _ := db.Command("hset", "hash:a", h).ValueAsInt()
+	assert.Equal(v, 2, "'hset' returns the number of new fields.")
+	v, _ = db.Command("hincrby", "hash:a", "b", 8).ValueAsInt()
+	assert.Equal(v, 50, "'hincrby' returns the new value.")
+
+	rh := db.Command("hgetall", "hash:a").Hash()
+	a, _ := rh.String("a")
+	b, _ := rh.Int("b")
+	assert.Equal(a, "foo", "'hgetall' returns field a.")
+	assert.Equal(b, 50, "'hgetall' returns field b.")
+
+	assert.Equal(db.Command("hget", "hash:a", "a").ValueAsString(), "foo", "'hget' returns the value.")
+	assert.Equal(db.Command("hkeys", "hash:a").ValuesAsStrings(), []string{"a", "b"}, "'hkeys' returns the fields.")
+	db.Command("hdel", "hash:a", "a", "b")
+	v, _ = db.Command("exists", "hash:a").ValueAsInt()
+	assert.Equal(v, 0, "Empty hash has been removed.")
+}
+
+func TestLists(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	srv, db := connect()
+	defer srv.Close()
+	defer db.Close()
+
+	db.Command("rpush", "list:a", "b", "c")
+	db.Command("lpush", "list:a", "a")
+	assert.Equal(db.Command("lrange", "list:a", 0, -1).ValuesAsStrings(), []string{"a", "b", "c"}, "'lrange' returns the list.")
+	v, _ := db.Command("llen", "list:a").ValueAsInt()
+	assert.Equal(v, 3, "'llen' returns the length.")
+	assert.Equal(db.Command("rpop", "list:a").ValueAsString(), "c", "'rpop' returns the last value.")
+	assert.Equal(db.Command("lindex", "list:a", -1).ValueAsString(), "b", "'lindex' returns the value.")
+
+	pushed := make(chan bool)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		db.Command("rpush", "list:b", "pushed")
+		close(pushed)
+	}()
+	rs := db.Command("blpop", "list:b", 5)
+	assert.Equal(rs.ValuesAsStrings(), []string{"list:b", "pushed"}, "'blpop' waited for the value.")
+	<-pushed
+	rs = db.Command("brpop", "list:b", 1)
+	assert.True(redis.IsTimeoutError(rs.Error()), "'brpop' timed out.")
+}
+
+func TestSets(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	srv, db := connect()
+	defer srv.Close()
+	defer db.Close()
+
+	v, _ := db.Command("sadd", "set:a", "x", "y", "x").ValueAsInt()
+	assert.Equal(v, 2, "'sadd' returns the number of new members.")
+	assert.Equal(db.Command("smembers", "set:a").ValuesAsStrings(), []string{"x", "y"}, "'smembers' returns the members.")
+	ok, _ := db.Command("sismember", "set:a", "y").ValueAsBool()
+	assert.True(ok, "'sismember' finds the member.")
+
+	db.Command("zadd", "zset:a", 3, "c", 1, "a", 2, "b")
+	assert.Equal(db.Command("zrange", "zset:a", 0, -1).ValuesAsStrings(), []string{"a", "b", "c"}, "'zrange' returns the members by score.")
+	assert.Equal(db.Command("zrevrange", "zset:a", 0, 0, "withscores").ValuesAsStrings(), []string{"c", "3"}, "'zrevrange' returns members and scores.")
+	assert.Equal(db.Command("zrangebyscore", "zset:a", "(1", "+inf").ValuesAsStrings(), []string{"b", "c"}, "'zrangebyscore' returns the members in range.")
+	db.Command("zincrby", "zset:a", 1.5, "a")
+	assert.Equal(db.Command("zscore", "zset:a", "a").ValueAsString(), "2.5", "'zincrby' changed the score.")
+	v, _ = db.Command("zremrangebyscore", "zset:a", "-inf", 2.5).ValueAsInt()
+	assert.Equal(v, 2, "'zremrangebyscore' removed the members.")
+	v, _ = db.Command("zcard", "zset:a").ValueAsInt()
+	assert.Equal(v, 1, "'zcard' returns the remaining members.")
+}
+
+func TestMultiCommand(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	srv, db := connect()
+	defer srv.Close()
+	defer db.Close()
+
+	rs := db.MultiCommand(func(mc *redis.MultiCommand) {
+		mc.Command("set", "multi:a", "a")
+		mc.Command("incr", "multi:counter")
+		mc.Command("incr", "multi:counter")
+		mc.Command("get", "multi:a")
+	})
+	assert.True(rs.IsOK(), "Transaction is ok.")
+	assert.Equal(rs.ResultSetCount(), 4, "Transaction returned all result sets.")
+	v, _ := rs.ResultSetAt(2).ValueAsInt()
+	assert.Equal(v, 2, "Counter has been incremented twice.")
+	assert.Equal(rs.ResultSetAt(3).ValueAsString(), "a", "Transaction read its own write.")
+
+	rs = db.MultiCommand(func(mc *redis.MultiCommand) {
+		mc.Command("set", "multi:b", "b")
+		mc.Discard()
+	})
+	assert.False(db.Command("get", "multi:b").IsOK(), "Discarded transaction had no effect.")
+
+	other := redis.Connect(redis.Configuration{Address: srv.Address(), Database: 1})
+	defer other.Close()
+	assert.False(other.Command("get", "multi:a").IsOK(), "Other database doesn't contain the key.")
+	other.Command("set", "multi:a", "other")
+	assert.Equal(db.Command("get", "multi:a").ValueAsString(), "a", "Database 0 is unchanged.")
+
+	srv.FlushAll()
+	assert.False(db.Command("get", "multi:a").IsOK(), "Data has been flushed.")
+}
+
+func TestSubscription(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	srv, db := connect()
+	defer srv.Close()
+	defer db.Close()
+
+	sub, err := db.Subscribe("sub:a", "sub:b")
+	assert.Nil(err, "Subscription has been created.")
+	defer sub.Stop()
+
+	// Wait until the subscription is active.
+	for i := 0; i < 100; i++ {
+		if n, _ := db.Publish("sub:a", "ready"); n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	receive := func() *redis.SubscriptionValue {
+		select {
+		case sv := <-sub.Values():
+			return sv
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+	assert.Equal(receive().String(), "ready", "First message has been received.")
+
+	n, err := db.Publish("sub:b", "foo")
+	assert.Nil(err, "Message has been published.")
+	assert.Equal(n, 1, "Message has one receiver.")
+	sv := receive()
+	assert.NotNil(sv, "Message has been received.")
+	assert.Equal(sv.Channel, "sub:b", "Message has the right channel.")
+	assert.Equal(sv.String(), "foo", "Message has the right value.")
+
+	sub.Unsubscribe("sub:b")
+	for i := 0; i < 100; i++ {
+		if n, _ = db.Publish("sub:b", "bar"); n == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(n, 0, "Unsubscribed channel has no receivers.")
+	db.Publish("sub:a", "baz")
+	assert.Equal(receive().String(), "baz", "Subscribed channel still receives messages.")
+
+	// Patterns are unsubscribed as patterns.
+	assert.Equal(sub.Subscribe("sub:p.*"), 2, "Pattern has been subscribed.")
+	n, err = db.Publish("sub:p.x", "qux")
+	assert.Nil(err, "Message has been published.")
+	assert.Equal(n, 1, "Message has one receiver.")
+	sv = receive()
+	assert.NotNil(sv, "Message has been received.")
+	assert.Equal(sv.ChannelPattern, "sub:p.*", "Message has the right pattern.")
+	assert.Equal(sv.Channel, "sub:p.x", "Message has the right channel.")
+	assert.Equal(sub.Unsubscribe("sub:p.*"), 1, "Pattern has been unsubscribed.")
+	n, err = db.Publish("sub:p.x", "quux")
+	assert.Nil(err, "Message has been published.")
+	assert.Equal(n, 0, "Unsubscribed pattern has no receivers.")
+
+	// A stopped subscription doesn't block.
+	sub.Stop()
+	done := make(chan bool)
+	go func() {
+		sub.Subscribe("sub:c")
+		sub.Unsubscribe("sub:a")
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Changing a stopped subscription blocks.")
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// connect starts a server and connects it.
+func connect() (*redistest.Server, *redis.Database) {
+	srv := redistest.NewServer()
+	db := redis.Connect(redis.Configuration{Address: srv.Address()})
+	return srv, db
+}
+
+// EOF
@@ -0,0 +1,678 @@
+// Tideland Common Go Library - Redis / Test Server
+//
+// Copyright (C) 2009-2013 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package redistest
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//--------------------
+// REPLIES
+//--------------------
+
+// status is a status reply like "OK".
+type status string
+
+// nilArray is the reply of a null multi-bulk, e.g. after
+// the timeout of a blocking command.
+type nilArray struct{}
+
+// noReply signals that the command already has written
+// its replies.
+type noReply struct{}
+
+// Often used replies.
+var (
+	okReply     = status("OK")
+	queuedReply = status("QUEUED")
+)
+
+//--------------------
+// SERVER
+//--------------------
+
+// Server is an in-memory server speaking the Redis protocol.
+type Server struct {
+	mutex         sync.Mutex
+	listener      net.Listener
+	databases     map[int]*database
+	connections   map[*connection]bool
+	users         map[string]string
+	notifications string
+	certificate   *x509.Certificate
+	closed        bool
+	closeChan     chan bool
+}
+
+// NewServer starts a new server on a loopback address. It
+// panics if no listener can be created.
+func NewServer() *Server {
+	return newServer(listen(), nil)
+}
+
+// NewTLSServer starts a new server on a loopback address accepting
+// only TLS connections. It uses a self-signed certificate for
+// "localhost" and "127.0.0.1", see Certificate(). It panics if
+// no listener can be created.
+func NewTLSServer() *Server {
+	cert, err := selfSignedCertificate()
+	if err != nil {
+		panic(fmt.Sprintf("redistest: cannot create certificate: %v", err))
+	}
+	l := tls.NewListener(listen(), &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	return newServer(l, cert.Leaf)
+}
+
+// newServer creates the server and starts accepting connections.
+func newServer(l net.Listener, certificate *x509.Certificate) *Server {
+	s := &Server{
+		listener:    l,
+		databases:   make(map[int]*database),
+		connections: make(map[*connection]bool),
+		users:       make(map[string]string),
+		certificate: certificate,
+		closeChan:   make(chan bool),
+	}
+	go s.accept()
+	return s
+}
+
+// Address returns the address of the server.
+func (s *Server) Address() string {
+	return s.listener.Addr().String()
+}
+
+// Certificate returns the certificate of a TLS server, it's
+// nil if the server has been started with NewServer().
+func (s *Server) Certificate() *x509.Certificate {
+	return s.certificate
+}
+
+// AddUser adds a user with its password. As soon as a user exists
+// the clients have to authenticate. The user "default" is used for
+// the authentication with the password only.
+func (s *Server) AddUser(username, password string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.users[username] = password
+}
+
+// Close stops the server and closes all connections.
+func (s *Server) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.closeChan)
+	s.listener.Close()
+	for c := range s.connections {
+		c.conn.Close()
+	}
+}
+
+// CloseConnections closes all client connections while the
+// server keeps running, e.g. to test reconnecting clients.
+func (s *Server) CloseConnections() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for c := range s.connections {
+		c.conn.Close()
+	}
+}
+
+// FlushAll removes the data of all databases.
+func (s *Server) FlushAll() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.databases = make(map[int]*database)
+}
+
+// database returns the database with the index, it is
+// created if needed. The server has to be locked.
+func (s *Server) database(index int) *database {
+	d, ok := s.databases[index]
+	if !ok {
+		d = newDatabase(s, index)
+		s.databases[index] = d
+	}
+	return d
+}
+
+// accept handles the incoming connections.
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := newConnection(s, conn)
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		s.connections[c] = true
+		s.mutex.Unlock()
+		go c.serve()
+	}
+}
+
+// remove removes a closed connection.
+func (s *Server) remove(c *connection) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.connections, c)
+}
+
+// authenticate checks username and password. The server
+// has to be locked.
+func (s *Server) authenticate(username, password string) bool {
+	if len(s.users) == 0 {
+		return true
+	}
+	expected, ok := s.users[username]
+	return ok && expected == password
+}
+
+// publish sends a message to all subscribers of the channel
+// and returns their number. The server has to be locked.
+func (s *Server) publish(channel, message []byte) int {
+	receivers := 0
+	for c := range s.connections {
+		receivers += c.deliver(channel, message)
+	}
+	return receivers
+}
+
+//--------------------
+// CONNECTION
+//--------------------
+
+// connection handles one client connection.
+type connection struct {
+	server        *Server
+	conn          net.Conn
+	reader        *bufio.Reader
+	authenticated bool
+	index         int
+	current       string
+	queue         [][][]byte
+	failed        bool
+	writeMux      sync.Mutex
+	channels      map[string]bool
+	patterns      map[string]bool
+}
+
+// newConnection creates a new connection.
+func newConnection(s *Server, conn net.Conn) *connection {
+	return &connection{
+		server:   s,
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+	}
+}
+
+// serve reads the commands and writes the replies.
+func (c *connection) serve() {
+	defer func() {
+		c.conn.Close()
+		c.server.remove(c)
+	}()
+	for {
+		args, err := c.readCommand()
+		if err != nil {
+			if err != io.EOF {
+				c.write(err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		name := strings.ToLower(string(args[0]))
+		reply := c.execute(name, args[1:])
+		if _, ok := reply.(noReply); ok {
+			continue
+		}
+		if err := c.write(reply); err != nil {
+			return
+		}
+		if name == "quit" {
+			return
+		}
+	}
+}
+
+// readCommand reads the arguments of the next command.
+func (c *connection) readCommand() ([][]byte, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		// Inline command.
+		fields := strings.Fields(line)
+		args := make([][]byte, len(fields))
+		for i, field := range fields {
+			args[i] = []byte(field)
+		}
+		return args, nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 {
+		return nil, errors.New("ERR Protocol error: invalid multibulk length")
+	}
+	args := make([][]byte, n)
+	for i := range args {
+		line, err = c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errors.New("ERR Protocol error: expected '$'")
+		}
+		l, err := strconv.Atoi(line[1:])
+		if err != nil || l < 0 {
+			return nil, errors.New("ERR Protocol error: invalid bulk length")
+		}
+		buf := make([]byte, l+2)
+		if _, err = io.ReadFull(c.reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = buf[:l]
+	}
+	return args, nil
+}
+
+// readLine reads one line without the line break.
+func (c *connection) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// write writes a reply to the client.
+func (c *connection) write(reply interface{}) error {
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+	_, err := c.conn.Write(encode(reply))
+	return err
+}
+
+// execute performs a command and returns its reply.
+func (c *connection) execute(name string, args [][]byte) interface{} {
+	if name != "auth" && name != "quit" && !c.isAuthenticated() {
+		return errors.New("NOAUTH Authentication required.")
+	}
+	// Commands controlling the connection.
+	switch name {
+	case "multi":
+		if c.queue != nil {
+			return errors.New("ERR MULTI calls can not be nested")
+		}
+		c.queue = [][][]byte{}
+		c.failed = false
+		return okReply
+	case "exec":
+		return c.exec()
+	case "discard":
+		if c.queue == nil {
+			return errors.New("ERR DISCARD without MULTI")
+		}
+		c.queue = nil
+		return okReply
+	case "watch", "unwatch":
+		// Optimistic locking is not supported, all
+		// transactions are executed.
+		return okReply
+	}
+	cmd, err := lookupCommand(name, args)
+	c.current = name
+	if c.queue != nil {
+		if err != nil {
+			c.failed = true
+			return err
+		}
+		c.queue = append(c.queue, append([][]byte{[]byte(name)}, args...))
+		return queuedReply
+	}
+	if err != nil {
+		return err
+	}
+	if c.isSubscribed() {
+		switch {
+		case name == "ping":
+			return []interface{}{"pong", ""}
+		case !cmd.pubsub && name != "quit":
+			return errors.New("ERR only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT allowed in this context")
+		}
+	}
+	switch {
+	case cmd.pubsub:
+		return c.executePubSub(name, args)
+	case cmd.blocking:
+		return c.executeBlocking(cmd, args)
+	}
+	c.server.mutex.Lock()
+	defer c.server.mutex.Unlock()
+	reply := cmd.handler(c, args)
+	notify(c, name, args, reply)
+	return reply
+}
+
+// exec executes a queued transaction.
+func (c *connection) exec() interface{} {
+	if c.queue == nil {
+		return errors.New("ERR EXEC without MULTI")
+	}
+	queue := c.queue
+	c.queue = nil
+	if c.failed {
+		return errors.New("EXECABORT Transaction discarded because of previous errors.")
+	}
+	c.server.mutex.Lock()
+	defer c.server.mutex.Unlock()
+	replies := []interface{}{}
+	for _, args := range queue {
+		name := string(args[0])
+		cmd, _ := lookupCommand(name, args[1:])
+		c.current = name
+		if cmd.pubsub {
+			replies = append(replies, errors.New("ERR command not allowed inside a transaction"))
+			continue
+		}
+		reply := cmd.handler(c, args[1:])
+		notify(c, name, args[1:], reply)
+		replies = append(replies, reply)
+	}
+	return replies
+}
+
+// executeBlocking performs a blocking command. It is retried
+// until it returns a reply or the timeout is reached.
+func (c *connection) executeBlocking(cmd *command, args [][]byte) interface{} {
+	timeout, err := strconv.ParseFloat(string(args[len(args)-1]), 64)
+	if err != nil || timeout < 0 {
+		return errors.New("ERR timeout is not a float or out of range")
+	}
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(time.Duration(timeout * float64(time.Second)))
+	}
+	for {
+		c.server.mutex.Lock()
+		reply := cmd.handler(c, args)
+		c.server.mutex.Unlock()
+		if _, ok := reply.(nilArray); !ok {
+			return reply
+		}
+		select {
+		case <-deadline:
+			return reply
+		case <-c.server.closeChan:
+			return reply
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// executePubSub performs the pub/sub commands.
+func (c *connection) executePubSub(name string, args [][]byte) interface{} {
+	switch name {
+	case "subscribe", "psubscribe":
+		for _, arg := range args {
+			c.server.mutex.Lock()
+			if name == "subscribe" {
+				c.channels[string(arg)] = true
+			} else {
+				c.patterns[string(arg)] = true
+			}
+			count := len(c.channels) + len(c.patterns)
+			c.server.mutex.Unlock()
+			c.write([]interface{}{name, arg, count})
+		}
+	case "unsubscribe", "punsubscribe":
+		c.server.mutex.Lock()
+		subscriptions := c.channels
+		if name == "punsubscribe" {
+			subscriptions = c.patterns
+		}
+		if len(args) == 0 {
+			for subscription := range subscriptions {
+				args = append(args, []byte(subscription))
+			}
+		}
+		count := len(c.channels) + len(c.patterns)
+		c.server.mutex.Unlock()
+		if len(args) == 0 {
+			c.write([]interface{}{name, nil, count})
+		}
+		for _, arg := range args {
+			c.server.mutex.Lock()
+			delete(subscriptions, string(arg))
+			count := len(c.channels) + len(c.patterns)
+			c.server.mutex.Unlock()
+			c.write([]interface{}{name, arg, count})
+		}
+	}
+	return noReply{}
+}
+
+// isAuthenticated checks if the connection has been authenticated
+// or if the server doesn't need an authentication.
+func (c *connection) isAuthenticated() bool {
+	c.server.mutex.Lock()
+	defer c.server.mutex.Unlock()
+	return c.authenticated || len(c.server.users) == 0
+}
+
+// isSubscribed checks if the connection is in subscription mode.
+func (c *connection) isSubscribed() bool {
+	c.server.mutex.Lock()
+	defer c.server.mutex.Unlock()
+	return len(c.channels)+len(c.patterns) > 0
+}
+
+// deliver sends a published message if the connection has
+// subscribed the channel. It returns the number of deliveries.
+// The server has to be locked.
+func (c *connection) deliver(channel, message []byte) int {
+	deliveries := 0
+	if c.channels[string(channel)] {
+		c.write([]interface{}{"message", channel, message})
+		deliveries++
+	}
+	for pattern := range c.patterns {
+		if match(pattern, string(channel)) {
+			c.write([]interface{}{"pmessage", pattern, channel, message})
+			deliveries++
+		}
+	}
+	return deliveries
+}
+
+// database returns the selected database. The server
+// has to be locked.
+func (c *connection) database() *database {
+	return c.server.database(c.index)
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// listen creates a listener on a loopback address.
+func listen() net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("redistest: cannot listen: %v", err))
+	}
+	return l
+}
+
+// selfSignedCertificate creates a certificate for the loopback
+// addresses valid for one day.
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(now.UnixNano()),
+		Subject:               pkix.Name{Organization: []string{"redistest"}},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// encode encodes a reply in the Redis protocol.
+func encode(reply interface{}) []byte {
+	switch r := reply.(type) {
+	case nil:
+		return []byte("$-1\r\n")
+	case nilArray:
+		return []byte("*-1\r\n")
+	case status:
+		return []byte("+" + string(r) + "\r\n")
+	case error:
+		return []byte("-" + r.Error() + "\r\n")
+	case int:
+		return []byte(":" + strconv.Itoa(r) + "\r\n")
+	case int64:
+		return []byte(":" + strconv.FormatInt(r, 10) + "\r\n")
+	case string:
+		return encode([]byte(r))
+	case []byte:
+		return append([]byte("$"+strconv.Itoa(len(r))+"\r\n"), append(r, '\r', '\n')...)
+	case [][]byte:
+		replies := make([]interface{}, len(r))
+		for i, b := range r {
+			replies[i] = b
+		}
+		return encode(replies)
+	case []interface{}:
+		b := []byte("*" + strconv.Itoa(len(r)) + "\r\n")
+		for _, e := range r {
+			b = append(b, encode(e)...)
+		}
+		return b
+	}
+	return encode(fmt.Errorf("ERR invalid reply type %T", reply))
+}
+
+// match checks if the name matches the glob-style pattern.
+func match(pattern, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(name); i >= 0; i-- {
+				if match(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(name) == 0 {
+				return false
+			}
+		case '[':
+			end := strings.IndexByte(pattern, ']')
+			if end < 0 || len(name) == 0 {
+				return false
+			}
+			set, negate := pattern[1:end], false
+			if len(set) > 0 && set[0] == '^' {
+				set, negate = set[1:], true
+			}
+			if matchSet(set, name[0]) == negate {
+				return false
+			}
+			pattern = pattern[end:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(name) == 0 || pattern[0] != name[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
+
+// matchSet checks if the character is part of the set
+// of a pattern like "abc" or "a-z".
+func matchSet(set string, c byte) bool {
+	for i := 0; i < len(set); i++ {
+		if i+2 < len(set) && set[i+1] == '-' {
+			if set[i] <= c && c <= set[i+2] {
+				return true
+			}
+			i += 2
+			continue
+		}
+		if set[i] == c {
+			return true
+		}
+	}
+	return false
+}
+
+// EOF
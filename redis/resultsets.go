@@ -12,9 +12,11 @@ package redis
 //--------------------
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 )
 
 //--------------------
@@ -483,4 +485,20 @@ func (f *Future) ResultSet() (rs *ResultSet) {
 	return
 }
 
+// ResultSetContext returns the result set in the moment it is
+// available. If the context is done before a result set containing
+// a TimeoutError is returned.
+func (f *Future) ResultSetContext(ctx context.Context) *ResultSet {
+	start := time.Now()
+	select {
+	case rs := <-f.rsChan:
+		f.rsChan <- rs
+		return rs
+	case <-ctx.Done():
+		rs := newResultSet("future")
+		rs.err = &TimeoutError{time.Now().Sub(start)}
+		return rs
+	}
+}
+
 // EOF
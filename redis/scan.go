@@ -0,0 +1,246 @@
+// Tideland Common Go Library - Redis - Scanning
+//
+// Copyright (C) 2009-2013 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package redis
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"sync"
+)
+
+//--------------------
+// SCAN OPTIONS
+//--------------------
+
+// ScanOptions control the scanning. Match is a glob-style pattern
+// for the returned elements, Count a hint for the number of elements
+// per call. Type filters the keys by their type and is only used
+// by Scan().
+type ScanOptions struct {
+	Match string
+	Count int
+	Type  string
+}
+
+// args returns the options as command arguments.
+func (o ScanOptions) args(withType bool) []interface{} {
+	args := []interface{}{}
+	if o.Match != "" {
+		args = append(args, "match", o.Match)
+	}
+	if o.Count > 0 {
+		args = append(args, "count", o.Count)
+	}
+	if withType && o.Type != "" {
+		args = append(args, "type", o.Type)
+	}
+	return args
+}
+
+//--------------------
+// SCANNER
+//--------------------
+
+// Scanner iterates lazily over the elements returned by the
+// commands SCAN, HSCAN, SSCAN and ZSCAN. Like those commands
+// it may return elements multiple times.
+type Scanner struct {
+	database *Database
+	command  string
+	key      string
+	options  ScanOptions
+	cursor   string
+	values   []Value
+	current  []Value
+	done     bool
+	err      error
+	stopChan chan bool
+	stopOnce sync.Once
+}
+
+// newScanner creates a new scanner for the command.
+func newScanner(db *Database, command, key string, options ScanOptions) *Scanner {
+	return &Scanner{
+		database: db,
+		command:  command,
+		key:      key,
+		options:  options,
+		cursor:   "0",
+		stopChan: make(chan bool),
+	}
+}
+
+// Scan returns a scanner for the keys of the database.
+func (db *Database) Scan(options ScanOptions) *Scanner {
+	return newScanner(db, "scan", "", options)
+}
+
+// HScan returns a scanner for the fields and values of a hash.
+// They can be retrieved with KeyValue().
+func (db *Database) HScan(key string, options ScanOptions) *Scanner {
+	return newScanner(db, "hscan", key, options)
+}
+
+// SScan returns a scanner for the members of a set.
+func (db *Database) SScan(key string, options ScanOptions) *Scanner {
+	return newScanner(db, "sscan", key, options)
+}
+
+// ZScan returns a scanner for the members and scores of a sorted
+// set. They can be retrieved with ScoredValue().
+func (db *Database) ZScan(key string, options ScanOptions) *Scanner {
+	return newScanner(db, "zscan", key, options)
+}
+
+// Next moves to the next element. It returns false if there
+// are no more elements, the scanner has been stopped or an
+// error occurred.
+func (s *Scanner) Next() bool {
+	size := 1
+	if s.command == "hscan" || s.command == "zscan" {
+		size = 2
+	}
+	for len(s.values) < size {
+		if s.done || s.err != nil || s.isStopped() {
+			s.current = nil
+			return false
+		}
+		s.fetch()
+	}
+	s.current = s.values[:size]
+	s.values = s.values[size:]
+	return true
+}
+
+// Value returns the current key of a scan, member of a set or
+// sorted set, or field of a hash.
+func (s *Scanner) Value() Value {
+	if len(s.current) == 0 {
+		return nil
+	}
+	return s.current[0]
+}
+
+// KeyValue returns the current field and value of a hash.
+func (s *Scanner) KeyValue() *KeyValue {
+	if len(s.current) < 2 {
+		return nil
+	}
+	return &KeyValue{s.current[0].String(), s.current[1]}
+}
+
+// ScoredValue returns the current member and score of a sorted
+// set. Fractional scores are truncated.
+func (s *Scanner) ScoredValue() *ScoredValue {
+	if len(s.current) < 2 {
+		return nil
+	}
+	score, err := s.current[1].Float64()
+	if err != nil {
+		s.err = err
+	}
+	return &ScoredValue{s.current[0], int(score)}
+}
+
+// Error returns the error if the scanning failed.
+func (s *Scanner) Error() error {
+	return s.err
+}
+
+// Stop ends the scanning.
+func (s *Scanner) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopChan)
+	})
+}
+
+// Values returns a channel emitting the values. It is closed
+// when there are no more elements or the scanner is stopped.
+func (s *Scanner) Values() <-chan Value {
+	valueChan := make(chan Value)
+	go s.emit(func() {
+		select {
+		case valueChan <- s.Value():
+		case <-s.stopChan:
+		}
+	}, func() { close(valueChan) })
+	return valueChan
+}
+
+// KeyValues returns a channel emitting the fields and values
+// of a hash. It is closed when there are no more elements or
+// the scanner is stopped.
+func (s *Scanner) KeyValues() <-chan *KeyValue {
+	kvChan := make(chan *KeyValue)
+	go s.emit(func() {
+		select {
+		case kvChan <- s.KeyValue():
+		case <-s.stopChan:
+		}
+	}, func() { close(kvChan) })
+	return kvChan
+}
+
+// ScoredValues returns a channel emitting the members and scores
+// of a sorted set. It is closed when there are no more elements
+// or the scanner is stopped.
+func (s *Scanner) ScoredValues() <-chan *ScoredValue {
+	svChan := make(chan *ScoredValue)
+	go s.emit(func() {
+		select {
+		case svChan <- s.ScoredValue():
+		case <-s.stopChan:
+		}
+	}, func() { close(svChan) })
+	return svChan
+}
+
+// emit calls send for each element and finally done.
+func (s *Scanner) emit(send, done func()) {
+	defer done()
+	for s.Next() {
+		send()
+	}
+}
+
+// fetch retrieves the next elements from the database.
+func (s *Scanner) fetch() {
+	args := []interface{}{}
+	if s.command != "scan" {
+		args = append(args, s.key)
+	}
+	args = append(args, s.cursor)
+	args = append(args, s.options.args(s.command == "scan")...)
+	rs := s.database.Command(s.command, args...)
+	if !rs.IsOK() {
+		s.err = rs.Error()
+		return
+	}
+	// Reply contains the next cursor and the elements.
+	if rs.ResultSetCount() != 2 {
+		s.err = &InvalidReplyError{rs.ResultSetCount(), nil, nil}
+		return
+	}
+	s.cursor = rs.ValueAt(0).String()
+	s.done = s.cursor == "0"
+	s.values = append(s.values, rs.ResultSetAt(1).Values()...)
+}
+
+// isStopped checks if the scanner has been stopped.
+func (s *Scanner) isStopped() bool {
+	select {
+	case <-s.stopChan:
+		return true
+	default:
+	}
+	return false
+}
+
+// EOF
@@ -0,0 +1,169 @@
+// Tideland Common Go Library - Redis - Scripting
+//
+// Copyright (C) 2009-2013 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package redis
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+)
+
+//--------------------
+// SCRIPT
+//--------------------
+
+// Script is a Lua script executed by its SHA1 hash. If
+// Redis doesn't know it yet it is loaded transparently.
+type Script struct {
+	source string
+	hash   string
+}
+
+// NewScript creates a new script with the passed source.
+func NewScript(source string) *Script {
+	sum := sha1.Sum([]byte(source))
+	return &Script{
+		source: source,
+		hash:   hex.EncodeToString(sum[:]),
+	}
+}
+
+// Source returns the source of the script.
+func (s *Script) Source() string {
+	return s.source
+}
+
+// Hash returns the SHA1 hash of the script.
+func (s *Script) Hash() string {
+	return s.hash
+}
+
+// Load loads the script into the script cache of Redis.
+func (s *Script) Load(db *Database) error {
+	rs := db.Command("script", "load", s.source)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+	return nil
+}
+
+// Do executes the script with EVALSHA. If the script is
+// unknown it is loaded and executed again.
+func (s *Script) Do(db *Database, keys []string, args ...interface{}) *ResultSet {
+	rs := db.Command("evalsha", s.args(s.hash, keys, args)...)
+	if !isNoScriptError(rs.Error()) {
+		return rs
+	}
+	if err := s.Load(db); err != nil {
+		rs = newResultSet("evalsha")
+		rs.err = err
+		return rs
+	}
+	return db.Command("evalsha", s.args(s.hash, keys, args)...)
+}
+
+// ensureLoaded loads the script if Redis doesn't know it yet.
+func (s *Script) ensureLoaded(ctx context.Context, db *Database) error {
+	rs := db.CommandContext(ctx, "script", "exists", s.hash)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+	if exists, _ := rs.ValueAt(0).Bool(); exists {
+		return nil
+	}
+	rs = db.CommandContext(ctx, "script", "load", s.source)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+	return nil
+}
+
+// AsyncDo executes the script asynchronously.
+func (s *Script) AsyncDo(db *Database, keys []string, args ...interface{}) *Future {
+	fut := newFuture()
+	go func() {
+		fut.setResultSet(s.Do(db, keys, args...))
+	}()
+	return fut
+}
+
+// args returns the arguments for EVAL or EVALSHA.
+func (s *Script) args(script string, keys []string, args []interface{}) []interface{} {
+	sargs := []interface{}{script, len(keys)}
+	for _, key := range keys {
+		sargs = append(sargs, key)
+	}
+	return append(sargs, args...)
+}
+
+//--------------------
+// MULTI COMMAND AND PIPELINE
+//--------------------
+
+// Script performs a script inside the transaction with EVALSHA.
+// A missing script could only be detected when executing the
+// transaction, so it is checked and loaded before using another
+// connection. If this fails the script is sent with EVAL.
+func (mc *MultiCommand) Script(s *Script, keys []string, args ...interface{}) {
+	if err := s.ensureLoaded(mc.ctx, mc.urp.database); err != nil {
+		mc.Command("eval", s.args(s.source, keys, args)...)
+		return
+	}
+	mc.Command("evalsha", s.args(s.hash, keys, args)...)
+}
+
+// Script adds a script to the pipeline. It will be sent with
+// EVALSHA after ensuring that Redis knows the script.
+func (p *Pipeline) Script(s *Script, keys []string, args ...interface{}) {
+	p.scripts = append(p.scripts, s)
+	p.Command("evalsha", s.args(s.hash, keys, args)...)
+}
+
+// loadScripts loads the scripts of the pipeline which are
+// not yet known by Redis.
+func (p *Pipeline) loadScripts() error {
+	if len(p.scripts) == 0 {
+		return nil
+	}
+	hashes := make([]interface{}, len(p.scripts))
+	for i, s := range p.scripts {
+		hashes[i] = s.hash
+	}
+	rs := newResultSet("script")
+	p.urp.command(rs, false, "script", append([]interface{}{"exists"}, hashes...)...)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+	for i, s := range p.scripts {
+		if exists, _ := rs.ValueAt(i).Bool(); exists {
+			continue
+		}
+		lrs := newResultSet("script")
+		p.urp.command(lrs, false, "script", "load", s.source)
+		if !lrs.IsOK() {
+			return lrs.Error()
+		}
+	}
+	return nil
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// isNoScriptError checks if Redis doesn't know a script.
+func isNoScriptError(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "redis: NOSCRIPT")
+}
+
+// EOF
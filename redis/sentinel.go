@@ -0,0 +1,236 @@
+// Tideland Common Go Library - Redis - Sentinel
+//
+// Copyright (C) 2009-2013 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package redis
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"cgl.tideland.biz/applog"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+//--------------------
+// SENTINEL
+//--------------------
+
+// sentinel retrieves the addresses of a master and its replicas
+// from a list of Redis Sentinels and follows their failover
+// announcements.
+type sentinel struct {
+	mutex     sync.RWMutex
+	database  *Database
+	sentinels []*Database
+	master    string
+	replicas  []string
+	next      int
+	stopChan  chan bool
+	stopOnce  sync.Once
+}
+
+// newSentinel creates the Sentinel handling for a database
+// and starts watching for failovers.
+func newSentinel(db *Database) *sentinel {
+	s := &sentinel{
+		database: db,
+		stopChan: make(chan bool),
+	}
+	for _, address := range db.configuration.SentinelAddresses {
+		s.sentinels = append(s.sentinels, Connect(Configuration{
+			Address:   address,
+			Timeout:   db.configuration.Timeout,
+			TLSConfig: db.configuration.TLSConfig,
+			PoolSize:  1,
+			Retries:   -1,
+		}))
+	}
+	go s.backend()
+	return s
+}
+
+// masterAddress returns the address of the current master.
+func (s *sentinel) masterAddress() (string, error) {
+	s.mutex.RLock()
+	master := s.master
+	s.mutex.RUnlock()
+	if master != "" {
+		return master, nil
+	}
+	return s.discover()
+}
+
+// replicaAddress returns the address of one of the replicas
+// using round robin.
+func (s *sentinel) replicaAddress() (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.replicas) == 0 {
+		return "", false
+	}
+	s.next = (s.next + 1) % len(s.replicas)
+	return s.replicas[s.next], true
+}
+
+// isCurrent checks if the address is still the one of the
+// master or of a replica.
+func (s *sentinel) isCurrent(address string, replica bool) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if !replica {
+		return address == s.master
+	}
+	for _, r := range s.replicas {
+		if address == r {
+			return true
+		}
+	}
+	return false
+}
+
+// discover asks the Sentinels for the current master and its
+// replicas. The first answering Sentinel will be asked first
+// next time.
+func (s *sentinel) discover() (string, error) {
+	var err error
+	for idx, sdb := range s.sentinelDatabases() {
+		rs := sdb.Command("sentinel", "get-master-addr-by-name", s.database.configuration.MasterName)
+		if !rs.IsOK() {
+			err = rs.Error()
+			continue
+		}
+		if rs.ValueCount() != 2 {
+			err = &InvalidReplyError{rs.ValueCount(), nil, nil}
+			continue
+		}
+		master := net.JoinHostPort(rs.ValueAt(0).String(), rs.ValueAt(1).String())
+		replicas := s.queryReplicas(sdb)
+		s.mutex.Lock()
+		s.master = master
+		s.replicas = replicas
+		s.sentinels = append(append([]*Database{sdb}, s.sentinels[:idx]...), s.sentinels[idx+1:]...)
+		s.mutex.Unlock()
+		return master, nil
+	}
+	return "", &ConnectionError{fmt.Errorf("no sentinel knows master %q: %v", s.database.configuration.MasterName, err)}
+}
+
+// queryReplicas retrieves the addresses of the replicas which
+// are not marked as down.
+func (s *sentinel) queryReplicas(sdb *Database) []string {
+	if !s.database.configuration.ReplicaReads {
+		return nil
+	}
+	rs := sdb.Command("sentinel", "replicas", s.database.configuration.MasterName)
+	if !rs.IsOK() {
+		// Older Sentinels only know the command 'slaves'.
+		rs = sdb.Command("sentinel", "slaves", s.database.configuration.MasterName)
+		if !rs.IsOK() {
+			applog.Errorf("redis: cannot retrieve replicas of %v: %v", s.database.configuration, rs.Error())
+			return nil
+		}
+	}
+	replicas := []string{}
+	rs.ResultSetsDo(func(replica *ResultSet) {
+		h := replica.Hash()
+		flags, _ := h.String("flags")
+		if strings.Contains(flags, "s_down") || strings.Contains(flags, "o_down") || strings.Contains(flags, "disconnected") {
+			return
+		}
+		ip, _ := h.String("ip")
+		port, _ := h.String("port")
+		replicas = append(replicas, net.JoinHostPort(ip, port))
+	})
+	return replicas
+}
+
+// switchMaster sets a new master announced by a Sentinel and
+// resets the pooled connections.
+func (s *sentinel) switchMaster(master string, sdb *Database) {
+	replicas := s.queryReplicas(sdb)
+	s.mutex.Lock()
+	old := s.master
+	s.master = master
+	s.replicas = replicas
+	s.mutex.Unlock()
+	applog.Warningf("redis: master of %v switched from %s to %s", s.database.configuration, old, master)
+	s.database.resetPools()
+}
+
+// sentinelDatabases returns a copy of the current Sentinel list.
+func (s *sentinel) sentinelDatabases() []*Database {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	sdbs := make([]*Database, len(s.sentinels))
+	copy(sdbs, s.sentinels)
+	return sdbs
+}
+
+// stop ends the watching of the Sentinels.
+func (s *sentinel) stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopChan)
+	})
+}
+
+// backend subscribes to the failover announcements of one of
+// the Sentinels. If that connection fails the next one is used.
+func (s *sentinel) backend() {
+	defer func() {
+		for _, sdb := range s.sentinelDatabases() {
+			sdb.Close()
+		}
+	}()
+	for {
+		for _, sdb := range s.sentinelDatabases() {
+			sub, err := sdb.Subscribe("+switch-master")
+			if err != nil {
+				continue
+			}
+			// Failovers may have happened while not watching.
+			s.discover()
+			stopped := s.watch(sub, sdb)
+			sub.Stop()
+			if stopped {
+				return
+			}
+		}
+		select {
+		case <-s.stopChan:
+			return
+		case <-time.After(s.database.configuration.MaxRetryDelay):
+		}
+	}
+}
+
+// watch handles the failover announcements of a subscription. It
+// returns true if the sentinel has been stopped.
+func (s *sentinel) watch(sub *Subscription, sdb *Database) bool {
+	for {
+		select {
+		case value, ok := <-sub.Values():
+			if !ok {
+				return false
+			}
+			// Announcement is '<name> <old-ip> <old-port> <new-ip> <new-port>'.
+			parts := strings.Fields(value.Value.String())
+			if len(parts) != 5 || parts[0] != s.database.configuration.MasterName {
+				continue
+			}
+			s.switchMaster(net.JoinHostPort(parts[3], parts[4]), sdb)
+		case <-s.stopChan:
+			return true
+		}
+	}
+}
+
+// EOF
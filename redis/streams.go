@@ -0,0 +1,405 @@
+// Tideland Common Go Library - Redis - Streams
+//
+// Copyright (C) 2009-2013 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package redis
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"cgl.tideland.biz/applog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//--------------------
+// STREAM ENTRIES
+//--------------------
+
+// StreamEntry is one entry of a stream.
+type StreamEntry struct {
+	Stream string
+	ID     string
+	Fields Hash
+}
+
+// newStreamEntry creates a stream entry out of a result
+// set containing the ID and the fields.
+func newStreamEntry(stream string, rs *ResultSet) (*StreamEntry, bool) {
+	if !rs.IsOK() || rs.ResultSetCount() != 2 {
+		// Entry has been deleted.
+		return nil, false
+	}
+	return &StreamEntry{
+		Stream: stream,
+		ID:     rs.ResultSetAt(0).ValueAsString(),
+		Fields: rs.ResultSetAt(1).Hash(),
+	}, true
+}
+
+// newStreamEntries creates the stream entries out of a
+// result set containing a list of entries.
+func newStreamEntries(stream string, rs *ResultSet) []*StreamEntry {
+	entries := []*StreamEntry{}
+	rs.ResultSetsDo(func(ers *ResultSet) {
+		if entry, ok := newStreamEntry(stream, ers); ok {
+			entries = append(entries, entry)
+		}
+	})
+	return entries
+}
+
+// PendingEntry is an entry delivered to a consumer of a
+// group but not yet acknowledged.
+type PendingEntry struct {
+	ID         string
+	Consumer   string
+	Idle       time.Duration
+	Deliveries int
+}
+
+//--------------------
+// STREAM COMMANDS
+//--------------------
+
+// XAdd appends an entry with the fields to the stream. An empty
+// id lets Redis generate the ID. The ID of the entry is returned.
+func (db *Database) XAdd(stream, id string, fields Hash) (string, error) {
+	if id == "" {
+		id = "*"
+	}
+	rs := db.Command("xadd", stream, id, fields)
+	if !rs.IsOK() {
+		return "", rs.Error()
+	}
+	return rs.ValueAsString(), nil
+}
+
+// XGroupCreate creates a consumer group for the stream starting
+// at the ID start, "$" means only new entries. The stream is
+// created if needed. An already existing group is no error.
+func (db *Database) XGroupCreate(stream, group, start string) error {
+	rs := db.Command("xgroup", "create", stream, group, start, "mkstream")
+	if !rs.IsOK() && !strings.HasPrefix(rs.Error().Error(), "redis: BUSYGROUP") {
+		return rs.Error()
+	}
+	return nil
+}
+
+// XReadGroup reads new entries of the streams for the consumer of
+// the group. A count greater than zero limits the number of entries
+// per stream. If block is greater than zero it waits that long for
+// new entries. Without new entries an empty slice is returned.
+func (db *Database) XReadGroup(group, consumer string, count int, block time.Duration, streams ...string) ([]*StreamEntry, error) {
+	args := []interface{}{"group", group, consumer}
+	if count > 0 {
+		args = append(args, "count", count)
+	}
+	if block > 0 {
+		args = append(args, "block", durationToMilliseconds(block))
+	}
+	args = append(args, "streams")
+	for _, stream := range streams {
+		args = append(args, stream)
+	}
+	for range streams {
+		args = append(args, ">")
+	}
+	rs := db.Command("xreadgroup", args...)
+	if IsTimeoutError(rs.Error()) {
+		// No new entries.
+		return []*StreamEntry{}, nil
+	}
+	if !rs.IsOK() {
+		return nil, rs.Error()
+	}
+	// Reply contains the name and the entries of each stream.
+	entries := []*StreamEntry{}
+	rs.ResultSetsDo(func(srs *ResultSet) {
+		stream := srs.ResultSetAt(0).ValueAsString()
+		entries = append(entries, newStreamEntries(stream, srs.ResultSetAt(1))...)
+	})
+	return entries, nil
+}
+
+// XAck acknowledges the entries of the stream for the group. It
+// returns the number of acknowledged entries.
+func (db *Database) XAck(stream, group string, ids ...string) (int, error) {
+	rs := db.Command("xack", argsToInterfaces(stream, group, ids)...)
+	if !rs.IsOK() {
+		return 0, rs.Error()
+	}
+	return rs.ValueAsInt()
+}
+
+// XPending returns up to count pending entries of the group. If
+// consumer is not empty only its entries are returned.
+func (db *Database) XPending(stream, group string, count int, consumer string) ([]*PendingEntry, error) {
+	return db.XPendingRange(stream, group, "-", "+", count, consumer)
+}
+
+// XPendingRange works like XPending() but returns only the entries
+// with IDs between start and end, e.g. to page through them.
+func (db *Database) XPendingRange(stream, group, start, end string, count int, consumer string) ([]*PendingEntry, error) {
+	args := []interface{}{stream, group, start, end, count}
+	if consumer != "" {
+		args = append(args, consumer)
+	}
+	rs := db.Command("xpending", args...)
+	if !rs.IsOK() {
+		return nil, rs.Error()
+	}
+	// Each pending entry contains ID, consumer, idle
+	// time in milliseconds and number of deliveries.
+	pending := []*PendingEntry{}
+	rs.ResultSetsDo(func(prs *ResultSet) {
+		if prs.ValueCount() != 4 {
+			return
+		}
+		idle, _ := prs.ValueAt(2).Int64()
+		deliveries, _ := prs.ValueAt(3).Int()
+		pending = append(pending, &PendingEntry{
+			ID:         prs.ValueAt(0).String(),
+			Consumer:   prs.ValueAt(1).String(),
+			Idle:       time.Duration(idle) * time.Millisecond,
+			Deliveries: deliveries,
+		})
+	})
+	return pending, nil
+}
+
+// XClaim transfers the pending entries idle for at least minIdle
+// to the consumer of the group. The claimed entries are returned,
+// deleted entries are left out.
+func (db *Database) XClaim(stream, group, consumer string, minIdle time.Duration, ids ...string) ([]*StreamEntry, error) {
+	rs := db.Command("xclaim", argsToInterfaces(stream, group, consumer, durationToMilliseconds(minIdle), ids)...)
+	if !rs.IsOK() {
+		return nil, rs.Error()
+	}
+	return newStreamEntries(stream, rs), nil
+}
+
+//--------------------
+// STREAM CONSUMER
+//--------------------
+
+// StreamConsumerOptions control a stream consumer. Count is the
+// maximum number of entries read at once, default is 10. Block
+// is the time waiting for new entries, default is one second.
+// Pending entries idle for at least MinIdle, default is one
+// minute, are claimed every ClaimInterval, default is MinIdle.
+type StreamConsumerOptions struct {
+	Count         int
+	Block         time.Duration
+	MinIdle       time.Duration
+	ClaimInterval time.Duration
+}
+
+// StreamDelivery is an entry delivered by a stream consumer. It
+// has to be acknowledged after a successful processing, otherwise
+// it will be delivered again. StreamConsumer.Handle() does this
+// automatically.
+type StreamDelivery struct {
+	*StreamEntry
+	consumer *StreamConsumer
+}
+
+// Ack acknowledges the entry.
+func (sd *StreamDelivery) Ack() error {
+	_, err := sd.consumer.database.XAck(sd.Stream, sd.consumer.group, sd.ID)
+	return err
+}
+
+// StreamConsumer reads the entries of a stream as member of a
+// consumer group and delivers them on a channel. Stale pending
+// entries, e.g. of dead consumers, are claimed and delivered again.
+// The claiming pages through all pending entries, Count per read.
+type StreamConsumer struct {
+	mutex        sync.Mutex
+	database     *Database
+	stream       string
+	group        string
+	consumer     string
+	options      StreamConsumerOptions
+	error        error
+	lastClaim    time.Time
+	claimStart   string
+	deliveryChan chan *StreamDelivery
+	stopChan     chan bool
+	stopOnce     sync.Once
+}
+
+// ConsumeStream starts a consumer of the stream in the group. The
+// group is created if it doesn't exist.
+func (db *Database) ConsumeStream(stream, group, consumer string, options StreamConsumerOptions) (*StreamConsumer, error) {
+	if err := db.XGroupCreate(stream, group, "$"); err != nil {
+		return nil, err
+	}
+	if options.Count <= 0 {
+		options.Count = 10
+	}
+	if options.Block <= 0 {
+		options.Block = time.Second
+	}
+	if options.MinIdle <= 0 {
+		options.MinIdle = time.Minute
+	}
+	if options.ClaimInterval <= 0 {
+		options.ClaimInterval = options.MinIdle
+	}
+	sc := &StreamConsumer{
+		database:     db,
+		stream:       stream,
+		group:        group,
+		consumer:     consumer,
+		options:      options,
+		deliveryChan: make(chan *StreamDelivery),
+		stopChan:     make(chan bool),
+	}
+	go sc.backend()
+	return sc, nil
+}
+
+// Deliveries returns a channel emitting the entries. It is closed
+// when the consumer is stopped.
+func (sc *StreamConsumer) Deliveries() <-chan *StreamDelivery {
+	return sc.deliveryChan
+}
+
+// Error returns the last error of the consumer.
+func (sc *StreamConsumer) Error() error {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	return sc.error
+}
+
+// Handle calls the handler for each delivered entry until the
+// consumer is stopped. An entry is acknowledged if the handler
+// returns nil, otherwise it stays pending and will be claimed
+// and delivered again.
+func (sc *StreamConsumer) Handle(handler func(entry *StreamEntry) error) {
+	for sd := range sc.deliveryChan {
+		if err := handler(sd.StreamEntry); err != nil {
+			applog.Errorf("redis: consumer %q of stream %q can't handle entry %q: %v", sc.consumer, sc.stream, sd.ID, err)
+			continue
+		}
+		if err := sd.Ack(); err != nil {
+			sc.mutex.Lock()
+			sc.error = err
+			sc.mutex.Unlock()
+			applog.Errorf("redis: consumer %q of stream %q can't acknowledge entry %q: %v", sc.consumer, sc.stream, sd.ID, err)
+		}
+	}
+}
+
+// Stop ends the consuming. A running blocking read will
+// be finished first.
+func (sc *StreamConsumer) Stop() {
+	sc.stopOnce.Do(func() {
+		close(sc.stopChan)
+	})
+}
+
+// backend reads and claims the entries and delivers them.
+func (sc *StreamConsumer) backend() {
+	defer close(sc.deliveryChan)
+	for {
+		var entries []*StreamEntry
+		var err error
+		if sc.claimStart != "" || time.Now().Sub(sc.lastClaim) >= sc.options.ClaimInterval {
+			entries, err = sc.claim()
+		} else {
+			entries, err = sc.database.XReadGroup(sc.group, sc.consumer, sc.options.Count, sc.options.Block, sc.stream)
+		}
+		if err != nil {
+			sc.mutex.Lock()
+			sc.error = err
+			sc.mutex.Unlock()
+			if IsDatabaseClosedError(err) {
+				return
+			}
+			applog.Errorf("redis: consumer %q of stream %q failed: %v", sc.consumer, sc.stream, err)
+			select {
+			case <-sc.stopChan:
+				return
+			case <-time.After(sc.database.configuration.RetryDelay):
+			}
+			continue
+		}
+		for _, entry := range entries {
+			select {
+			case sc.deliveryChan <- &StreamDelivery{entry, sc}:
+			case <-sc.stopChan:
+				return
+			}
+		}
+		select {
+		case <-sc.stopChan:
+			return
+		default:
+		}
+	}
+}
+
+// claim claims the stale entries of the next page of pending
+// entries. Own entries are included, so unacknowledged deliveries
+// are retried. The following pages are claimed by the next calls.
+func (sc *StreamConsumer) claim() ([]*StreamEntry, error) {
+	start := sc.claimStart
+	if start == "" {
+		sc.lastClaim = time.Now()
+		start = "-"
+	}
+	pending, err := sc.database.XPendingRange(sc.stream, sc.group, start, "+", sc.options.Count, "")
+	if err != nil {
+		sc.claimStart = ""
+		return nil, err
+	}
+	if len(pending) < sc.options.Count {
+		sc.claimStart = ""
+	} else {
+		sc.claimStart = nextStreamID(pending[len(pending)-1].ID)
+	}
+	ids := []string{}
+	for _, pe := range pending {
+		if pe.Idle >= sc.options.MinIdle {
+			ids = append(ids, pe.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return []*StreamEntry{}, nil
+	}
+	return sc.database.XClaim(sc.stream, sc.group, sc.consumer, sc.options.MinIdle, ids...)
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// nextStreamID returns the smallest ID following the passed one
+// by incrementing the sequence number.
+func nextStreamID(id string) string {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return id
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return id
+	}
+	return parts[0] + "-" + strconv.FormatUint(seq+1, 10)
+}
+
+// durationToMilliseconds converts a duration into milliseconds.
+func durationToMilliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+// EOF
@@ -0,0 +1,364 @@
+// Tideland Common Go Library - Redis - Struct Mapping
+//
+// Copyright (C) 2009-2013 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package redis
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//--------------------
+// HASHABLE STRUCT
+//--------------------
+
+// HashableStruct implements the Hashable interface for any
+// struct using reflection. Conversion errors are stored and
+// can be retrieved with Error().
+type HashableStruct struct {
+	value interface{}
+	err   error
+}
+
+// NewHashableStruct creates a hashable for the passed
+// pointer to a struct.
+func NewHashableStruct(v interface{}) *HashableStruct {
+	return &HashableStruct{value: v}
+}
+
+// GetHash returns the fields of the struct as hash.
+func (hs *HashableStruct) GetHash() Hash {
+	var h Hash
+	h, hs.err = StructToHash(hs.value)
+	return h
+}
+
+// SetHash sets the fields of the struct from the hash.
+func (hs *HashableStruct) SetHash(h Hash) {
+	hs.err = HashToStruct(h, hs.value)
+}
+
+// Error returns the error of the last conversion.
+func (hs *HashableStruct) Error() error {
+	return hs.err
+}
+
+//--------------------
+// DATABASE HELPERS
+//--------------------
+
+// StoreStruct stores the fields of a struct in a hash. The hash is
+// replaced in a transaction, so fields omitted now are removed too.
+// If no field is stored at all the hash is deleted.
+func (db *Database) StoreStruct(key string, v interface{}) *ResultSet {
+	h, err := StructToHash(v)
+	if err != nil {
+		rs := newResultSet("multi")
+		rs.err = err
+		return rs
+	}
+	return db.MultiCommand(func(mc *MultiCommand) {
+		mc.Command("del", key)
+		if h.Len() > 0 {
+			mc.Command("hset", key, h)
+		}
+	})
+}
+
+// LoadStruct loads the fields of a struct from a hash.
+func (db *Database) LoadStruct(key string, v interface{}) error {
+	rs := db.Command("hgetall", key)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+	if rs.ValueCount() == 0 {
+		return &InvalidKeyError{key}
+	}
+	return rs.Struct(v)
+}
+
+// Struct sets the fields of the struct pointed to by v from
+// the values of the result set interpreted as hash.
+func (rs *ResultSet) Struct(v interface{}) error {
+	return HashToStruct(rs.Hash(), v)
+}
+
+//--------------------
+// CONVERSION
+//--------------------
+
+// StructToHash converts a struct or pointer to a struct into a hash.
+// The field names are the names of the exported fields or the names
+// set in the tag 'redis', e.g. `redis:"name"`. Fields tagged with
+// `redis:"-"` are ignored, with `redis:"name,omitempty"` empty values
+// are left out. Nested structs, maps and slices are encoded as JSON,
+// times as RFC 3339. Anonymous struct fields are flattened.
+func StructToHash(v interface{}) (Hash, error) {
+	sv := reflect.Indirect(reflect.ValueOf(v))
+	if sv.Kind() != reflect.Struct {
+		return nil, &InvalidTypeError{"struct", fmt.Sprintf("%T", v), nil}
+	}
+	h := NewHash()
+	if err := structToHash(sv, h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// HashToStruct sets the fields of the struct pointed to by v from
+// the hash. Fields not contained in the hash are left untouched.
+// The naming follows the same rules as in StructToHash.
+func HashToStruct(h Hash, v interface{}) error {
+	pv := reflect.ValueOf(v)
+	if pv.Kind() != reflect.Ptr || pv.Elem().Kind() != reflect.Struct {
+		return &InvalidTypeError{"pointer to struct", fmt.Sprintf("%T", v), nil}
+	}
+	return hashToStruct(h, pv.Elem())
+}
+
+// structToHash adds the fields of the struct to the hash.
+func structToHash(sv reflect.Value, h Hash) error {
+	st := sv.Type()
+	for i := 0; i < st.NumField(); i++ {
+		sf := st.Field(i)
+		fv := sv.Field(i)
+		name, omitEmpty, ok := fieldName(sf)
+		if !ok {
+			continue
+		}
+		if name == "" && isEmbeddedStruct(sf) {
+			// Flatten embedded struct.
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			if err := structToHash(fv, h); err != nil {
+				return err
+			}
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		if fv.Kind() == reflect.Ptr {
+			if fv.IsNil() {
+				continue
+			}
+			fv = fv.Elem()
+		}
+		if omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		b, err := fieldToBytes(fv)
+		if err != nil {
+			return &InvalidTypeError{fv.Type().String(), name, err}
+		}
+		h[name] = Value(b)
+	}
+	return nil
+}
+
+// hashToStruct sets the fields of the struct from the hash.
+func hashToStruct(h Hash, sv reflect.Value) error {
+	st := sv.Type()
+	for i := 0; i < st.NumField(); i++ {
+		sf := st.Field(i)
+		fv := sv.Field(i)
+		name, _, ok := fieldName(sf)
+		if !ok {
+			continue
+		}
+		if name == "" && isEmbeddedStruct(sf) {
+			// Fill embedded struct.
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					fv.Set(reflect.New(fv.Type().Elem()))
+				}
+				fv = fv.Elem()
+			}
+			if err := hashToStruct(h, fv); err != nil {
+				return err
+			}
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		value, ok := h[name]
+		if !ok {
+			continue
+		}
+		if fv.Kind() == reflect.Ptr {
+			if fv.IsNil() {
+				fv.Set(reflect.New(fv.Type().Elem()))
+			}
+			fv = fv.Elem()
+		}
+		if err := bytesToField(value, fv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fieldName returns the name of a field in the hash, if empty values
+// shall be omitted and if the field is mapped at all. An empty
+// name means the name of the field.
+func fieldName(sf reflect.StructField) (string, bool, bool) {
+	if sf.PkgPath != "" {
+		// Unexported field.
+		return "", false, false
+	}
+	tag := sf.Tag.Get("redis")
+	if tag == "-" {
+		return "", false, false
+	}
+	parts := strings.Split(tag, ",")
+	omitEmpty := false
+	for _, option := range parts[1:] {
+		if option == "omitempty" {
+			omitEmpty = true
+		}
+	}
+	return parts[0], omitEmpty, true
+}
+
+// isEmbeddedStruct checks if the field is an embedded struct
+// or pointer to a struct which will be flattened.
+func isEmbeddedStruct(sf reflect.StructField) bool {
+	if !sf.Anonymous {
+		return false
+	}
+	t := sf.Type
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct && t != reflect.TypeOf(time.Time{})
+}
+
+// fieldToBytes converts the value of a field into bytes.
+func fieldToBytes(fv reflect.Value) ([]byte, error) {
+	switch fv.Kind() {
+	case reflect.String:
+		return []byte(fv.String()), nil
+	case reflect.Bool:
+		return []byte(strconv.FormatBool(fv.Bool())), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return []byte(strconv.FormatInt(fv.Int(), 10)), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return []byte(strconv.FormatUint(fv.Uint(), 10)), nil
+	case reflect.Float32, reflect.Float64:
+		return []byte(strconv.FormatFloat(fv.Float(), 'g', -1, fv.Type().Bits())), nil
+	case reflect.Slice:
+		if fv.Type().Elem().Kind() == reflect.Uint8 {
+			return fv.Bytes(), nil
+		}
+	case reflect.Struct:
+		if t, ok := fv.Interface().(time.Time); ok {
+			return []byte(t.Format(time.RFC3339Nano)), nil
+		}
+	}
+	// Encode all other values as JSON.
+	return json.Marshal(fv.Interface())
+}
+
+// bytesToField sets the field based on the value.
+func bytesToField(v Value, fv reflect.Value) error {
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(v.String())
+		return nil
+	case reflect.Bool:
+		b, err := v.Bool()
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := v.Int64()
+		if err != nil {
+			return err
+		}
+		if fv.OverflowInt(i) {
+			return &InvalidTypeError{fv.Type().String(), v.String(), nil}
+		}
+		fv.SetInt(i)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := v.Uint64()
+		if err != nil {
+			return err
+		}
+		if fv.OverflowUint(u) {
+			return &InvalidTypeError{fv.Type().String(), v.String(), nil}
+		}
+		fv.SetUint(u)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(f)
+		return nil
+	case reflect.Slice:
+		if fv.Type().Elem().Kind() == reflect.Uint8 {
+			fv.SetBytes(append([]byte{}, v.Bytes()...))
+			return nil
+		}
+	case reflect.Struct:
+		if _, ok := fv.Interface().(time.Time); ok {
+			t, err := time.Parse(time.RFC3339Nano, v.String())
+			if err != nil {
+				return &InvalidTypeError{"time", v.String(), err}
+			}
+			fv.Set(reflect.ValueOf(t))
+			return nil
+		}
+	}
+	// Decode all other values from JSON.
+	if err := json.Unmarshal(v.Bytes(), fv.Addr().Interface()); err != nil {
+		return &InvalidTypeError{fv.Type().String(), v.String(), err}
+	}
+	return nil
+}
+
+// isEmptyValue checks if a value is the zero value of its type.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	case reflect.Struct:
+		if t, ok := v.Interface().(time.Time); ok {
+			return t.IsZero()
+		}
+	}
+	return false
+}
+
+// EOF
@@ -7,6 +7,19 @@
 
 package redis
 
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"cgl.tideland.biz/applog"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
 //--------------------
 // SUBSCRIPTION VALUE
 //--------------------
@@ -40,72 +53,344 @@ func newSubscriptionValue(data [][]byte) *SubscriptionValue {
 	return nil
 }
 
+// KeyspaceEvent returns the keyspace or keyevent notification
+// contained in the value. If the value is no notification false
+// is returned.
+func (sv *SubscriptionValue) KeyspaceEvent() (*KeyspaceEvent, bool) {
+	return ParseKeyspaceEvent(sv.Channel, sv.Value.String())
+}
+
+//--------------------
+// KEYSPACE EVENT
+//--------------------
+
+// Prefixes of the notification channels.
+const (
+	keyspacePrefix = "__keyspace@"
+	keyeventPrefix = "__keyevent@"
+)
+
+// KeyspaceEvent is a notification about an operation on a key.
+type KeyspaceEvent struct {
+	Database  int
+	Key       string
+	Operation string
+}
+
+// ParseKeyspaceEvent parses the channel and message of a keyspace
+// notification like "__keyspace@0__:mykey" with message "set" or
+// a keyevent notification like "__keyevent@0__:set" with message
+// "mykey". If it is no notification false is returned.
+func ParseKeyspaceEvent(channel, message string) (*KeyspaceEvent, bool) {
+	var keyspace bool
+	switch {
+	case strings.HasPrefix(channel, keyspacePrefix):
+		keyspace = true
+	case strings.HasPrefix(channel, keyeventPrefix):
+		keyspace = false
+	default:
+		return nil, false
+	}
+	rest := channel[len(keyspacePrefix):]
+	end := strings.Index(rest, "__:")
+	if end < 0 {
+		return nil, false
+	}
+	index, err := strconv.Atoi(rest[:end])
+	if err != nil {
+		return nil, false
+	}
+	ke := &KeyspaceEvent{Database: index}
+	if keyspace {
+		ke.Key, ke.Operation = rest[end+3:], message
+	} else {
+		ke.Key, ke.Operation = message, rest[end+3:]
+	}
+	return ke, true
+}
+
+// String returns the event in a readable form.
+func (ke *KeyspaceEvent) String() string {
+	return fmt.Sprintf("%s %q in database %d", ke.Operation, ke.Key, ke.Database)
+}
+
 //--------------------
 // SUBSCRIPTION
 //--------------------
 
 // Subscription manages a subscription one or more channels in Redis.
+// If the connection breaks it reconnects and subscribes the channels
+// again.
 type Subscription struct {
+	mutex        sync.Mutex
+	database     *Database
 	urp          *unifiedRequestProtocol
 	error        error
+	channels     map[string]bool
+	patterns     map[string]bool
 	channelCount int
+	reconnecting bool
 	valueChan    chan *SubscriptionValue
+	stopChan     chan bool
+	stopOnce     sync.Once
 }
 
 // newSubscription creates a new subscription.
-func newSubscription(urp *unifiedRequestProtocol, channels ...string) *Subscription {
+func newSubscription(db *Database, urp *unifiedRequestProtocol, channels ...string) *Subscription {
 	sub := &Subscription{
+		database:  db,
 		urp:       urp,
+		channels:  make(map[string]bool),
+		patterns:  make(map[string]bool),
 		valueChan: make(chan *SubscriptionValue, 10),
+		stopChan:  make(chan bool),
 	}
-	sub.channelCount = sub.urp.subscribe(channels...)
+	sub.Subscribe(channels...)
 	go sub.backend()
 	return sub
 }
 
-// Subscribe adds one or more channels to the subscription.
+// Subscribe adds one or more channels to the subscription. Channels
+// containing the glob-style characters '*', '?' or '[' are subscribed
+// as patterns.
 func (s *Subscription) Subscribe(channels ...string) int {
-	s.channelCount = s.urp.subscribe(channels...)
-	return s.channelCount
+	channels, patterns := splitPatterns(channels)
+	if len(patterns) > 0 {
+		s.PSubscribe(patterns...)
+	}
+	return s.subscribe(false, s.channels, channels)
 }
 
 // Unsubscribe removes one or more channels from the subscription.
+// Channels containing glob-style characters are unsubscribed as
+// patterns. Without arguments all channels are removed.
 func (s *Subscription) Unsubscribe(channels ...string) int {
-	s.channelCount = s.urp.unsubscribe(channels...)
+	if len(channels) == 0 {
+		return s.unsubscribe(false, s.channels, nil)
+	}
+	channels, patterns := splitPatterns(channels)
+	count := s.ChannelCount()
+	if len(patterns) > 0 {
+		count = s.PUnsubscribe(patterns...)
+	}
+	if len(channels) > 0 {
+		count = s.unsubscribe(false, s.channels, channels)
+	}
+	return count
+}
+
+// PSubscribe adds one or more patterns to the subscription.
+func (s *Subscription) PSubscribe(patterns ...string) int {
+	return s.subscribe(true, s.patterns, patterns)
+}
+
+// PUnsubscribe removes one or more patterns from the subscription.
+// Without arguments all patterns are removed.
+func (s *Subscription) PUnsubscribe(patterns ...string) int {
+	return s.unsubscribe(true, s.patterns, patterns)
+}
+
+// subscribe subscribes the channels or patterns and adds
+// them to the subscribed ones.
+func (s *Subscription) subscribe(pattern bool, subscribed map[string]bool, channels []string) int {
+	s.mutex.Lock()
+	if len(channels) == 0 || s.reconnecting {
+		// During reconnecting they will be subscribed
+		// by the new connection.
+		for _, channel := range channels {
+			subscribed[channel] = true
+		}
+		defer s.mutex.Unlock()
+		return s.channelCount
+	}
+	for _, channel := range channels {
+		subscribed[channel] = true
+	}
+	urp := s.urp
+	s.mutex.Unlock()
+	return s.updateChannelCount(urp, func() (int, bool) {
+		return urp.subscribe(pattern, channels...)
+	})
+}
+
+// unsubscribe unsubscribes the channels or patterns, or all
+// if none are passed, and removes them from the subscribed ones.
+func (s *Subscription) unsubscribe(pattern bool, subscribed map[string]bool, channels []string) int {
+	s.mutex.Lock()
+	if len(channels) == 0 {
+		for channel := range subscribed {
+			channels = append(channels, channel)
+		}
+	}
+	for _, channel := range channels {
+		delete(subscribed, channel)
+	}
+	if len(channels) == 0 || s.reconnecting {
+		// During reconnecting they won't be subscribed
+		// by the new connection.
+		defer s.mutex.Unlock()
+		return s.channelCount
+	}
+	urp := s.urp
+	s.mutex.Unlock()
+	return s.updateChannelCount(urp, func() (int, bool) {
+		return urp.unsubscribe(pattern, channels...)
+	})
+}
+
+// updateChannelCount performs the subscription change without holding
+// the mutex, so a stopped protocol doesn't block the subscription. The
+// count is only taken if the protocol hasn't been replaced meanwhile.
+func (s *Subscription) updateChannelCount(urp *unifiedRequestProtocol, change func() (int, bool)) int {
+	count, ok := change()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if ok && urp == s.urp {
+		s.channelCount = count
+	}
 	return s.channelCount
 }
 
-// ChannelCount returns the number of subscribed channels.
+// ChannelCount returns the number of subscribed channels and patterns.
 func (s *Subscription) ChannelCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	return s.channelCount
 }
 
 // Values returns a channel emitting the subscription valies.
+// It is closed when the subscription is stopped or if the
+// reconnecting failed.
 func (s *Subscription) Values() <-chan *SubscriptionValue {
 	return s.valueChan
 }
 
+// Error returns the error if reconnecting the subscription failed.
+func (s *Subscription) Error() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.error
+}
+
 // Stop ends the subscription..
 func (s *Subscription) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopChan)
+	})
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.urp.stop()
-	close(s.valueChan)
 }
 
 // backend is the serving goroutine for the subscription.
 func (s *Subscription) backend() {
-	for epd := range s.urp.publishedDataChan {
-		// Received a published data, republish
-		// as subscription value.
-		sv := newSubscriptionValue(epd.data)
-		// Send the subscription value.
+	defer close(s.valueChan)
+	for {
+		s.mutex.Lock()
+		urp := s.urp
+		s.mutex.Unlock()
 		select {
-		case s.valueChan <- sv:
-			// OK.
-		default:
-			// Not sent!
+		case epd := <-urp.publishedDataChan:
+			if epd.err != nil {
+				if !IsConnectionError(epd.err) {
+					applog.Errorf("redis: subscription received an error: %v", epd.err)
+					continue
+				}
+				// Connection is broken, try to reconnect.
+				if err := s.reconnect(); err != nil {
+					applog.Errorf("redis: subscription cannot reconnect: %v", err)
+					return
+				}
+				continue
+			}
+			// Received a published data, republish
+			// as subscription value.
+			sv := newSubscriptionValue(epd.data)
+			if sv == nil {
+				continue
+			}
+			// Send the subscription value.
+			select {
+			case s.valueChan <- sv:
+			case <-s.stopChan:
+				return
+			}
+		case <-s.stopChan:
 			return
 		}
 	}
 }
 
+// reconnect replaces the broken protocol by a new one and
+// subscribes the channels again. The mutex isn't held while
+// connecting, so the subscription can be changed or stopped
+// during the retries.
+func (s *Subscription) reconnect() error {
+	s.mutex.Lock()
+	s.urp.stop()
+	s.reconnecting = true
+	s.mutex.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-s.stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	urp, err := s.database.connect(ctx, false)
+	cancel()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reconnecting = false
+	// Check if the subscription has been stopped meanwhile.
+	select {
+	case <-s.stopChan:
+		if urp != nil {
+			urp.stop()
+		}
+		return nil
+	default:
+	}
+	if err != nil {
+		s.error = err
+		return err
+	}
+	s.urp = urp
+	// Subscribe channels and patterns separately again.
+	var channels, patterns []string
+	for channel := range s.channels {
+		channels = append(channels, channel)
+	}
+	for pattern := range s.patterns {
+		patterns = append(patterns, pattern)
+	}
+	if len(channels) > 0 {
+		s.channelCount, _ = urp.subscribe(false, channels...)
+	}
+	if len(patterns) > 0 {
+		s.channelCount, _ = urp.subscribe(true, patterns...)
+	}
+	applog.Infof("redis: subscription reconnected to %v", s.database.configuration)
+	return nil
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// splitPatterns separates the channels containing glob-style
+// characters from the plain ones.
+func splitPatterns(all []string) ([]string, []string) {
+	var channels, patterns []string
+	for _, channel := range all {
+		if strings.IndexAny(channel, "*?[") != -1 {
+			patterns = append(patterns, channel)
+		} else {
+			channels = append(channels, channel)
+		}
+	}
+	return channels, patterns
+}
+
 // EOF
@@ -16,11 +16,14 @@ import (
 	"cgl.tideland.biz/applog"
 	"cgl.tideland.biz/identifier"
 	"cgl.tideland.biz/monitoring"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -28,18 +31,33 @@ import (
 // MISC
 //--------------------
 
+// errKeyNotFound signals a nil bulk reply.
+var errKeyNotFound = errors.New("redis: key not found")
+
+// errCommandCancelled signals a command whose context
+// has been done while waiting for the reply.
+var errCommandCancelled = errors.New("redis: command cancelled")
+
 // envCommand is the envelope for almost all commands.
 type envCommand struct {
-	rs       *ResultSet
-	multi    bool
-	command  string
-	args     []interface{}
+	rs         *ResultSet
+	multi      bool
+	command    string
+	args       []interface{}
+	cancelChan <-chan struct{}
+	doneChan   chan bool
+}
+
+// envPipeline is the envelope for pipelined commands.
+type envPipeline struct {
+	commands []*envCommand
 	doneChan chan bool
 }
 
 // envSubscription is the envelope for subscriptions.
 type envSubscription struct {
 	in        bool
+	pattern   bool
 	channels  []string
 	countChan chan int
 }
@@ -69,35 +87,49 @@ type envPublishedData struct {
 // unifiedRequestProtocol implements the Redis unified request protocol URP.
 type unifiedRequestProtocol struct {
 	database          *Database
+	address           string
+	replica           bool
 	conn              net.Conn
 	writer            *bufio.Writer
 	reader            *bufio.Reader
 	err               error
 	commandChan       chan *envCommand
+	pipelineChan      chan *envPipeline
 	subscriptionChan  chan *envSubscription
 	dataChan          chan *envData
 	publishedDataChan chan *envPublishedData
+	cancelChan        <-chan struct{}
+	brokenChan        chan bool
 	stopChan          chan bool
+	stopOnce          sync.Once
+	lastUsed          time.Time
 }
 
-// newUnifiedRequestProtocol creates a new protocol.
-func newUnifiedRequestProtocol(db *Database) (*unifiedRequestProtocol, error) {
+// newUnifiedRequestProtocol creates a new protocol connected
+// to the passed address. Connecting, authentication and selection
+// of the database end when the context is done.
+func newUnifiedRequestProtocol(ctx context.Context, db *Database, address string, replica bool) (*unifiedRequestProtocol, error) {
 	// Establish the connection.
-	conn, err := net.DialTimeout("tcp", db.configuration.Address, db.configuration.Timeout)
+	conn, err := dial(ctx, db.configuration, address)
 	if err != nil {
 		return nil, &ConnectionError{err}
 	}
 	// Create the URP.
 	urp := &unifiedRequestProtocol{
 		database:          db,
+		address:           address,
+		replica:           replica,
 		conn:              conn,
 		writer:            bufio.NewWriter(conn),
 		reader:            bufio.NewReader(conn),
 		commandChan:       make(chan *envCommand),
+		pipelineChan:      make(chan *envPipeline),
 		subscriptionChan:  make(chan *envSubscription),
 		dataChan:          make(chan *envData, 20),
 		publishedDataChan: make(chan *envPublishedData, 5),
+		brokenChan:        make(chan bool),
 		stopChan:          make(chan bool),
+		lastUsed:          time.Now(),
 	}
 	// Start goroutines.
 	go urp.receiver()
@@ -105,17 +137,25 @@ func newUnifiedRequestProtocol(db *Database) (*unifiedRequestProtocol, error) {
 	// Authenticate if needed.
 	var rs *ResultSet
 	if db.configuration.Auth != "" {
+		args := []interface{}{db.configuration.Auth}
+		if db.configuration.Username != "" {
+			// ACL authentication.
+			args = []interface{}{db.configuration.Username, db.configuration.Auth}
+		}
 		rs = newResultSet("auth")
-		urp.command(rs, false, "auth", db.configuration.Auth)
+		urp.commandContext(ctx, rs, false, "auth", args...)
 		if !rs.IsOK() {
 			// Authentication is not ok, so reset.
 			urp.stop()
 			return nil, rs.Error()
 		}
 	}
-	// Select database.
+	// Select database if it's not the default one.
+	if db.configuration.Database == 0 {
+		return urp, nil
+	}
 	rs = newResultSet("select")
-	urp.command(rs, false, "select", db.configuration.Database)
+	urp.commandContext(ctx, rs, false, "select", db.configuration.Database)
 	if !rs.IsOK() {
 		// Connection or database is not ok, so reset.
 		urp.stop()
@@ -124,37 +164,136 @@ func newUnifiedRequestProtocol(db *Database) (*unifiedRequestProtocol, error) {
 	return urp, nil
 }
 
+// dial connects the address, with TLS if configured.
+func dial(ctx context.Context, c *Configuration, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: c.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil || c.TLSConfig == nil {
+		return conn, err
+	}
+	tc := c.TLSConfig.Clone()
+	if tc.ServerName == "" {
+		tc.ServerName, _, _ = net.SplitHostPort(address)
+	}
+	tlsConn := tls.Client(conn, tc)
+	tlsConn.SetDeadline(time.Now().Add(c.Timeout))
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
 // command performs a Redis command.
 func (urp *unifiedRequestProtocol) command(rs *ResultSet, multi bool, command string, args ...interface{}) {
+	urp.commandContext(context.Background(), rs, multi, command, args...)
+}
+
+// commandContext performs a Redis command until the context is done.
+// In that case the result set contains a timeout error. If the command
+// has already been sent the backend stops waiting for the reply and
+// marks the protocol as broken, so that it won't be reused.
+func (urp *unifiedRequestProtocol) commandContext(ctx context.Context, rs *ResultSet, multi bool, command string, args ...interface{}) {
+	start := time.Now()
+	if ctx.Err() != nil {
+		rs.err = &TimeoutError{0}
+		return
+	}
 	m := monitoring.BeginMeasuring(identifier.Identifier("redis", "command", command))
+	defer m.EndMeasuring()
+	doneChan := make(chan bool)
+	select {
+	case urp.commandChan <- &envCommand{rs, multi, command, args, ctx.Done(), doneChan}:
+	case <-ctx.Done():
+		rs.err = &TimeoutError{time.Now().Sub(start)}
+		return
+	case <-urp.stopChan:
+		rs.err = &ConnectionError{errors.New("protocol has been stopped")}
+		return
+	}
+	<-doneChan
+	if ce, ok := rs.err.(*ConnectionError); ok && ce.Err == errCommandCancelled {
+		rs.err = &TimeoutError{time.Now().Sub(start)}
+	}
+}
+
+// pipeline performs multiple Redis commands by writing all
+// of them before reading the replies.
+func (urp *unifiedRequestProtocol) pipeline(ecs []*envCommand) {
+	m := monitoring.BeginMeasuring(identifier.Identifier("redis", "pipeline"))
 	doneChan := make(chan bool)
-	urp.commandChan <- &envCommand{rs, multi, command, args, doneChan}
+	urp.pipelineChan <- &envPipeline{ecs, doneChan}
 	<-doneChan
 	m.EndMeasuring()
 }
 
-// subscribe subscribes to one or more channels.
-func (urp *unifiedRequestProtocol) subscribe(channels ...string) int {
-	countChan := make(chan int)
-	urp.subscriptionChan <- &envSubscription{true, channels, countChan}
-	return <-countChan
+// subscribe subscribes to one or more channels or patterns. It
+// returns the number of subscribed channels and patterns, and false
+// if the protocol has been stopped.
+func (urp *unifiedRequestProtocol) subscribe(pattern bool, channels ...string) (int, bool) {
+	return urp.subscription(&envSubscription{true, pattern, channels, make(chan int)})
 }
 
-// unsubscribe unsubscribes from one or more channels.
-func (urp *unifiedRequestProtocol) unsubscribe(channels ...string) int {
-	countChan := make(chan int)
-	urp.subscriptionChan <- &envSubscription{false, channels, countChan}
-	return <-countChan
+// unsubscribe unsubscribes from one or more channels or patterns.
+// It returns like subscribe().
+func (urp *unifiedRequestProtocol) unsubscribe(pattern bool, channels ...string) (int, bool) {
+	return urp.subscription(&envSubscription{false, pattern, channels, make(chan int)})
 }
 
-// stop tells the protocol to end its work.
+// subscription passes the subscription to the backend unless the
+// protocol has been stopped.
+func (urp *unifiedRequestProtocol) subscription(es *envSubscription) (int, bool) {
+	select {
+	case urp.subscriptionChan <- es:
+	case <-urp.stopChan:
+		return 0, false
+	}
+	return <-es.countChan, true
+}
+
+// stop tells the protocol to end its work. It can
+// be called multiple times.
 func (urp *unifiedRequestProtocol) stop() {
-	urp.stopChan <- true
+	urp.stopOnce.Do(func() {
+		close(urp.stopChan)
+	})
+}
+
+// isBroken checks if the connection of the protocol has
+// been lost or an error made it unusable.
+func (urp *unifiedRequestProtocol) isBroken() bool {
+	if urp.err != nil {
+		return true
+	}
+	select {
+	case <-urp.brokenChan:
+		return true
+	default:
+	}
+	return false
+}
+
+// isHealthy checks if the protocol can be reused. If configured
+// idle connections are checked with a ping.
+func (urp *unifiedRequestProtocol) isHealthy() bool {
+	if urp.isBroken() {
+		return false
+	}
+	interval := urp.database.configuration.PingInterval
+	if interval > 0 && time.Now().Sub(urp.lastUsed) > interval {
+		rs := newResultSet("ping")
+		urp.command(rs, false, "ping")
+		return rs.IsOK()
+	}
+	return true
 }
 
 // receiver is the goroutine for the receiving of the results in the background.
 func (urp *unifiedRequestProtocol) receiver() {
 	var ed *envData
+	// Signal a broken connection when leaving.
+	defer close(urp.brokenChan)
 	for {
 		b, err := urp.reader.ReadBytes('\n')
 		if err != nil {
@@ -169,7 +308,7 @@ func (urp *unifiedRequestProtocol) receiver() {
 			ed = &envData{len(r), r, nil}
 		case '-':
 			// Error reply.
-			ed = &envData{0, nil, errors.New("redis: " + string(b[5:len(b)-2]))}
+			ed = &envData{0, nil, errors.New("redis: " + strings.TrimPrefix(string(b[1:len(b)-2]), "ERR "))}
 		case ':':
 			// Integer reply.
 			r := b[1 : len(b)-2]
@@ -179,7 +318,7 @@ func (urp *unifiedRequestProtocol) receiver() {
 			i, _ := strconv.Atoi(string(b[1 : len(b)-2]))
 			if i == -1 {
 				// Key not found.
-				ed = &envData{0, nil, errors.New("redis: key not found")}
+				ed = &envData{0, nil, errKeyNotFound}
 			} else {
 				// Reading the data.
 				ir := i + 2
@@ -203,7 +342,7 @@ func (urp *unifiedRequestProtocol) receiver() {
 			ed = &envData{i, nil, nil}
 		default:
 			// Oops!
-			ed = &envData{0, nil, errors.New("redis: invalid received data type")}
+			ed = &envData{0, nil, &InvalidReplyError{0, b, errors.New("invalid received data type")}}
 		}
 		// Send result.
 		urp.dataChan <- ed
@@ -223,6 +362,9 @@ func (urp *unifiedRequestProtocol) backend() {
 		case ec := <-urp.commandChan:
 			// Received a command.
 			urp.handleCommand(ec)
+		case ep := <-urp.pipelineChan:
+			// Received pipelined commands.
+			urp.handlePipeline(ep)
 		case es := <-urp.subscriptionChan:
 			// Received a subscription.
 			urp.handleSubscription(es)
@@ -237,8 +379,13 @@ func (urp *unifiedRequestProtocol) backend() {
 	}
 }
 
-// handleCommand executes a command and returns the reply.
+// handleCommand executes a command and returns the reply. Waiting
+// for the reply ends if the command is cancelled.
 func (urp *unifiedRequestProtocol) handleCommand(ec *envCommand) {
+	urp.cancelChan = ec.cancelChan
+	defer func() {
+		urp.cancelChan = nil
+	}()
 	if err := urp.writeRequest(ec.command, ec.args); err == nil {
 		// Receive and return reply.
 		urp.receiveReply(ec.rs, ec.multi)
@@ -250,6 +397,31 @@ func (urp *unifiedRequestProtocol) handleCommand(ec *envCommand) {
 	ec.doneChan <- true
 }
 
+// handlePipeline writes all commands of a pipeline and then
+// reads their replies in the same order.
+func (urp *unifiedRequestProtocol) handlePipeline(ep *envPipeline) {
+	// Write all requests before flushing them at once.
+	var err error
+	for _, ec := range ep.commands {
+		if err = urp.bufferRequest(ec.command, ec.args); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = urp.flush()
+	}
+	// Receive the replies or return the error.
+	for _, ec := range ep.commands {
+		if err == nil {
+			urp.receiveReply(ec.rs, ec.multi)
+		} else {
+			ec.rs.err = err
+		}
+		urp.logCommand(ec)
+	}
+	ep.doneChan <- true
+}
+
 // logCommand logs a command and its execution status.
 func (urp *unifiedRequestProtocol) logCommand(ec *envCommand) {
 	// Format the command for the log entry.
@@ -283,10 +455,13 @@ func (urp *unifiedRequestProtocol) handleSubscription(es *envSubscription) {
 	} else {
 		command = "unsubscribe"
 	}
-	cis, pattern := urp.prepareChannels(es.channels)
-	if pattern {
+	if es.pattern {
 		command = "p" + command
 	}
+	cis := make([]interface{}, len(es.channels))
+	for i, channel := range es.channels {
+		cis[i] = channel
+	}
 	// Send the subscription request.
 	rs := newResultSet(command)
 	if err := urp.writeRequest(command, cis); err != nil {
@@ -315,32 +490,51 @@ func (urp *unifiedRequestProtocol) handlePublishing(ed *envData) {
 	switch {
 	case ed.err != nil:
 		// Error.
-		urp.publishedDataChan <- &envPublishedData{nil, ed.err}
+		urp.publish(&envPublishedData{nil, ed.err})
 	case ed.length > 0:
 		// Multiple results as part of the one reply.
 		values := make([][]byte, ed.length)
 		for i := 0; i < ed.length; i++ {
-			ed := <-urp.dataChan
+			ed := urp.receiveData()
 			if ed.err != nil {
-				urp.publishedDataChan <- &envPublishedData{nil, ed.err}
+				urp.publish(&envPublishedData{nil, ed.err})
+				return
 			}
 			values[i] = ed.data
 		}
-		urp.publishedDataChan <- &envPublishedData{values, nil}
+		urp.publish(&envPublishedData{values, nil})
 	case ed.length == 0:
 		// No result.
-		urp.publishedDataChan <- &envPublishedData{[][]byte{}, nil}
+		urp.publish(&envPublishedData{[][]byte{}, nil})
 	case ed.length == -1:
 		// Timeout.
-		urp.publishedDataChan <- &envPublishedData{nil, &TimeoutError{time.Now().Sub(start)}}
+		urp.publish(&envPublishedData{nil, &TimeoutError{time.Now().Sub(start)}})
 	default:
 		// Invalid reply.
-		urp.publishedDataChan <- &envPublishedData{nil, &InvalidReplyError{ed.length, ed.data, ed.err}}
+		urp.publish(&envPublishedData{nil, &InvalidReplyError{ed.length, ed.data, ed.err}})
 	}
 }
 
-// writeRequest send the request to the server.
+// publish passes published data to the subscription unless
+// the protocol is stopped.
+func (urp *unifiedRequestProtocol) publish(epd *envPublishedData) {
+	select {
+	case urp.publishedDataChan <- epd:
+	case <-urp.stopChan:
+	}
+}
+
+// writeRequest sends the request to the server.
 func (urp *unifiedRequestProtocol) writeRequest(cmd string, args []interface{}) error {
+	if err := urp.bufferRequest(cmd, args); err != nil {
+		return err
+	}
+	return urp.flush()
+}
+
+// bufferRequest writes the request into the buffer without
+// flushing it.
+func (urp *unifiedRequestProtocol) bufferRequest(cmd string, args []interface{}) error {
 	// Calculate number of data.
 	dataNum := 1
 	for _, arg := range args {
@@ -373,9 +567,6 @@ func (urp *unifiedRequestProtocol) writeDataNumber(dataLen int) (err error) {
 	if err = urp.write([]byte(fmt.Sprintf("*%d\r\n", dataLen))); err != nil {
 		return
 	}
-	if err = urp.flush(); err != nil {
-		return
-	}
 	return nil
 }
 
@@ -392,9 +583,6 @@ func (urp *unifiedRequestProtocol) writeData(data []byte) (err error) {
 	if err = urp.write([]byte{'\r', '\n'}); err != nil {
 		return
 	}
-	if err = urp.flush(); err != nil {
-		return
-	}
 	return nil
 }
 
@@ -456,10 +644,20 @@ func (urp *unifiedRequestProtocol) flush() error {
 	return nil
 }
 
-// receiveReply gets the reply from the server.
+// receiveReply gets the reply from the server. Only connection and
+// protocol errors make the protocol unusable, error replies of the
+// server like WRONGTYPE don't.
 func (urp *unifiedRequestProtocol) receiveReply(rs *ResultSet, multi bool) {
+	urp.processReply(rs, urp.receiveData(), multi)
+	if IsConnectionError(rs.err) || IsInvalidReplyError(rs.err) {
+		urp.err = rs.err
+	}
+}
+
+// processReply processes the initial data of a reply and
+// receives the following data if needed.
+func (urp *unifiedRequestProtocol) processReply(rs *ResultSet, ed *envData, multi bool) {
 	start := time.Now()
-	ed := <-urp.dataChan
 	switch {
 	case ed.err != nil:
 		rs.err = ed.err
@@ -475,16 +673,7 @@ func (urp *unifiedRequestProtocol) receiveReply(rs *ResultSet, multi bool) {
 				urp.receiveReply(rs.resultSets[i], false)
 			}
 		} else {
-			rs.values = make([]Value, ed.length)
-			for i := 0; i < ed.length; i++ {
-				ied := <-urp.dataChan
-				if ied.err != nil {
-					rs.values = nil
-					rs.err = ied.err
-					return
-				}
-				rs.values[i] = Value(ied.data)
-			}
+			urp.receiveValues(rs, ed.length)
 		}
 	case ed.length == 0:
 		// No result.
@@ -497,22 +686,80 @@ func (urp *unifiedRequestProtocol) receiveReply(rs *ResultSet, multi bool) {
 		// Invalid reply.
 		rs.err = &InvalidReplyError{ed.length, ed.data, ed.err}
 	}
-	urp.err = rs.err
 }
 
-// prepareChannels converts the channels from strings to interfaces which is
-// needed for proper writing. It also checks if one of the channels contains a
-// pattern.
-func (urp *unifiedRequestProtocol) prepareChannels(channels []string) ([]interface{}, bool) {
-	pattern := false
-	cis := make([]interface{}, len(channels))
-	for idx, channel := range channels {
-		cis[idx] = channel
-		if strings.IndexAny(channel, "*?[") != -1 {
-			pattern = true
+// receiveValues receives the values of a multi-bulk reply. Nested
+// multi-bulk replies lead to one result set per value, missing
+// values are nil. All values are read even in case of an error
+// to stay in sync with the server.
+func (urp *unifiedRequestProtocol) receiveValues(rs *ResultSet, length int) {
+	var nested []*ResultSet
+	rs.values = make([]Value, length)
+	for i := 0; i < length; i++ {
+		ied := urp.receiveData()
+		switch {
+		case ied.err == errKeyNotFound:
+			// Missing value.
+		case IsConnectionError(ied.err):
+			rs.values = nil
+			rs.err = ied.err
+			return
+		case ied.err != nil:
+			if rs.err == nil {
+				rs.err = ied.err
+			}
+		case ied.data == nil:
+			// Nested multi-bulk reply.
+			if nested == nil {
+				nested = make([]*ResultSet, length)
+			}
+			nested[i] = newResultSet(rs.cmd)
+			urp.processReply(nested[i], ied, false)
+			if IsConnectionError(nested[i].err) {
+				rs.values = nil
+				rs.err = nested[i].err
+				return
+			}
+		default:
+			rs.values[i] = Value(ied.data)
+		}
+	}
+	if rs.err != nil {
+		rs.values = nil
+		return
+	}
+	if nested != nil {
+		// Wrap the simple values into result sets too.
+		for i, nrs := range nested {
+			if nrs == nil {
+				nrs = newResultSet(rs.cmd)
+				nrs.values = []Value{rs.values[i]}
+				nrs.err = nil
+				nested[i] = nrs
+			}
+		}
+		rs.resultSets = nested
+	}
+}
+
+// receiveData returns the next data read by the receiver. If the
+// receiver has already ended or the current command is cancelled a
+// connection error is returned, the protocol is out of sync then.
+func (urp *unifiedRequestProtocol) receiveData() *envData {
+	select {
+	case ed := <-urp.dataChan:
+		return ed
+	case <-urp.cancelChan:
+		return &envData{0, nil, &ConnectionError{errCommandCancelled}}
+	case <-urp.brokenChan:
+		// Data may still be buffered.
+		select {
+		case ed := <-urp.dataChan:
+			return ed
+		default:
 		}
 	}
-	return cis, pattern
+	return &envData{0, nil, &ConnectionError{errors.New("connection closed")}}
 }
 
 // EOF
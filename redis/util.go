@@ -156,6 +156,29 @@ func IsDatabaseClosedError(err error) bool {
 	return ok
 }
 
+// LockNotHeldError is returned when a mutex is unlocked or
+// extended without holding the lock.
+type LockNotHeldError struct {
+	Key string
+}
+
+// Error returns the error in a readable form.
+func (e *LockNotHeldError) Error() string {
+	return fmt.Sprintf("redis: lock %q is not held", e.Key)
+}
+
+// IsLockNotHeldError check if the passed error is a lock not held error.
+func IsLockNotHeldError(err error) bool {
+	_, ok := err.(*LockNotHeldError)
+	return ok
+}
+
+// IsKeyNotFoundError checks if the passed error signals a nil
+// reply, e.g. of a 'get' for a missing key.
+func IsKeyNotFoundError(err error) bool {
+	return err == errKeyNotFound
+}
+
 //--------------------
 // INTERFACES
 //--------------------
@@ -184,6 +207,59 @@ func Pack(v interface{}) []byte {
 // USEFUL HELPERS
 //--------------------
 
+// readOnlyCommands contains the commands which can be
+// sent to replicas.
+var readOnlyCommands = map[string]bool{
+	"bitcount":         true,
+	"dbsize":           true,
+	"exists":           true,
+	"get":              true,
+	"getbit":           true,
+	"getrange":         true,
+	"hexists":          true,
+	"hget":             true,
+	"hgetall":          true,
+	"hkeys":            true,
+	"hlen":             true,
+	"hmget":            true,
+	"hscan":            true,
+	"hvals":            true,
+	"keys":             true,
+	"lindex":           true,
+	"llen":             true,
+	"lrange":           true,
+	"mget":             true,
+	"pttl":             true,
+	"randomkey":        true,
+	"scan":             true,
+	"scard":            true,
+	"sdiff":            true,
+	"sinter":           true,
+	"sismember":        true,
+	"smembers":         true,
+	"srandmember":      true,
+	"sscan":            true,
+	"strlen":           true,
+	"sunion":           true,
+	"ttl":              true,
+	"type":             true,
+	"zcard":            true,
+	"zcount":           true,
+	"zrange":           true,
+	"zrangebyscore":    true,
+	"zrank":            true,
+	"zrevrange":        true,
+	"zrevrangebyscore": true,
+	"zrevrank":         true,
+	"zscan":            true,
+	"zscore":           true,
+}
+
+// isReadOnlyCommand checks if a command only reads data.
+func isReadOnlyCommand(cmd string) bool {
+	return readOnlyCommands[strings.ToLower(cmd)]
+}
+
 // valueToBytes converts a value into a byte slice.
 func valueToBytes(v interface{}) []byte {
 	var bs []byte
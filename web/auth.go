@@ -0,0 +1,404 @@
+// Tideland Common Go Library - Web - Authentication
+//
+// Copyright (C) 2009-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package web
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//--------------------
+// PRINCIPAL
+//--------------------
+
+// Principal is the authenticated identity of a request.
+type Principal struct {
+	Name  string
+	Roles []string
+}
+
+// HasRole checks if the principal has the role.
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+//--------------------
+// AUTHENTICATOR
+//--------------------
+
+// Authenticator authenticates requests. Authenticate returns nil
+// without an error if the request contains no credentials for the
+// authenticator, an HTTPError with status unauthorized if they are
+// invalid. Challenge returns the value for the WWW-Authenticate header.
+type Authenticator interface {
+	Authenticate(ctx *Context) (*Principal, error)
+	Challenge() string
+}
+
+// Authenticate returns a middleware authenticating each request with
+// the first authenticator finding credentials. The principal is set in
+// the context, requests without valid credentials are answered with
+// status unauthorized.
+func Authenticate(authenticators ...Authenticator) Middleware {
+	return func(h HandlerFunc) HandlerFunc {
+		return func(ctx *Context) error {
+			for _, a := range authenticators {
+				p, err := a.Authenticate(ctx)
+				if err != nil {
+					if he, ok := err.(*HTTPError); ok && he.Status == http.StatusUnauthorized {
+						challenge(ctx, authenticators)
+					}
+					return err
+				}
+				if p != nil {
+					ctx.Principal = p
+					return h(ctx)
+				}
+			}
+			challenge(ctx, authenticators)
+			return NewHTTPError(http.StatusUnauthorized, "authentication required")
+		}
+	}
+}
+
+// RequireRoles returns a middleware checking if the principal of an
+// authenticated request has one of the roles. Otherwise the request
+// is answered with status forbidden, or unauthorized if there's no
+// principal.
+func RequireRoles(roles ...string) Middleware {
+	return func(h HandlerFunc) HandlerFunc {
+		return func(ctx *Context) error {
+			if ctx.Principal == nil {
+				return NewHTTPError(http.StatusUnauthorized, "authentication required")
+			}
+			for _, role := range roles {
+				if ctx.Principal.HasRole(role) {
+					return h(ctx)
+				}
+			}
+			return NewHTTPError(http.StatusForbidden, "principal '%s' has no required role", ctx.Principal.Name)
+		}
+	}
+}
+
+// challenge sets the WWW-Authenticate headers of the authenticators.
+func challenge(ctx *Context, authenticators []Authenticator) {
+	h := ctx.ResponseWriter.Header()
+	h.Del("WWW-Authenticate")
+	for _, a := range authenticators {
+		h.Add("WWW-Authenticate", a.Challenge())
+	}
+}
+
+// invalidCredentials returns the error for invalid credentials. Errors
+// of the validation functions are internal server errors.
+func invalidCredentials(err error) error {
+	if err != nil {
+		return &HTTPError{Status: http.StatusInternalServerError, Err: err}
+	}
+	return NewHTTPError(http.StatusUnauthorized, "invalid credentials")
+}
+
+//--------------------
+// BASIC AUTHENTICATION
+//--------------------
+
+// basicAuthenticator implements the HTTP basic authentication.
+type basicAuthenticator struct {
+	realm    string
+	validate func(username, password string) (*Principal, error)
+}
+
+// NewBasicAuthenticator creates an authenticator for the HTTP basic
+// authentication. The validation function returns the principal for
+// valid credentials, otherwise nil.
+func NewBasicAuthenticator(realm string, validate func(username, password string) (*Principal, error)) Authenticator {
+	return &basicAuthenticator{realm, validate}
+}
+
+// Authenticate implements the Authenticator interface.
+func (a *basicAuthenticator) Authenticate(ctx *Context) (*Principal, error) {
+	username, password, ok := ctx.Request.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	p, err := a.validate(username, password)
+	if p == nil || err != nil {
+		return nil, invalidCredentials(err)
+	}
+	return p, nil
+}
+
+// Challenge implements the Authenticator interface.
+func (a *basicAuthenticator) Challenge() string {
+	return fmt.Sprintf("Basic realm=%q", a.realm)
+}
+
+//--------------------
+// BEARER TOKEN AUTHENTICATION
+//--------------------
+
+// bearerAuthenticator implements the authentication with bearer tokens.
+type bearerAuthenticator struct {
+	realm    string
+	validate func(token string) (*Principal, error)
+}
+
+// NewBearerAuthenticator creates an authenticator for bearer tokens.
+// The validation function returns the principal for a valid token,
+// otherwise nil.
+func NewBearerAuthenticator(realm string, validate func(token string) (*Principal, error)) Authenticator {
+	return &bearerAuthenticator{realm, validate}
+}
+
+// Authenticate implements the Authenticator interface.
+func (a *bearerAuthenticator) Authenticate(ctx *Context) (*Principal, error) {
+	scheme, token := authorization(ctx)
+	if scheme != "bearer" {
+		return nil, nil
+	}
+	p, err := a.validate(token)
+	if p == nil || err != nil {
+		return nil, invalidCredentials(err)
+	}
+	return p, nil
+}
+
+// Challenge implements the Authenticator interface.
+func (a *bearerAuthenticator) Challenge() string {
+	return fmt.Sprintf("Bearer realm=%q", a.realm)
+}
+
+//--------------------
+// HMAC AUTHENTICATION
+//--------------------
+
+// HMAC_SCHEME is the authorization scheme of signed requests.
+const HMAC_SCHEME = "HMAC-SHA256"
+
+// HMACConfiguration configures the authentication of signed requests.
+// Keys returns the secret key for a key id, or nil if it's unknown. The
+// key id is the name of the principal. Requests are only accepted if
+// their timestamp is within the Window around the current time, it
+// defaults to five minutes. Bodies larger than MaxBodySize, by default
+// one megabyte, are rejected.
+type HMACConfiguration struct {
+	Keys        func(keyId string) ([]byte, error)
+	Window      time.Duration
+	MaxBodySize int64
+}
+
+// hmacAuthenticator implements the authentication of signed requests.
+type hmacAuthenticator struct {
+	mutex         sync.Mutex
+	configuration HMACConfiguration
+	nonces        map[string]time.Time
+	lastSweep     time.Time
+}
+
+// NewHMACAuthenticator creates an authenticator for requests signed
+// with SignRequest(). The nonce of a request must not have been used
+// within the window, so signed requests can't be replayed.
+func NewHMACAuthenticator(c HMACConfiguration) Authenticator {
+	if c.Window <= 0 {
+		c.Window = 5 * time.Minute
+	}
+	if c.MaxBodySize <= 0 {
+		c.MaxBodySize = 1 << 20
+	}
+	return &hmacAuthenticator{
+		configuration: c,
+		nonces:        make(map[string]time.Time),
+		lastSweep:     time.Now(),
+	}
+}
+
+// Authenticate implements the Authenticator interface.
+func (a *hmacAuthenticator) Authenticate(ctx *Context) (*Principal, error) {
+	scheme, params := authorization(ctx)
+	if scheme != strings.ToLower(HMAC_SCHEME) {
+		return nil, nil
+	}
+	values := parseAuthParams(params)
+	keyId, ts, nonce, sig := values["key"], values["ts"], values["nonce"], values["sig"]
+	if keyId == "" || ts == "" || nonce == "" || sig == "" {
+		return nil, NewHTTPError(http.StatusUnauthorized, "incomplete signature")
+	}
+	// Check the timestamp first, it's cheap.
+	seconds, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, NewHTTPError(http.StatusUnauthorized, "invalid timestamp")
+	}
+	now := time.Now()
+	window := a.configuration.Window
+	if diff := now.Sub(time.Unix(seconds, 0)); diff > window || diff < -window {
+		return nil, NewHTTPError(http.StatusUnauthorized, "timestamp outside of window")
+	}
+	// Check key and nonce before the body is read.
+	key, err := a.configuration.Keys(keyId)
+	if key == nil || err != nil {
+		return nil, invalidCredentials(err)
+	}
+	nonceKey := keyId + ":" + nonce
+	if a.knowsNonce(nonceKey) {
+		return nil, NewHTTPError(http.StatusUnauthorized, "request has been replayed")
+	}
+	// Now verify the signature.
+	r := ctx.Request
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(ctx.ResponseWriter, r.Body, a.configuration.MaxBodySize)
+	}
+	expected, err := signature(r, key, ts, nonce)
+	if err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			return nil, NewHTTPError(http.StatusRequestEntityTooLarge, "body is larger than %d bytes", mbe.Limit)
+		}
+		return nil, &HTTPError{Status: http.StatusBadRequest, Detail: "cannot read body", Err: err}
+	}
+	if !hmac.Equal([]byte(expected), []byte(sig)) {
+		return nil, invalidCredentials(nil)
+	}
+	// Finally register the nonce, it may have been used meanwhile.
+	if !a.registerNonce(nonceKey, now) {
+		return nil, NewHTTPError(http.StatusUnauthorized, "request has been replayed")
+	}
+	return &Principal{Name: keyId}, nil
+}
+
+// Challenge implements the Authenticator interface.
+func (a *hmacAuthenticator) Challenge() string {
+	return HMAC_SCHEME
+}
+
+// knowsNonce checks if the nonce is already registered.
+func (a *hmacAuthenticator) knowsNonce(nonce string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	_, ok := a.nonces[nonce]
+	return ok
+}
+
+// registerNonce registers a nonce. It returns false if the
+// nonce is already registered. Nonces are kept twice the
+// window, after that the timestamp check rejects the request.
+// They are removed once per window.
+func (a *hmacAuthenticator) registerNonce(nonce string, now time.Time) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, ok := a.nonces[nonce]; ok {
+		return false
+	}
+	a.nonces[nonce] = now
+	if now.Sub(a.lastSweep) > a.configuration.Window {
+		a.sweep(now)
+	}
+	return true
+}
+
+// sweep removes the nonces which are older than twice the window.
+func (a *hmacAuthenticator) sweep(now time.Time) {
+	for n, t := range a.nonces {
+		if now.Sub(t) > 2*a.configuration.Window {
+			delete(a.nonces, n)
+		}
+	}
+	a.lastSweep = now
+}
+
+// SignRequest signs a request for the HMAC authentication. The
+// signature covers method, URI, body, a timestamp and a random
+// nonce, so the body has to be set before.
+func SignRequest(r *http.Request, keyId string, key []byte) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := hex.EncodeToString(b)
+	sig, err := signature(r, key, ts, nonce)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Authorization", fmt.Sprintf("%s key=%q, ts=%q, nonce=%q, sig=%q", HMAC_SCHEME, keyId, ts, nonce, sig))
+	return nil
+}
+
+// signature returns the signature of the request. The body is
+// read and replaced, so that it can be read again.
+func signature(r *http.Request, key []byte, ts, nonce string) (string, error) {
+	var body []byte
+	if r.Body != nil {
+		b, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		body = b
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%x", r.Method, r.URL.RequestURI(), ts, nonce, bodyHash)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// authorization returns the lower-case scheme and the
+// parameters of the authorization header.
+func authorization(ctx *Context) (string, string) {
+	parts := strings.SplitN(strings.TrimSpace(ctx.Request.Header.Get("Authorization")), " ", 2)
+	if len(parts) != 2 {
+		return strings.ToLower(parts[0]), ""
+	}
+	return strings.ToLower(parts[0]), strings.TrimSpace(parts[1])
+}
+
+// parseAuthParams parses comma separated parameters like
+// 'key="value"' of an authorization header.
+func parseAuthParams(params string) map[string]string {
+	values := make(map[string]string)
+	for _, param := range strings.Split(params, ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := kv[1]
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		values[strings.TrimSpace(kv[0])] = value
+	}
+	return values
+}
+
+// EOF
@@ -0,0 +1,418 @@
+// Tideland Common Go Library - Web - Binding
+//
+// Copyright (C) 2009-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package web
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+//--------------------
+// BINDING
+//--------------------
+
+// maxMemory is the size of multipart forms kept in memory.
+const maxMemory = 32 << 20
+
+// Bind fills the struct pointed to by v from the request and validates
+// it. The body is decoded depending on its content type as JSON, XML or
+// GOB. Form posts, query parameters and path parts are assigned to the
+// fields tagged with "form", "query" or "path" and the name of the value.
+// Path names are the parameters of a route or "domain", "resource" and
+// "resourceid". The values of later sources replace earlier ones in the
+// order body, form, query and path.
+//
+// Afterwards the fields are validated by their "validate" tags, like
+// `validate:"required,min=1,max=10"`. Required fields must not have
+// their zero value, other fields with the zero value aren't validated.
+// The values of numbers have to be within min and max, for strings,
+// slices and maps it's the length, len demands an exact length. A
+// pattern like "pattern=^[a-z]+$" has to be the last option, strings
+// must match it.
+//
+// All invalid fields are returned at once in an HTTPError with status
+// unprocessable entity, a body which can't be decoded leads to a bad
+// request.
+func (ctx *Context) Bind(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("web: cannot bind to %T, need pointer to struct", v)
+	}
+	if err := ctx.bindBody(v); err != nil {
+		return err
+	}
+	b := &binder{ctx: ctx, rv: rv.Elem()}
+	if ctx.Request.PostForm != nil {
+		b.bindValues("form", func(name string) []string {
+			return ctx.Request.PostForm[name]
+		})
+	}
+	query := ctx.Request.URL.Query()
+	b.bindValues("query", func(name string) []string {
+		return query[name]
+	})
+	b.bindValues("path", func(name string) []string {
+		if value := ctx.pathValue(name); value != "" {
+			return []string{value}
+		}
+		return nil
+	})
+	if err := b.validate(); err != nil {
+		return err
+	}
+	if len(b.invalid) > 0 {
+		return &HTTPError{
+			Status:        http.StatusUnprocessableEntity,
+			Detail:        "invalid parameters",
+			InvalidParams: b.invalid,
+		}
+	}
+	return nil
+}
+
+// bindBody decodes the request body into v.
+func (ctx *Context) bindBody(v interface{}) error {
+	r := ctx.Request
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return nil
+	}
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var err error
+	switch contentType {
+	case CT_JSON:
+		err = json.NewDecoder(r.Body).Decode(v)
+	case CT_XML:
+		err = xml.NewDecoder(r.Body).Decode(v)
+	case CT_GOB:
+		err = gob.NewDecoder(r.Body).Decode(v)
+	case CT_FORM:
+		err = r.ParseForm()
+	case CT_MULTIPART:
+		err = r.ParseMultipartForm(maxMemory)
+	default:
+		return NewHTTPError(http.StatusUnsupportedMediaType, "content type '%s' is not supported", contentType)
+	}
+	if err != nil && err != io.EOF {
+		return &HTTPError{Status: http.StatusBadRequest, Detail: "invalid " + contentType + " body", Err: err}
+	}
+	return nil
+}
+
+// pathValue returns the value of a route parameter or a path part.
+func (ctx *Context) pathValue(name string) string {
+	if value, ok := ctx.Parameters[name]; ok {
+		return value
+	}
+	switch strings.ToLower(name) {
+	case "domain":
+		return ctx.Domain
+	case "resource":
+		return ctx.Resource
+	case "resourceid":
+		return ctx.ResourceId
+	}
+	return ""
+}
+
+//--------------------
+// BINDER
+//--------------------
+
+// binder assigns the values to the struct fields and
+// collects the invalid ones.
+type binder struct {
+	ctx     *Context
+	rv      reflect.Value
+	invalid []InvalidParam
+}
+
+// bindValues assigns the values returned by lookup for
+// the names of the tag.
+func (b *binder) bindValues(tag string, lookup func(name string) []string) {
+	rt := b.rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		name := field.Tag.Get(tag)
+		if name == "" || name == "-" || field.PkgPath != "" {
+			continue
+		}
+		values := lookup(name)
+		if len(values) == 0 {
+			continue
+		}
+		if err := setValue(b.rv.Field(i), values); err != nil {
+			b.addInvalid(field, err.Error())
+		}
+	}
+}
+
+// validate validates the fields by their tags.
+func (b *binder) validate() error {
+	rt := b.rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		tag := field.Tag.Get("validate")
+		if tag == "" || field.PkgPath != "" || b.isInvalid(field) {
+			continue
+		}
+		rules, err := parseRules(tag)
+		if err != nil {
+			return fmt.Errorf("web: field %s: %v", field.Name, err)
+		}
+		fv := b.rv.Field(i)
+		if fv.IsZero() {
+			if rules.required {
+				b.addInvalid(field, "is required")
+			}
+			continue
+		}
+		if reason := rules.check(fv); reason != "" {
+			b.addInvalid(field, reason)
+		}
+	}
+	return nil
+}
+
+// addInvalid adds an invalid field.
+func (b *binder) addInvalid(field reflect.StructField, reason string) {
+	b.invalid = append(b.invalid, InvalidParam{fieldName(field), reason})
+}
+
+// isInvalid checks if the field is already invalid.
+func (b *binder) isInvalid(field reflect.StructField) bool {
+	name := fieldName(field)
+	for _, ip := range b.invalid {
+		if ip.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+//--------------------
+// VALIDATION RULES
+//--------------------
+
+// rules contains the parsed validation rules of a field.
+type rules struct {
+	required bool
+	min      *float64
+	max      *float64
+	length   *int
+	pattern  *regexp.Regexp
+}
+
+// patterns caches the compiled patterns.
+var patterns = struct {
+	sync.Mutex
+	compiled map[string]*regexp.Regexp
+}{compiled: make(map[string]*regexp.Regexp)}
+
+// parseRules parses the validation tag of a field.
+func parseRules(tag string) (*rules, error) {
+	rs := &rules{}
+	for tag != "" {
+		var rule string
+		if strings.HasPrefix(tag, "pattern=") {
+			// The pattern may contain commas.
+			rule, tag = tag, ""
+		} else if i := strings.Index(tag, ","); i >= 0 {
+			rule, tag = tag[:i], tag[i+1:]
+		} else {
+			rule, tag = tag, ""
+		}
+		kv := strings.SplitN(strings.TrimSpace(rule), "=", 2)
+		switch {
+		case kv[0] == "required" && len(kv) == 1:
+			rs.required = true
+		case (kv[0] == "min" || kv[0] == "max") && len(kv) == 2:
+			f, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s rule %q", kv[0], kv[1])
+			}
+			if kv[0] == "min" {
+				rs.min = &f
+			} else {
+				rs.max = &f
+			}
+		case kv[0] == "len" && len(kv) == 2:
+			l, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid len rule %q", kv[1])
+			}
+			rs.length = &l
+		case kv[0] == "pattern" && len(kv) == 2:
+			re, err := compilePattern(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			rs.pattern = re
+		default:
+			return nil, fmt.Errorf("invalid validation rule %q", rule)
+		}
+	}
+	return rs, nil
+}
+
+// compilePattern returns the compiled pattern, it's cached.
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	patterns.Lock()
+	defer patterns.Unlock()
+	if re, ok := patterns.compiled[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	patterns.compiled[pattern] = re
+	return re, nil
+}
+
+// check checks the value and returns the reason if it's invalid.
+func (rs *rules) check(fv reflect.Value) string {
+	var size float64
+	unit := ""
+	switch fv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		size = float64(fv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		size = float64(fv.Uint())
+	case reflect.Float32, reflect.Float64:
+		size = fv.Float()
+	case reflect.String:
+		size, unit = float64(utf8.RuneCountInString(fv.String())), " characters"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		size, unit = float64(fv.Len()), " elements"
+	default:
+		if rs.min != nil || rs.max != nil || rs.length != nil {
+			return "cannot be checked"
+		}
+	}
+	if rs.length != nil && (unit == "" || int(size) != *rs.length) {
+		return fmt.Sprintf("must have %d%s", *rs.length, unit)
+	}
+	if rs.min != nil && size < *rs.min {
+		if unit != "" {
+			return fmt.Sprintf("must have at least %v%s", *rs.min, unit)
+		}
+		return fmt.Sprintf("must be at least %v", *rs.min)
+	}
+	if rs.max != nil && size > *rs.max {
+		if unit != "" {
+			return fmt.Sprintf("must have at most %v%s", *rs.max, unit)
+		}
+		return fmt.Sprintf("must be at most %v", *rs.max)
+	}
+	if rs.pattern != nil && (fv.Kind() != reflect.String || !rs.pattern.MatchString(fv.String())) {
+		return fmt.Sprintf("must match %q", rs.pattern.String())
+	}
+	return ""
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// textUnmarshalerType is the type of encoding.TextUnmarshaler.
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// setValue converts the values and sets the field. Slices
+// get all values, other fields the first one.
+func setValue(fv reflect.Value, values []string) error {
+	if fv.Kind() == reflect.Slice && !fv.Addr().Type().Implements(textUnmarshalerType) {
+		slice := reflect.MakeSlice(fv.Type(), len(values), len(values))
+		for i, value := range values {
+			if err := setSingleValue(slice.Index(i), value); err != nil {
+				return err
+			}
+		}
+		fv.Set(slice)
+		return nil
+	}
+	return setSingleValue(fv, values[0])
+}
+
+// setSingleValue converts the value and sets the field.
+func setSingleValue(fv reflect.Value, value string) error {
+	if fv.Addr().Type().Implements(textUnmarshalerType) {
+		if err := fv.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(value)); err != nil {
+			return fmt.Errorf("invalid value %q", value)
+		}
+		return nil
+	}
+	if fv.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		fv.SetInt(int64(d))
+		return nil
+	}
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, fv.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		fv.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(value, 10, fv.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid unsigned integer %q", value)
+		}
+		fv.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, fv.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		fv.SetFloat(f)
+	default:
+		return fmt.Errorf("cannot assign %q", value)
+	}
+	return nil
+}
+
+// fieldName returns the name of a field used in the request.
+func fieldName(field reflect.StructField) string {
+	for _, tag := range []string{"path", "query", "form", "json", "xml"} {
+		name := strings.Split(field.Tag.Get(tag), ",")[0]
+		if name != "" && name != "-" {
+			return name
+		}
+	}
+	return field.Name
+}
+
+// EOF
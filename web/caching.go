@@ -0,0 +1,421 @@
+// Tideland Common Go Library - Web - Caching
+//
+// Copyright (C) 2009-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package web
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//--------------------
+// CACHING MIDDLEWARE
+//--------------------
+
+// CacheConfiguration configures the caching of responses. MaxAge is
+// set as max-age of the Cache-Control header, which is private if
+// Private is true. Without MaxAge clients have to revalidate each time.
+// A TTL enables the caching of the rendered responses in memory for
+// the time, up to MaxEntries responses if that's set. Requests with an
+// Authorization header or the SessionCookie, by default "session", are
+// never answered out of the cache.
+type CacheConfiguration struct {
+	MaxAge        time.Duration
+	Private       bool
+	TTL           time.Duration
+	MaxEntries    int
+	SessionCookie string
+}
+
+// Caching returns a middleware for the caching of the responses to GET
+// and HEAD requests. Successful responses get an ETag computed out of
+// the body and a Cache-Control header if the handler doesn't set them.
+// If-None-Match and If-Modified-Since, if the handler sets Last-Modified,
+// are answered with not modified. Cached responses are found by the
+// method, the host, the path, the query, the Accept header and the headers
+// named in the Vary header of the response. PUT, POST and DELETE requests
+// remove the cached responses of their path.
+func Caching(c CacheConfiguration) Middleware {
+	if c.SessionCookie == "" {
+		c.SessionCookie = "session"
+	}
+	rc := &responseCache{
+		configuration: c,
+		responses:     make(map[string]*cachedResponse),
+		varies:        make(map[string][]string),
+	}
+	return func(h HandlerFunc) HandlerFunc {
+		return func(ctx *Context) error {
+			switch ctx.Request.Method {
+			case "GET", "HEAD":
+				return rc.handle(ctx, h)
+			case "PUT", "POST", "DELETE":
+				rc.invalidate(ctx)
+			}
+			return h(ctx)
+		}
+	}
+}
+
+// cachedResponse is a rendered response.
+type cachedResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// responseCache handles the caching of the responses. Additionally
+// to the responses it keeps the names of the headers the responses
+// vary by per resource.
+type responseCache struct {
+	mutex         sync.Mutex
+	configuration CacheConfiguration
+	responses     map[string]*cachedResponse
+	varies        map[string][]string
+}
+
+// handle answers the request out of the cache or by the handler.
+func (rc *responseCache) handle(ctx *Context, h HandlerFunc) error {
+	cacheable := rc.cacheable(ctx.Request)
+	if cacheable {
+		if cr := rc.lookup(ctx.Request); cr != nil {
+			hdr := ctx.ResponseWriter.Header()
+			for k, v := range cr.header {
+				hdr[k] = append([]string{}, v...)
+			}
+			rc.write(ctx, cr.status, cr.body)
+			return nil
+		}
+	}
+	rw := ctx.ResponseWriter
+	brw := &bufferedResponseWriter{rw: rw}
+	ctx.ResponseWriter = brw
+	err := h(ctx)
+	ctx.ResponseWriter = rw
+	if brw.passthrough {
+		return err
+	}
+	if err != nil {
+		// Let the error renderer write a fresh response.
+		return err
+	}
+	status := brw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	body := brw.body.Bytes()
+	if status == http.StatusOK {
+		hdr := rw.Header()
+		if hdr.Get("ETag") == "" {
+			sum := sha256.Sum256(body)
+			hdr.Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+		}
+		if hdr.Get("Cache-Control") == "" {
+			hdr.Set("Cache-Control", rc.cacheControl())
+		}
+		if cacheable {
+			rc.store(ctx.Request, hdr, body)
+		}
+	}
+	rc.write(ctx, status, body)
+	return nil
+}
+
+// write writes the response, or not modified if the client
+// has a current version.
+func (rc *responseCache) write(ctx *Context, status int, body []byte) {
+	hdr := ctx.ResponseWriter.Header()
+	if status == http.StatusOK && notModified(ctx.Request, hdr.Get("ETag"), hdr.Get("Last-Modified")) {
+		hdr.Del("Content-Type")
+		hdr.Del("Content-Length")
+		ctx.ResponseWriter.WriteHeader(http.StatusNotModified)
+		return
+	}
+	ctx.ResponseWriter.WriteHeader(status)
+	if ctx.Request.Method != "HEAD" {
+		ctx.ResponseWriter.Write(body)
+	}
+}
+
+// cacheable checks if the request may be answered out of the cache
+// and its response stored. Requests with credentials or a session
+// may get individual responses.
+func (rc *responseCache) cacheable(r *http.Request) bool {
+	if rc.configuration.TTL <= 0 || r.Header.Get("Authorization") != "" {
+		return false
+	}
+	_, err := r.Cookie(rc.configuration.SessionCookie)
+	return err != nil
+}
+
+// resource returns the method, the host, the path and the query of
+// the request. It's the path instead of Context.String(), so that routes
+// with more parts are distinct. The method lets HEAD have its own entries,
+// the host keeps the responses of virtual hosts apart.
+func (rc *responseCache) resource(r *http.Request) string {
+	return fmt.Sprintf("%s %s%s?%s", r.Method, strings.ToLower(r.Host), r.URL.Path, r.URL.RawQuery)
+}
+
+// key returns the cache key of the request. It's the resource with
+// the values of the Accept header and the headers the response varies by.
+func (rc *responseCache) key(r *http.Request, resource string, vary []string) string {
+	key := resource + "|" + r.Header.Get("Accept")
+	for _, name := range vary {
+		key += "|" + strings.Join(r.Header[name], ",")
+	}
+	return key
+}
+
+// varyHeaders returns the canonical names of the headers a response
+// varies by. If it varies by all it can't be cached.
+func varyHeaders(hdr http.Header) ([]string, bool) {
+	names := []string{}
+	for _, value := range hdr["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			switch name {
+			case "":
+			case "*":
+				return nil, false
+			default:
+				names = append(names, name)
+			}
+		}
+	}
+	return names, true
+}
+
+// cacheControl returns the configured Cache-Control value.
+func (rc *responseCache) cacheControl() string {
+	visibility := "public"
+	if rc.configuration.Private {
+		visibility = "private"
+	}
+	if rc.configuration.MaxAge <= 0 {
+		return visibility + ", no-cache"
+	}
+	return fmt.Sprintf("%s, max-age=%d", visibility, rc.configuration.MaxAge/time.Second)
+}
+
+// lookup returns a cached response if it's not expired.
+func (rc *responseCache) lookup(r *http.Request) *cachedResponse {
+	resource := rc.resource(r)
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	vary, ok := rc.varies[resource]
+	if !ok {
+		return nil
+	}
+	key := rc.key(r, resource, vary)
+	cr, ok := rc.responses[key]
+	if !ok {
+		return nil
+	}
+	if cr.expires.Before(time.Now()) {
+		delete(rc.responses, key)
+		return nil
+	}
+	return cr
+}
+
+// store caches a response. Responses setting cookies, varying
+// by all headers or forbidding to store them aren't cached.
+func (rc *responseCache) store(r *http.Request, hdr http.Header, body []byte) {
+	if hdr.Get("Set-Cookie") != "" {
+		return
+	}
+	cacheControl := hdr.Get("Cache-Control")
+	if strings.Contains(cacheControl, "no-store") || strings.Contains(cacheControl, "private") {
+		return
+	}
+	vary, ok := varyHeaders(hdr)
+	if !ok {
+		return
+	}
+	resource := rc.resource(r)
+	key := rc.key(r, resource, vary)
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	now := time.Now()
+	if limit := rc.configuration.MaxEntries; limit > 0 && len(rc.responses) >= limit {
+		for k, cr := range rc.responses {
+			if cr.expires.Before(now) {
+				delete(rc.responses, k)
+			}
+		}
+		if len(rc.responses) >= limit {
+			return
+		}
+	}
+	header := make(http.Header)
+	for k, v := range hdr {
+		header[k] = append([]string{}, v...)
+	}
+	rc.varies[resource] = vary
+	rc.responses[key] = &cachedResponse{
+		status:  http.StatusOK,
+		header:  header,
+		body:    append([]byte{}, body...),
+		expires: now.Add(rc.configuration.TTL),
+	}
+}
+
+// invalidate removes the cached responses of the resource.
+func (rc *responseCache) invalidate(ctx *Context) {
+	location := strings.ToLower(ctx.Request.Host) + ctx.Request.URL.Path + "?"
+	prefixes := []string{"GET " + location, "HEAD " + location}
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	for _, prefix := range prefixes {
+		for key := range rc.responses {
+			if strings.HasPrefix(key, prefix) {
+				delete(rc.responses, key)
+			}
+		}
+		for resource := range rc.varies {
+			if strings.HasPrefix(resource, prefix) {
+				delete(rc.varies, resource)
+			}
+		}
+	}
+}
+
+//--------------------
+// CONDITIONAL REQUESTS
+//--------------------
+
+// NotModified sets the ETag and Last-Modified headers if passed and
+// checks if the client has a current version. In this case not modified
+// is written and true returned, so handlers can skip computing the
+// response.
+func (ctx *Context) NotModified(etag string, modified time.Time) bool {
+	hdr := ctx.ResponseWriter.Header()
+	if etag != "" {
+		if !strings.HasPrefix(etag, `"`) && !strings.HasPrefix(etag, `W/"`) {
+			etag = `"` + etag + `"`
+		}
+		hdr.Set("ETag", etag)
+	}
+	lastModified := ""
+	if !modified.IsZero() {
+		lastModified = modified.UTC().Format(http.TimeFormat)
+		hdr.Set("Last-Modified", lastModified)
+	}
+	if !notModified(ctx.Request, etag, lastModified) {
+		return false
+	}
+	ctx.ResponseWriter.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// notModified checks the conditional headers of the request. If-None-Match
+// has priority over If-Modified-Since.
+func notModified(r *http.Request, etag, lastModified string) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || lastModified == "" {
+		return false
+	}
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+	return !modified.After(since)
+}
+
+//--------------------
+// BUFFERED RESPONSE WRITER
+//--------------------
+
+// bufferedResponseWriter buffers a response. If it's flushed or
+// hijacked, e.g. for streaming, it passes everything through.
+type bufferedResponseWriter struct {
+	rw          http.ResponseWriter
+	status      int
+	body        bytes.Buffer
+	passthrough bool
+}
+
+// Header implements the http.ResponseWriter interface.
+func (brw *bufferedResponseWriter) Header() http.Header {
+	return brw.rw.Header()
+}
+
+// Write implements the http.ResponseWriter interface.
+func (brw *bufferedResponseWriter) Write(b []byte) (int, error) {
+	if brw.passthrough {
+		return brw.rw.Write(b)
+	}
+	return brw.body.Write(b)
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (brw *bufferedResponseWriter) WriteHeader(status int) {
+	if brw.passthrough {
+		brw.rw.WriteHeader(status)
+		return
+	}
+	if brw.status == 0 {
+		brw.status = status
+	}
+}
+
+// Flush implements the http.Flusher interface. It writes the
+// buffered response and passes everything through afterwards.
+func (brw *bufferedResponseWriter) Flush() {
+	if !brw.passthrough {
+		brw.passthrough = true
+		if brw.status != 0 {
+			brw.rw.WriteHeader(brw.status)
+		}
+		brw.rw.Write(brw.body.Bytes())
+		brw.body.Reset()
+	}
+	if flusher, ok := brw.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack implements the http.Hijacker interface.
+func (brw *bufferedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := brw.rw.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("web: response writer cannot be hijacked")
+	}
+	brw.passthrough = true
+	return hj.Hijack()
+}
+
+// EOF
@@ -60,17 +60,29 @@ type Context struct {
 	Domain         string
 	Resource       string
 	ResourceId     string
+	Parameters     map[string]string
+	Principal      *Principal
+	server         *Server
+	basePath       string
+	session        *Session
+	sessionManager *SessionManager
 }
 
 // Creates a new context.
-func newContext(rw http.ResponseWriter, r *http.Request) *Context {
+func newContext(s *Server, rw http.ResponseWriter, r *http.Request) *Context {
 	// Init the context.
 	ctx := &Context{
 		ResponseWriter: rw,
 		Request:        r,
+		server:         s,
+		basePath:       s.BasePath(),
 	}
-	// Split path for REST identifiers.
-	parts := strings.Split(r.URL.Path[len(srv.basePath):], "/")
+	// Split path for REST identifiers. Paths outside of
+	// the base path are rejected when serving.
+	if !ctx.insideBasePath() {
+		return ctx
+	}
+	parts := strings.Split(ctx.path(), "/")
 	switch len(parts) {
 	case 3:
 		ctx.ResourceId = parts[2]
@@ -80,17 +92,37 @@ func newContext(rw http.ResponseWriter, r *http.Request) *Context {
 		ctx.Resource = parts[1]
 		ctx.Domain = parts[0]
 	default:
-		ctx.Resource = srv.defaultResource
-		ctx.Domain = srv.defaultDomain
+		s.mutex.RLock()
+		ctx.Resource = s.defaultResource
+		ctx.Domain = s.defaultDomain
+		s.mutex.RUnlock()
 	}
 	return ctx
 }
 
+// insideBasePath checks if the path of the request is
+// inside the base path of the server.
+func (ctx *Context) insideBasePath() bool {
+	return strings.HasPrefix(ctx.Request.URL.Path, ctx.basePath)
+}
+
+// path returns the path of the request relative to the
+// base path of the server.
+func (ctx *Context) path() string {
+	return strings.TrimPrefix(ctx.Request.URL.Path, ctx.basePath)
+}
+
 // String returns domain, resource and resource id of the context.
 func (ctx *Context) String() string {
 	return fmt.Sprintf("%s /%s/%s/%s", ctx.Request.Method, ctx.Domain, ctx.Resource, ctx.ResourceId)
 }
 
+// Parameter returns the value of a parameter or wildcard of the
+// matching route. It is empty if the parameter doesn't exist.
+func (ctx *Context) Parameter(name string) string {
+	return ctx.Parameters[name]
+}
+
 // AcceptsPlain checks if the requestor accepts plain text as a content type.
 func (ctx *Context) AcceptsPlain() bool {
 	return strings.Contains(ctx.Request.Header.Get("Accept"), CT_PLAIN)
@@ -130,9 +162,14 @@ func (ctx *Context) Languages() Languages {
 	return languages
 }
 
+// ContentTypes returns the accepted content types with the quality values.
+func (ctx *Context) ContentTypes() ContentTypes {
+	return parseContentTypes(ctx.Request.Header.Get("Accept"))
+}
+
 // Redirect to a domain, resource and resource id (optional).
 func (ctx *Context) Redirect(domain, resource, resourceId string) {
-	url := srv.basePath + domain + "/" + resource
+	url := ctx.basePath + domain + "/" + resource
 	if resourceId != "" {
 		url = url + "/" + resourceId
 	}
@@ -140,9 +177,17 @@ func (ctx *Context) Redirect(domain, resource, resourceId string) {
 	ctx.ResponseWriter.WriteHeader(http.StatusMovedPermanently)
 }
 
+// Error writes the error with the error renderer and returns false,
+// so resource handlers can return the result. Errors which are no
+// HTTPError are written as internal server error without details.
+func (ctx *Context) Error(err error) bool {
+	handleError(ctx, err)
+	return false
+}
+
 // RenderTemplate renders a template with the passed data to the response writer.
 func (ctx *Context) RenderTemplate(templateId string, data interface{}) {
-	srv.templateCache.render(ctx.ResponseWriter, templateId, data)
+	ctx.server.templateCache.render(ctx.ResponseWriter, templateId, data)
 }
 
 // MarshalJSON marshals the passed data to JSON and writes it to the response writer.
@@ -12,6 +12,75 @@
 // packages. The business logic has to be implemented in components that fullfill the
 // individual handler interfaces. They work on a context with some helpers but also
 // have got access to the original Request and ResponseWriter arguments.
+//
+// A Server created with NewServer() has its own handlers, templates and
+// defaults. It implements http.Handler and can be shut down gracefully,
+// waiting for the requests in flight. The package functions like
+// StartServer() and AddResourceHandler() use a default server.
+//
+// Beside the resource handlers, which are addressed by domain, resource and
+// resource id, handler functions can be added for path patterns with
+// AddRoute(). Patterns contain parameters like "{id}" and a wildcard like
+// "*path" at the end, their values are returned by Context.Parameter().
+// Middlewares added with Use() wrap the handling of all requests.
+//
+// Handler functions return errors, resource handlers return the result of
+// Context.Error(). An HTTPError contains the status code and the detail for
+// the client, all other errors and panics are only logged and answered with
+// an internal server error. The error renderer, by default RenderError(),
+// writes problem details as JSON or XML, HTML or plain text.
+//
+// Context.Respond() writes data with the encoder of the best accepted
+// content type. JSON, XML, SML and GOB encoders are registered by default,
+// templates and own formats can be added with RegisterEncoder().
+//
+// The middleware of a SessionManager makes sessions available via
+// Context.Session(). They are identified by signed cookies and kept in
+// a SessionStore, in memory, in files or in Redis. Sessions provide
+// values, flash messages, rotation at login and destruction at logout.
+//
+// The middleware returned by Authenticate() authenticates the requests
+// before they are handled, with HTTP basic authentication, bearer tokens
+// or HMAC signed requests, and sets Context.Principal. Failures are
+// answered with unauthorized, RequireRoles() answers with forbidden if
+// the principal lacks the needed roles.
+//
+// Context.Bind() fills a struct from the JSON, XML or GOB body, form posts,
+// query parameters and path parts by the field tags and validates it by the
+// "validate" tags. All invalid fields are reported at once as invalid
+// parameters of the problem details with status unprocessable entity.
+//
+// Context.EventStream() keeps the connection open for server-sent events.
+// They are sent individually or served from a channel, a Redis subscription
+// or an SSEAgent of the event bus, which also resends the events a client
+// missed since its Last-Event-ID. Streams are closed when the client
+// disconnects or the server shuts down.
+//
+// Resource handlers implementing WebSocketResourceHandler get GET requests
+// asking for an upgrade to the WebSocket protocol as a WebSocketConn. It
+// reads and writes text and binary messages, answers pings, sends pings
+// for keep-alive and runs goroutines belonging to the connection.
+//
+// Templates are parsed with ParseTemplate() or loaded with
+// LoadAndParseTemplate(), both return parsing errors. A set defined with
+// DefineTemplateSet() consists of a layout and shared partials, the
+// templates loaded with LoadAndParseSetTemplate() define the blocks used
+// by the layout. HtmlInternalReference and own functions added with
+// AddTemplateFuncs() can be used in the templates. WatchTemplates()
+// reloads changed template files during development.
+//
+// The middleware returned by Caching() adds ETags and Cache-Control headers
+// to successful GET responses, answers conditional requests with not
+// modified and optionally keeps the rendered responses in memory for a
+// time. Handlers can use Context.NotModified() to skip computing responses
+// the client already has.
+//
+// RateLimit() limits the requests per client with token buckets, the
+// clients are identified by IP address, principal or a header like an API
+// key. ConcurrencyLimit() caps the requests handled at once per resource,
+// further ones wait in a queue for a time. Rejected requests are answered
+// with too many requests or service unavailable and a Retry-After header.
+// Both count the requests in monitoring variables.
 package web
 
 // EOF
@@ -0,0 +1,202 @@
+// Tideland Common Go Library - Web - Errors
+//
+// Copyright (C) 2009-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package web
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"cgl.tideland.biz/applog"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+)
+
+//--------------------
+// HTTP ERROR
+//--------------------
+
+// HTTPError is an error with an HTTP status code. Type, Detail and
+// the invalid parameters are part of the response, the cause Err is
+// only logged.
+type HTTPError struct {
+	Status        int
+	Type          string
+	Detail        string
+	InvalidParams []InvalidParam
+	Err           error
+}
+
+// NewHTTPError creates an error with the status code and a
+// detail message for the client.
+func NewHTTPError(status int, detail string, args ...interface{}) *HTTPError {
+	if len(args) > 0 {
+		detail = fmt.Sprintf(detail, args...)
+	}
+	return &HTTPError{
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// Error returns the error in a readable form.
+func (e *HTTPError) Error() string {
+	msg := fmt.Sprintf("web: %d %s", e.Status, http.StatusText(e.Status))
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	if e.Err != nil {
+		msg += fmt.Sprintf(" (%v)", e.Err)
+	}
+	return msg
+}
+
+// Problem returns the problem details of the error for the context.
+func (e *HTTPError) Problem(ctx *Context) *Problem {
+	return &Problem{
+		Type:          e.Type,
+		Title:         http.StatusText(e.Status),
+		Status:        e.Status,
+		Detail:        e.Detail,
+		Instance:      ctx.Request.URL.Path,
+		InvalidParams: e.InvalidParams,
+	}
+}
+
+// IsHTTPError checks if the passed error is an HTTP error.
+func IsHTTPError(err error) bool {
+	_, ok := err.(*HTTPError)
+	return ok
+}
+
+//--------------------
+// PROBLEM DETAILS
+//--------------------
+
+// Problem contains the problem details of an error
+// following RFC 7807.
+type Problem struct {
+	XMLName       xml.Name       `json:"-" xml:"urn:ietf:rfc:7807 problem"`
+	Type          string         `json:"type,omitempty" xml:"type,omitempty"`
+	Title         string         `json:"title" xml:"title"`
+	Status        int            `json:"status" xml:"status"`
+	Detail        string         `json:"detail,omitempty" xml:"detail,omitempty"`
+	Instance      string         `json:"instance,omitempty" xml:"instance,omitempty"`
+	InvalidParams []InvalidParam `json:"invalid-params,omitempty" xml:"invalid-params>i,omitempty"`
+}
+
+// InvalidParam describes why the value of a parameter
+// of a request is invalid.
+type InvalidParam struct {
+	Name   string `json:"name" xml:"name"`
+	Reason string `json:"reason" xml:"reason"`
+}
+
+//--------------------
+// ERROR RENDERER
+//--------------------
+
+// ErrorRenderer writes an error as response.
+type ErrorRenderer func(ctx *Context, err *HTTPError)
+
+// errorFormats are the formats of the default error renderer and
+// the content types they are chosen for. Their order decides if the
+// accepted content types have equal values and positions.
+var errorFormats = []struct {
+	format       string
+	contentTypes []string
+}{
+	{"plain", []string{CT_PLAIN}},
+	{"json", []string{CT_PROBLEM_JSON, CT_JSON}},
+	{"xml", []string{CT_PROBLEM_XML, CT_XML}},
+	{"html", []string{CT_HTML}},
+}
+
+// errorFormat negotiates the format of an error. The highest value
+// wins, for equal values the earlier media range in the accept header.
+// If none is acceptable it's plain text.
+func errorFormat(ctx *Context) string {
+	accepted := ctx.ContentTypes()
+	format, value, index := "plain", 0.0, -1
+	for _, ef := range errorFormats {
+		for _, contentType := range ef.contentTypes {
+			v, i := accepted.match(contentType)
+			if v > value || (v == value && v > 0 && i < index) {
+				format, value, index = ef.format, v, i
+			}
+		}
+	}
+	return format
+}
+
+// RenderError is the default error renderer. Depending on the values
+// of the accepted content types it writes the problem details as JSON
+// or XML, a small HTML page or plain text.
+func RenderError(ctx *Context, err *HTTPError) {
+	p := err.Problem(ctx)
+	h := ctx.ResponseWriter.Header()
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Add("Vary", "Accept")
+	var b []byte
+	switch errorFormat(ctx) {
+	case "json":
+		h.Set("Content-Type", CT_PROBLEM_JSON)
+		b, _ = json.Marshal(p)
+	case "xml":
+		h.Set("Content-Type", CT_PROBLEM_XML)
+		b, _ = xml.Marshal(p)
+		b = append([]byte(xml.Header), b...)
+	case "html":
+		title := html.EscapeString(fmt.Sprintf("%d %s", p.Status, p.Title))
+		h.Set("Content-Type", CT_HTML+"; charset=utf-8")
+		params := ""
+		if len(p.InvalidParams) > 0 {
+			params = "<ul>\n"
+			for _, ip := range p.InvalidParams {
+				params += fmt.Sprintf("<li>%s: %s</li>\n", html.EscapeString(ip.Name), html.EscapeString(ip.Reason))
+			}
+			params += "</ul>\n"
+		}
+		b = []byte(fmt.Sprintf("<!DOCTYPE html>\n<html>\n<head><title>%s</title></head>\n<body>\n<h1>%s</h1>\n<p>%s</p>\n%s</body>\n</html>\n",
+			title, title, html.EscapeString(p.Detail), params))
+	default:
+		msg := fmt.Sprintf("%d %s", p.Status, strings.ToLower(p.Title))
+		if p.Detail != "" {
+			msg += ": " + p.Detail
+		}
+		for _, ip := range p.InvalidParams {
+			msg += fmt.Sprintf("\n%s: %s", ip.Name, ip.Reason)
+		}
+		h.Set("Content-Type", CT_PLAIN+"; charset=utf-8")
+		b = []byte(msg + "\n")
+	}
+	ctx.ResponseWriter.WriteHeader(p.Status)
+	ctx.ResponseWriter.Write(b)
+}
+
+// handleError logs the error and writes it with the configured
+// renderer. Errors which are no HTTP errors are internal server
+// errors without details for the client.
+func handleError(ctx *Context, err error) {
+	he, ok := err.(*HTTPError)
+	if !ok {
+		he = &HTTPError{Status: http.StatusInternalServerError, Err: err}
+	}
+	if he.Status >= http.StatusInternalServerError {
+		applog.Errorf("error handling %s: %v", ctx, he)
+	} else {
+		applog.Warningf("error handling %s: %v", ctx, he)
+	}
+	ctx.server.renderer()(ctx, he)
+}
+
+// EOF
@@ -0,0 +1,301 @@
+// Tideland Common Go Library - Web - Limits
+//
+// Copyright (C) 2009-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package web
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"cgl.tideland.biz/identifier"
+	"cgl.tideland.biz/monitoring"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//--------------------
+// CLIENT KEYS
+//--------------------
+
+// KeyFunc returns the key identifying the client of a request.
+type KeyFunc func(ctx *Context) string
+
+// KeyByIP identifies clients by their IP address.
+func KeyByIP(ctx *Context) string {
+	host, _, err := net.SplitHostPort(ctx.Request.RemoteAddr)
+	if err != nil {
+		return ctx.Request.RemoteAddr
+	}
+	return host
+}
+
+// KeyByPrincipal identifies clients by the name of the principal
+// set by the authentication, or by their IP address.
+func KeyByPrincipal(ctx *Context) string {
+	if ctx.Principal != nil {
+		return "principal:" + ctx.Principal.Name
+	}
+	return KeyByIP(ctx)
+}
+
+// KeyByHeader returns a key function identifying clients by the
+// value of a header, e.g. an API key, or by their IP address.
+func KeyByHeader(name string) KeyFunc {
+	return func(ctx *Context) string {
+		if value := ctx.Request.Header.Get(name); value != "" {
+			return "header:" + value
+		}
+		return KeyByIP(ctx)
+	}
+}
+
+//--------------------
+// RATE LIMIT
+//--------------------
+
+// RateLimitConfiguration configures a rate limit. Each client may send
+// Rate requests per second on average and Burst requests at once, it
+// defaults to one. The Key identifies the clients, by default their
+// IP address. The Name is used for the monitoring variables.
+//
+// The limit counts all requests passing the middleware. If resources
+// need individual limits wrap their handlers with own rate limits
+// instead of using it for the whole server.
+type RateLimitConfiguration struct {
+	Name  string
+	Rate  float64
+	Burst int
+	Key   KeyFunc
+}
+
+// bucket is the token bucket of a client.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits the requests with token buckets.
+type rateLimiter struct {
+	mutex         sync.Mutex
+	configuration RateLimitConfiguration
+	buckets       map[string]*bucket
+	lastSweep     time.Time
+}
+
+// RateLimit returns a middleware limiting the requests per client. If
+// a client exceeds its limit the request is answered with too many
+// requests and a Retry-After header. The numbers of allowed and
+// rejected requests are counted in the monitoring variables
+// "web:ratelimit:<name>:allowed" and "...:rejected".
+func RateLimit(c RateLimitConfiguration) Middleware {
+	if c.Name == "" {
+		c.Name = "default"
+	}
+	if c.Burst < 1 {
+		c.Burst = 1
+	}
+	if c.Key == nil {
+		c.Key = KeyByIP
+	}
+	rl := &rateLimiter{
+		configuration: c,
+		buckets:       make(map[string]*bucket),
+		lastSweep:     time.Now(),
+	}
+	allowedId := identifier.Identifier("web", "ratelimit", c.Name, "allowed")
+	rejectedId := identifier.Identifier("web", "ratelimit", c.Name, "rejected")
+	return func(h HandlerFunc) HandlerFunc {
+		return func(ctx *Context) error {
+			wait := rl.take(c.Key(ctx), time.Now())
+			if wait > 0 {
+				monitoring.IncrVariable(rejectedId)
+				setRetryAfter(ctx, wait)
+				return NewHTTPError(http.StatusTooManyRequests, "rate limit exceeded")
+			}
+			monitoring.IncrVariable(allowedId)
+			return h(ctx)
+		}
+	}
+}
+
+// take takes a token out of the bucket of the client. If there
+// is none it returns the time to wait for the next one.
+func (rl *rateLimiter) take(key string, now time.Time) time.Duration {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	burst := float64(rl.configuration.Burst)
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{burst, now}
+		rl.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rl.configuration.Rate)
+	b.last = now
+	if now.Sub(rl.lastSweep) > time.Minute {
+		rl.sweep(now)
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	if rl.configuration.Rate <= 0 {
+		return time.Hour
+	}
+	return time.Duration((1 - b.tokens) / rl.configuration.Rate * float64(time.Second))
+}
+
+// sweep removes the buckets which are full again.
+func (rl *rateLimiter) sweep(now time.Time) {
+	burst := float64(rl.configuration.Burst)
+	for key, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.configuration.Rate >= burst {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.lastSweep = now
+}
+
+//--------------------
+// CONCURRENCY LIMIT
+//--------------------
+
+// ConcurrencyConfiguration configures the number of requests handled
+// concurrently per registered resource, identified by "domain/resource"
+// for resource handlers and by the pattern for routes. Max is the
+// default, Resources contains individual ones, zero means no limit.
+// Further requests wait up to QueueTimeout, with zero they are
+// rejected immediately when the limit is reached. Requests for
+// unregistered resources aren't limited.
+type ConcurrencyConfiguration struct {
+	Max          int
+	Resources    map[string]int
+	QueueTimeout time.Duration
+}
+
+// semaphore limits the concurrent requests of a resource.
+type semaphore struct {
+	slots    chan struct{}
+	activeId string
+}
+
+// concurrencyLimiter limits the concurrent requests per resource.
+type concurrencyLimiter struct {
+	mutex         sync.Mutex
+	configuration ConcurrencyConfiguration
+	semaphores    map[string]*semaphore
+}
+
+// ConcurrencyLimit returns a middleware limiting the number of
+// concurrently handled requests per resource. Requests waiting
+// longer than the queue timeout are answered with service unavailable
+// and a Retry-After header. The number of active requests per resource
+// is kept in the monitoring variable "web:concurrency:<domain>:<resource>",
+// or the pattern parts for routes, the rejected requests are counted
+// in "web:concurrency:rejected".
+func ConcurrencyLimit(c ConcurrencyConfiguration) Middleware {
+	cl := &concurrencyLimiter{
+		configuration: c,
+		semaphores:    make(map[string]*semaphore),
+	}
+	rejectedId := identifier.Identifier("web", "concurrency", "rejected")
+	return func(h HandlerFunc) HandlerFunc {
+		return func(ctx *Context) error {
+			sem := cl.semaphore(ctx.server.resourceKey(ctx))
+			if sem == nil {
+				return h(ctx)
+			}
+			if !cl.acquire(ctx, sem) {
+				if err := ctx.Request.Context().Err(); err != nil {
+					return err
+				}
+				monitoring.IncrVariable(rejectedId)
+				setRetryAfter(ctx, c.QueueTimeout)
+				return NewHTTPError(http.StatusServiceUnavailable, "too many concurrent requests")
+			}
+			monitoring.IncrVariable(sem.activeId)
+			defer func() {
+				<-sem.slots
+				monitoring.DecrVariable(sem.activeId)
+			}()
+			return h(ctx)
+		}
+	}
+}
+
+// acquire takes a slot of the semaphore. If none is free it waits
+// up to the queue timeout. It returns false if it got no slot.
+func (cl *concurrencyLimiter) acquire(ctx *Context, sem *semaphore) bool {
+	select {
+	case sem.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if cl.configuration.QueueTimeout <= 0 {
+		return false
+	}
+	timer := time.NewTimer(cl.configuration.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case sem.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Request.Context().Done():
+		return false
+	}
+}
+
+// semaphore returns the semaphore of the resource, or nil if it's
+// unlimited. The keys are those of the registered resources, so
+// the number of semaphores is limited.
+func (cl *concurrencyLimiter) semaphore(resource string) *semaphore {
+	if resource == "" {
+		return nil
+	}
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	if sem, ok := cl.semaphores[resource]; ok {
+		return sem
+	}
+	limit, ok := cl.configuration.Resources[resource]
+	if !ok {
+		limit = cl.configuration.Max
+	}
+	var sem *semaphore
+	if limit > 0 {
+		parts := []interface{}{"web", "concurrency"}
+		for _, part := range splitPath(resource) {
+			parts = append(parts, part)
+		}
+		sem = &semaphore{
+			slots:    make(chan struct{}, limit),
+			activeId: identifier.Identifier(parts...),
+		}
+	}
+	cl.semaphores[resource] = sem
+	return sem
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// setRetryAfter sets the Retry-After header in full seconds.
+func setRetryAfter(ctx *Context, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	ctx.ResponseWriter.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
+
+// EOF
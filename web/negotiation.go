@@ -0,0 +1,230 @@
+// Tideland Common Go Library - Web - Content Negotiation
+//
+// Copyright (C) 2009-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package web
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bytes"
+	"cgl.tideland.biz/markup"
+	"encoding/gob"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//--------------------
+// CONTENT TYPE
+//--------------------
+
+// ContentType is an accepted content type, which may be a
+// range like "text/*", with value.
+type ContentType struct {
+	MediaRange string
+	Value      float64
+}
+
+// ContentTypes is the ordered set of accepted content types.
+type ContentTypes []ContentType
+
+// Value returns the value of the content type. It is the one
+// of the most specific matching media range, or 0 if none
+// matches.
+func (cts ContentTypes) Value(contentType string) float64 {
+	value, _ := cts.match(contentType)
+	return value
+}
+
+// match returns the value and the index of the most specific
+// media range matching the content type. The index is -1 if
+// none matches.
+func (cts ContentTypes) match(contentType string) (float64, int) {
+	contentType = strings.ToLower(contentType)
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = strings.TrimSpace(contentType[:i])
+	}
+	mainType := strings.SplitN(contentType, "/", 2)[0]
+	value, index, specificity := 0.0, -1, 0
+	for i, ct := range cts {
+		s := 0
+		switch ct.MediaRange {
+		case contentType:
+			s = 3
+		case mainType + "/*":
+			s = 2
+		case "*/*":
+			s = 1
+		}
+		if s > specificity {
+			value, index, specificity = ct.Value, i, s
+		}
+	}
+	return value, index
+}
+
+// parseContentTypes parses the content types of an accept header.
+// Without a header all content types are accepted.
+func parseContentTypes(accept string) ContentTypes {
+	contentTypes := ContentTypes{}
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(params[0]))
+		if mediaRange == "" {
+			continue
+		}
+		value := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.TrimSpace(kv[0]) == "q" {
+				v, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+				if err != nil {
+					v = 0.0
+				}
+				value = v
+			}
+		}
+		contentTypes = append(contentTypes, ContentType{mediaRange, value})
+	}
+	if len(contentTypes) == 0 {
+		contentTypes = append(contentTypes, ContentType{"*/*", 1.0})
+	}
+	return contentTypes
+}
+
+//--------------------
+// ENCODER
+//--------------------
+
+// ErrNotEncodable is returned by encoders if they can't encode
+// the data. Then the next acceptable encoder is tried.
+var ErrNotEncodable = errors.New("web: data cannot be encoded")
+
+// Encoder encodes data for a response.
+type Encoder func(ctx *Context, data interface{}) ([]byte, error)
+
+// encoderEntry registers an encoder for a content type.
+type encoderEntry struct {
+	contentType string
+	encoder     Encoder
+}
+
+// defaultEncoders returns the initially registered encoders.
+func defaultEncoders() []*encoderEntry {
+	return []*encoderEntry{
+		{CT_JSON, EncodeJSON},
+		{CT_XML, EncodeXML},
+		{CT_SML, EncodeSML},
+		{CT_GOB, EncodeGob},
+	}
+}
+
+// EncodeJSON encodes the data as JSON.
+func EncodeJSON(ctx *Context, data interface{}) ([]byte, error) {
+	b, err := json.Marshal(data)
+	if _, ok := err.(*json.UnsupportedTypeError); ok {
+		return nil, ErrNotEncodable
+	}
+	return b, err
+}
+
+// EncodeXML encodes the data as XML document.
+func EncodeXML(ctx *Context, data interface{}) ([]byte, error) {
+	b, err := xml.Marshal(data)
+	if err != nil {
+		if _, ok := err.(*xml.UnsupportedTypeError); ok {
+			return nil, ErrNotEncodable
+		}
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+// EncodeSML encodes a *markup.TagNode as SML document.
+func EncodeSML(ctx *Context, data interface{}) ([]byte, error) {
+	root, ok := data.(*markup.TagNode)
+	if !ok {
+		return nil, ErrNotEncodable
+	}
+	var buf bytes.Buffer
+	if err := markup.WriteSML(root, &buf, false); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// EncodeGob encodes the data as GOB.
+func EncodeGob(ctx *Context, data interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// TemplateEncoder returns an encoder rendering the data with
+// the template of the server.
+func TemplateEncoder(templateId string) Encoder {
+	return func(ctx *Context, data interface{}) ([]byte, error) {
+		var buf bytes.Buffer
+		if err := ctx.server.templateCache.execute(&buf, templateId, data); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+}
+
+//--------------------
+// RESPONDING
+//--------------------
+
+// Respond writes the data with the status. The encoder is chosen by
+// the values of the accepted content types, the registration order of
+// the encoders decides between equal values. If no encoder is acceptable
+// a not acceptable HTTP error is returned.
+func (ctx *Context) Respond(status int, data interface{}) error {
+	h := ctx.ResponseWriter.Header()
+	h.Add("Vary", "Accept")
+	accepted := ctx.ContentTypes()
+	type candidate struct {
+		entry *encoderEntry
+		value float64
+	}
+	candidates := []candidate{}
+	contentTypes := []string{}
+	for _, entry := range ctx.server.encoderEntries() {
+		contentTypes = append(contentTypes, entry.contentType)
+		if value := accepted.Value(entry.contentType); value > 0 {
+			candidates = append(candidates, candidate{entry, value})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].value > candidates[j].value
+	})
+	for _, c := range candidates {
+		b, err := c.entry.encoder(ctx, data)
+		if err == ErrNotEncodable {
+			continue
+		}
+		if err != nil {
+			return &HTTPError{Status: http.StatusInternalServerError, Err: err}
+		}
+		h.Set("Content-Type", c.entry.contentType)
+		ctx.ResponseWriter.WriteHeader(status)
+		_, err = ctx.ResponseWriter.Write(b)
+		return err
+	}
+	return NewHTTPError(http.StatusNotAcceptable, "available content types are %s", strings.Join(contentTypes, ", "))
+}
+
+// EOF
@@ -0,0 +1,135 @@
+// Tideland Common Go Library - Web - Router
+//
+// Copyright (C) 2009-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package web
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"fmt"
+	"strings"
+)
+
+//--------------------
+// HANDLER FUNC AND MIDDLEWARE
+//--------------------
+
+// HandlerFunc handles a request matching a route. A returned error
+// is written by the error renderer, errors which are no HTTPError as
+// internal server error without details.
+type HandlerFunc func(ctx *Context) error
+
+// Middleware wraps a handler function for cross-cutting concerns
+// like authentication or compression. The returned handler function
+// may answer the request itself or call the wrapped one.
+type Middleware func(h HandlerFunc) HandlerFunc
+
+// chain wraps the handler function with the middlewares. The
+// first middleware is the outermost one.
+func chain(h HandlerFunc, middlewares []Middleware) HandlerFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+//--------------------
+// ROUTE
+//--------------------
+
+// route maps a path pattern and the allowed methods
+// to a handler function.
+type route struct {
+	pattern  string
+	segments []string
+	methods  []string
+	handler  HandlerFunc
+}
+
+// newRoute creates a new route. The pattern consists of literal
+// segments, parameters like "{id}" and an optional wildcard like
+// "*path" as last segment. It panics if the pattern is invalid.
+func newRoute(pattern string, h HandlerFunc, methods []string) *route {
+	segments := splitPath(pattern)
+	for i, segment := range segments {
+		switch {
+		case strings.HasPrefix(segment, "*"):
+			if i != len(segments)-1 || len(segment) == 1 {
+				panic(fmt.Sprintf("web: invalid wildcard in route pattern %q", pattern))
+			}
+		case strings.HasPrefix(segment, "{"):
+			if !strings.HasSuffix(segment, "}") || len(segment) == 2 {
+				panic(fmt.Sprintf("web: invalid parameter in route pattern %q", pattern))
+			}
+		}
+	}
+	upperMethods := make([]string, len(methods))
+	for i, method := range methods {
+		upperMethods[i] = strings.ToUpper(method)
+	}
+	return &route{
+		pattern:  pattern,
+		segments: segments,
+		methods:  upperMethods,
+		handler:  h,
+	}
+}
+
+// match checks if the parts of a path match the route and
+// returns the parameters.
+func (r *route) match(parts []string) (map[string]string, bool) {
+	parameters := make(map[string]string)
+	for i, segment := range r.segments {
+		switch {
+		case strings.HasPrefix(segment, "*"):
+			parameters[segment[1:]] = strings.Join(parts[i:], "/")
+			return parameters, true
+		case i >= len(parts):
+			return nil, false
+		case strings.HasPrefix(segment, "{"):
+			parameters[segment[1:len(segment)-1]] = parts[i]
+		case segment != parts[i]:
+			return nil, false
+		}
+	}
+	if len(parts) != len(r.segments) {
+		return nil, false
+	}
+	return parameters, true
+}
+
+// allows checks if the route allows the method. A route
+// without methods allows all.
+func (r *route) allows(method string) bool {
+	if len(r.methods) == 0 {
+		return true
+	}
+	for _, allowed := range r.methods {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// splitPath splits a path into its parts without leading
+// and trailing slashes.
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}
+	}
+	return strings.Split(path, "/")
+}
+
+// EOF
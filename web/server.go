@@ -0,0 +1,427 @@
+// Tideland Common Go Library - Web - Server
+//
+// Copyright (C) 2009-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package web
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"cgl.tideland.biz/applog"
+	"cgl.tideland.biz/identifier"
+	"cgl.tideland.biz/monitoring"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+//--------------------
+// SERVER
+//--------------------
+
+// Server dispatches requests to its routes and resource handlers.
+// It implements http.Handler, so it can be used standalone with
+// ListenAndServe() or be mounted into other servers. Each server
+// has its own handlers, templates, defaults and middlewares.
+type Server struct {
+	mutex           sync.RWMutex
+	address         string
+	basePath        string
+	defaultDomain   string
+	defaultResource string
+	domains         domainMapping
+	routes          []*route
+	middlewares     []Middleware
+	errorRenderer   ErrorRenderer
+	encoders        []*encoderEntry
+	templateCache   *templateCache
+	httpServer      *http.Server
+	active          int
+	closing         bool
+	closingChan     chan struct{}
+	idleChan        chan bool
+}
+
+// NewServer creates a server for the address and base path. An
+// empty address defaults to ":8080", the base path always ends
+// with a slash.
+func NewServer(address, basePath string) *Server {
+	s := &Server{
+		defaultDomain:   "default",
+		defaultResource: "default",
+		domains:         make(domainMapping),
+		errorRenderer:   RenderError,
+		encoders:        defaultEncoders(),
+		closingChan:     make(chan struct{}),
+	}
+	s.templateCache = newTemplateCache(template.FuncMap{
+		"HtmlInternalReference": func(domain, resource, resourceId string, query ...KeyValue) string {
+			return internalReference(s.BasePath(), domain, resource, resourceId, query...)
+		},
+		"KeyValue": func(key string, value interface{}) KeyValue {
+			return KeyValue{key, value}
+		},
+	})
+	s.prepare(address, basePath)
+	return s
+}
+
+// prepare sets the passed configuration information.
+func (s *Server) prepare(address, basePath string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.address = address
+	s.basePath = basePath
+	// Check passed parameters.
+	if s.address == "" {
+		s.address = ":8080"
+	}
+	if !strings.HasSuffix(s.basePath, "/") {
+		s.basePath += "/"
+	}
+}
+
+// ServeHTTP dispatches the requests through the middlewares to the
+// registered routes and resource handlers. During a shutdown new
+// requests are answered with service unavailable.
+func (s *Server) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	ctx := newContext(s, rw, r)
+	if !s.begin() {
+		handleError(ctx, NewHTTPError(http.StatusServiceUnavailable, "server is shutting down"))
+		return
+	}
+	defer s.end()
+	defer func() {
+		if err := recover(); err != nil {
+			// Log the panic, but don't tell the client.
+			applog.Criticalf("panic handling %s: %v", ctx, err)
+			handleError(ctx, NewHTTPError(http.StatusInternalServerError, ""))
+		}
+	}()
+	if !ctx.insideBasePath() {
+		handleError(ctx, NewHTTPError(http.StatusNotFound, "path is outside of %q", ctx.basePath))
+		return
+	}
+	s.mutex.RLock()
+	h := chain(s.handleRoutes, s.middlewares)
+	s.mutex.RUnlock()
+	if err := h(ctx); err != nil {
+		handleError(ctx, err)
+	}
+}
+
+// ListenAndServe listens on the configured address and serves the
+// requests until the server is shut down.
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.Address())
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves the requests on the listener until the server
+// is shut down.
+func (s *Server) Serve(l net.Listener) error {
+	return s.serve(l, s)
+}
+
+// serve serves the requests on the listener with the handler.
+func (s *Server) serve(l net.Listener, handler http.Handler) error {
+	hs := &http.Server{Handler: handler}
+	s.mutex.Lock()
+	if s.closing {
+		s.mutex.Unlock()
+		l.Close()
+		return http.ErrServerClosed
+	}
+	s.httpServer = hs
+	s.mutex.Unlock()
+	return hs.Serve(l)
+}
+
+// Shutdown stops accepting new requests and waits until the requests
+// in flight are done or the context is done. Event streams are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	if !s.closing {
+		close(s.closingChan)
+	}
+	s.closing = true
+	hs := s.httpServer
+	if s.active > 0 && s.idleChan == nil {
+		s.idleChan = make(chan bool)
+	}
+	idleChan := s.idleChan
+	s.mutex.Unlock()
+	if hs != nil {
+		if err := hs.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	if idleChan != nil {
+		select {
+		case <-idleChan:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Address returns the configured address of the server.
+func (s *Server) Address() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.address
+}
+
+// BasePath returns the configured base path of the server.
+func (s *Server) BasePath() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.basePath
+}
+
+// SetDefault configures own default domain and resource ids.
+func (s *Server) SetDefault(domain, resource string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.defaultDomain = domain
+	s.defaultResource = resource
+}
+
+// AddResourceHandler assigns a resource handler to a domain and
+// resource id. Multiple handlers for the same domain and resource
+// are called in the order of their registration.
+func (s *Server) AddResourceHandler(domain, resource string, handler ResourceHandler) ResourceHandler {
+	s.mutex.Lock()
+	// Map domain to resources.
+	resources := s.domains[domain]
+	if resources == nil {
+		resources = make(resourceMapping)
+		s.domains[domain] = resources
+	}
+	// Add handler.
+	resources[resource] = append(resources[resource], handler)
+	s.mutex.Unlock()
+	// Init handler, it may parse templates.
+	handler.Init(domain, resource)
+	return handler
+}
+
+// AddRoute assigns a handler function to a path pattern relative to
+// the base path. The pattern consists of literal segments, parameters
+// like "{id}" and an optional wildcard like "*path" as last segment
+// matching the rest of the path. The values are available via
+// Context.Parameter(). If no methods are passed all are allowed.
+// Routes are matched in the order of their registration, requests
+// not matching any route are dispatched to the resource handlers.
+func (s *Server) AddRoute(pattern string, handler HandlerFunc, methods ...string) {
+	rt := newRoute(pattern, handler, methods)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.routes = append(s.routes, rt)
+}
+
+// SetErrorRenderer sets the renderer for errors returned by handler
+// functions and resource handlers. The default is RenderError().
+func (s *Server) SetErrorRenderer(renderer ErrorRenderer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.errorRenderer = renderer
+}
+
+// RegisterEncoder registers an encoder for a content type used by
+// Context.Respond(). An existing encoder for the content type is
+// replaced, otherwise it's added with the lowest priority. Initially
+// JSON, XML, SML and GOB are registered in this order.
+func (s *Server) RegisterEncoder(contentType string, encoder Encoder) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, entry := range s.encoders {
+		if entry.contentType == contentType {
+			entry.encoder = encoder
+			return
+		}
+	}
+	s.encoders = append(s.encoders, &encoderEntry{contentType, encoder})
+}
+
+// Use adds middlewares wrapping the handling of all requests. The
+// first added middleware is the outermost one.
+func (s *Server) Use(middlewares ...Middleware) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.middlewares = append(s.middlewares, middlewares...)
+}
+
+// AddTemplateFuncs adds functions for the templates parsed afterwards.
+// Initially the functions HtmlInternalReference, using the base path
+// of the server, and KeyValue for its query arguments are available.
+func (s *Server) AddTemplateFuncs(funcs template.FuncMap) {
+	s.templateCache.addFuncs(funcs)
+}
+
+// ParseTemplate parses a template and stores it together with the
+// content type in the cache.
+func (s *Server) ParseTemplate(templateId, template, contentType string) error {
+	return s.templateCache.parse(templateId, template, contentType)
+}
+
+// LoadAndParseTemplate loads a file, parses a template and stores it
+// together with the content type in the cache.
+func (s *Server) LoadAndParseTemplate(templateId, filename, contentType string) error {
+	return s.templateCache.loadAndParse(templateId, filename, contentType)
+}
+
+// DefineTemplateSet defines a set of a layout and shared partials. The
+// layout is the content of the templates loaded in the set, it can use
+// templates defined by them, e.g. {{template "content" .}}, and the
+// partials by their file base names or the templates they define.
+func (s *Server) DefineTemplateSet(setId, layout string, partials ...string) error {
+	return s.templateCache.defineSet(setId, layout, partials)
+}
+
+// LoadAndParseSetTemplate loads a file, parses it together with the
+// files of the template set and stores the template together with the
+// content type in the cache.
+func (s *Server) LoadAndParseSetTemplate(templateId, setId, filename, contentType string) error {
+	return s.templateCache.loadAndParseInSet(templateId, setId, filename, contentType)
+}
+
+// WatchTemplates checks the files of the loaded templates in the interval
+// and reloads changed ones, e.g. during development. Templates which can't
+// be parsed are logged and kept. It runs until the server is shut down.
+func (s *Server) WatchTemplates(interval time.Duration) {
+	go s.templateCache.watch(interval, s.closingChan)
+}
+
+// begin registers a request in flight. It returns false
+// if the server is shutting down.
+func (s *Server) begin() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closing {
+		return false
+	}
+	s.active++
+	return true
+}
+
+// end unregisters a request in flight.
+func (s *Server) end() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.active--
+	if s.active == 0 && s.idleChan != nil {
+		close(s.idleChan)
+		s.idleChan = nil
+	}
+}
+
+// encoderEntries returns a copy of the registered encoders.
+func (s *Server) encoderEntries() []*encoderEntry {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	entries := make([]*encoderEntry, len(s.encoders))
+	for i, entry := range s.encoders {
+		entries[i] = &encoderEntry{entry.contentType, entry.encoder}
+	}
+	return entries
+}
+
+// renderer returns the error renderer.
+func (s *Server) renderer() ErrorRenderer {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.errorRenderer
+}
+
+// handleRoutes dispatches the request to the first matching route.
+// If none matches it is dispatched to the resource handlers.
+func (s *Server) handleRoutes(ctx *Context) error {
+	s.mutex.RLock()
+	routes := s.routes
+	s.mutex.RUnlock()
+	parts := splitPath(ctx.path())
+	allowed := []string{}
+	for _, rt := range routes {
+		parameters, ok := rt.match(parts)
+		if !ok {
+			continue
+		}
+		if !rt.allows(ctx.Request.Method) {
+			allowed = append(allowed, rt.methods...)
+			continue
+		}
+		ctx.Parameters = parameters
+		m := monitoring.BeginMeasuring(identifier.Identifier("web", "route", rt.pattern, ctx.Request.Method))
+		err := rt.handler(ctx)
+		m.EndMeasuring()
+		return err
+	}
+	if len(allowed) > 0 {
+		// Path matches, but not the method.
+		ctx.ResponseWriter.Header().Set("Allow", strings.Join(allowed, ", "))
+		return NewHTTPError(http.StatusMethodNotAllowed, "")
+	}
+	return s.handleResources(ctx)
+}
+
+// resourceKey returns the pattern of the route or "domain/resource"
+// of the resource handlers the request is dispatched to. It's empty
+// if there's none.
+func (s *Server) resourceKey(ctx *Context) string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	parts := splitPath(ctx.path())
+	for _, rt := range s.routes {
+		if _, ok := rt.match(parts); ok && rt.allows(ctx.Request.Method) {
+			return rt.pattern
+		}
+	}
+	if s.domains[ctx.Domain][ctx.Resource] != nil {
+		return ctx.Domain + "/" + ctx.Resource
+	}
+	return ""
+}
+
+// handleResources dispatches the request to the resource handlers
+// registered for the domain and resource.
+func (s *Server) handleResources(ctx *Context) error {
+	s.mutex.RLock()
+	handlers := s.domains[ctx.Domain][ctx.Resource]
+	defaultDomain, defaultResource := s.defaultDomain, s.defaultResource
+	s.mutex.RUnlock()
+	if handlers != nil {
+		m := monitoring.BeginMeasuring(identifier.Identifier("web", ctx.Domain, ctx.Resource, ctx.Request.Method))
+		for _, h := range handlers {
+			if !dispatch(ctx, h) {
+				break
+			}
+		}
+		m.EndMeasuring()
+		return nil
+	}
+	// No valid configuration, redirect to default (if not already).
+	if ctx.Domain == defaultDomain && ctx.Resource == defaultResource {
+		// No default handler registered.
+		return NewHTTPError(http.StatusNotFound, "domain '%v' and resource '%v' not found", ctx.Domain, ctx.Resource)
+	}
+	// Redirect to default handler.
+	applog.Warningf("domain '%v' and resource '%v' not found, redirecting to default", ctx.Domain, ctx.Resource)
+	ctx.Redirect(defaultDomain, defaultResource, "")
+	return nil
+}
+
+// EOF
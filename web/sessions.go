@@ -0,0 +1,577 @@
+// Tideland Common Go Library - Web - Sessions
+//
+// Copyright (C) 2009-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package web
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bytes"
+	"cgl.tideland.biz/applog"
+	"cgl.tideland.biz/redis"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//--------------------
+// SESSION STORE
+//--------------------
+
+// SessionStore stores the encoded data of the sessions by their
+// ids. Load returns nil if a session doesn't exist.
+type SessionStore interface {
+	Load(id string) ([]byte, error)
+	Save(id string, data []byte, lifetime time.Duration) error
+	Delete(id string) error
+}
+
+//--------------------
+// MEMORY SESSION STORE
+//--------------------
+
+// memorySession is a session stored in memory.
+type memorySession struct {
+	data    []byte
+	expires time.Time
+}
+
+// MemorySessionStore stores the sessions in memory.
+type MemorySessionStore struct {
+	mutex     sync.Mutex
+	sessions  map[string]*memorySession
+	lastSweep time.Time
+}
+
+// NewMemorySessionStore creates a new session store in memory.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions:  make(map[string]*memorySession),
+		lastSweep: time.Now(),
+	}
+}
+
+// Load returns the data of the session.
+func (s *MemorySessionStore) Load(id string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ms, ok := s.sessions[id]
+	if !ok || ms.expires.Before(time.Now()) {
+		delete(s.sessions, id)
+		return nil, nil
+	}
+	return ms.data, nil
+}
+
+// Save stores the data of the session. Expired sessions
+// are removed once a minute.
+func (s *MemorySessionStore) Save(id string, data []byte, lifetime time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	s.sessions[id] = &memorySession{data, now.Add(lifetime)}
+	if now.Sub(s.lastSweep) > time.Minute {
+		for id, ms := range s.sessions {
+			if ms.expires.Before(now) {
+				delete(s.sessions, id)
+			}
+		}
+		s.lastSweep = now
+	}
+	return nil
+}
+
+// Delete removes the session.
+func (s *MemorySessionStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+//--------------------
+// FILE SESSION STORE
+//--------------------
+
+// FileSessionStore stores each session in a file named
+// by the session id. The modification time of the file is
+// set to the expiration of the session.
+type FileSessionStore struct {
+	mutex     sync.Mutex
+	dir       string
+	lastSweep time.Time
+}
+
+// NewFileSessionStore creates a session store in the directory.
+// It's created if it doesn't exist.
+func NewFileSessionStore(dir string) (*FileSessionStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileSessionStore{
+		dir:       dir,
+		lastSweep: time.Now(),
+	}, nil
+}
+
+// Load returns the data of the session.
+func (s *FileSessionStore) Load(id string) ([]byte, error) {
+	fn, err := s.filename(id)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fi.ModTime().Before(time.Now()) {
+		if err = os.Remove(fn); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Save stores the data of the session. Expired sessions
+// are removed once a minute.
+func (s *FileSessionStore) Save(id string, data []byte, lifetime time.Duration) error {
+	fn, err := s.filename(id)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	s.mutex.Lock()
+	if now.Sub(s.lastSweep) > time.Minute {
+		s.lastSweep = now
+		s.mutex.Unlock()
+		s.sweep(now)
+	} else {
+		s.mutex.Unlock()
+	}
+	// Write a temporary file first, so that loading never
+	// reads a partially written session.
+	f, err := ioutil.TempFile(s.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	expires := now.Add(lifetime)
+	if err = os.Chtimes(f.Name(), now, expires); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), fn)
+}
+
+// Delete removes the session.
+func (s *FileSessionStore) Delete(id string) error {
+	fn, err := s.filename(id)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(fn); os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// sweep removes the files of the expired sessions.
+func (s *FileSessionStore) sweep(now time.Time) {
+	fns, err := filepath.Glob(filepath.Join(s.dir, "session-*"))
+	if err != nil {
+		applog.Errorf("cannot sweep sessions in %q: %v", s.dir, err)
+		return
+	}
+	for _, fn := range fns {
+		if fi, err := os.Stat(fn); err == nil && fi.ModTime().Before(now) {
+			os.Remove(fn)
+		}
+	}
+}
+
+// filename returns the filename for the session id.
+func (s *FileSessionStore) filename(id string) (string, error) {
+	if id == "" || strings.IndexFunc(id, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_')
+	}) >= 0 {
+		return "", fmt.Errorf("web: invalid session id %q", id)
+	}
+	return filepath.Join(s.dir, "session-"+id), nil
+}
+
+//--------------------
+// REDIS SESSION STORE
+//--------------------
+
+// RedisSessionStore stores the sessions in Redis using
+// the lifetime as expiration.
+type RedisSessionStore struct {
+	database *redis.Database
+	prefix   string
+}
+
+// NewRedisSessionStore creates a session store using the database.
+// The prefix is used for the keys of the sessions.
+func NewRedisSessionStore(db *redis.Database, prefix string) *RedisSessionStore {
+	return &RedisSessionStore{db, prefix}
+}
+
+// Load returns the data of the session.
+func (s *RedisSessionStore) Load(id string) ([]byte, error) {
+	rs := s.database.Command("get", s.prefix+id)
+	if !rs.IsOK() {
+		if redis.IsKeyNotFoundError(rs.Error()) {
+			return nil, nil
+		}
+		return nil, rs.Error()
+	}
+	return []byte(rs.Value()), nil
+}
+
+// Save stores the data of the session.
+func (s *RedisSessionStore) Save(id string, data []byte, lifetime time.Duration) error {
+	ms := int64(lifetime / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	rs := s.database.Command("set", s.prefix+id, data, "px", ms)
+	return rs.Error()
+}
+
+// Delete removes the session.
+func (s *RedisSessionStore) Delete(id string) error {
+	return s.database.Command("del", s.prefix+id).Error()
+}
+
+//--------------------
+// SESSION MANAGER
+//--------------------
+
+// SessionConfiguration configures the session handling. The Secret
+// signs the session cookies, without one a random secret is used,
+// so sessions don't survive a restart. The Lifetime is extended with
+// each request using the session, it defaults to 30 minutes. The
+// Store defaults to a MemorySessionStore, the CookieName to "session".
+// Secure cookies are only sent via HTTPS.
+type SessionConfiguration struct {
+	Store      SessionStore
+	Secret     []byte
+	Lifetime   time.Duration
+	CookieName string
+	Secure     bool
+}
+
+// SessionManager loads and saves the sessions of the requests.
+type SessionManager struct {
+	configuration SessionConfiguration
+}
+
+// NewSessionManager creates a session manager.
+func NewSessionManager(c SessionConfiguration) *SessionManager {
+	if c.Store == nil {
+		c.Store = NewMemorySessionStore()
+	}
+	if len(c.Secret) == 0 {
+		c.Secret = make([]byte, 32)
+		if _, err := rand.Read(c.Secret); err != nil {
+			panic(fmt.Sprintf("web: cannot create session secret: %v", err))
+		}
+	}
+	if c.Lifetime <= 0 {
+		c.Lifetime = 30 * time.Minute
+	}
+	if c.CookieName == "" {
+		c.CookieName = "session"
+	}
+	return &SessionManager{c}
+}
+
+// Middleware returns the middleware making the sessions available
+// via Context.Session() and saving them after the handling.
+func (sm *SessionManager) Middleware() Middleware {
+	return func(h HandlerFunc) HandlerFunc {
+		return func(ctx *Context) error {
+			ctx.sessionManager = sm
+			err := h(ctx)
+			if ctx.session != nil {
+				if serr := ctx.session.save(); serr != nil {
+					applog.Errorf("cannot save session of %s: %v", ctx, serr)
+				}
+			}
+			return err
+		}
+	}
+}
+
+// load loads the session of the request or creates a new one.
+func (sm *SessionManager) load(ctx *Context) (*Session, error) {
+	s := &Session{
+		manager: sm,
+		ctx:     ctx,
+		data:    &sessionData{Values: make(map[string]string)},
+	}
+	if cookie, err := ctx.Request.Cookie(sm.configuration.CookieName); err == nil {
+		if id, ok := sm.verify(cookie.Value); ok {
+			b, err := sm.configuration.Store.Load(id)
+			if err != nil {
+				return nil, err
+			}
+			if b != nil {
+				data := &sessionData{}
+				if err = gob.NewDecoder(bytes.NewReader(b)).Decode(data); err != nil {
+					// Corrupt session, start a new one.
+					applog.Warningf("cannot decode session of %s: %v", ctx, err)
+					if err = sm.configuration.Store.Delete(id); err != nil {
+						return nil, err
+					}
+				} else if data.Expires.After(time.Now()) {
+					if data.Values == nil {
+						data.Values = make(map[string]string)
+					}
+					s.id = id
+					s.data = data
+				} else if err = sm.configuration.Store.Delete(id); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if s.id == "" {
+		id, err := newSessionId()
+		if err != nil {
+			return nil, err
+		}
+		s.id = id
+	}
+	sm.setCookie(ctx, s.id, sm.configuration.Lifetime)
+	return s, nil
+}
+
+// setCookie sets the signed session cookie.
+func (sm *SessionManager) setCookie(ctx *Context, id string, lifetime time.Duration) {
+	cookie := &http.Cookie{
+		Name:     sm.configuration.CookieName,
+		Value:    sm.sign(id),
+		Path:     ctx.basePath,
+		MaxAge:   int(lifetime / time.Second),
+		Secure:   sm.configuration.Secure,
+		HttpOnly: true,
+	}
+	if lifetime < 0 {
+		cookie.Value = ""
+		cookie.MaxAge = -1
+	}
+	// Replace a cookie set before in the same request.
+	h := ctx.ResponseWriter.Header()
+	cookies := []string{}
+	for _, c := range h["Set-Cookie"] {
+		if !strings.HasPrefix(c, sm.configuration.CookieName+"=") {
+			cookies = append(cookies, c)
+		}
+	}
+	h["Set-Cookie"] = append(cookies, cookie.String())
+}
+
+// sign returns the id with its signature.
+func (sm *SessionManager) sign(id string) string {
+	mac := hmac.New(sha256.New, sm.configuration.Secret)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks the signature of a cookie value and returns the id.
+func (sm *SessionManager) verify(value string) (string, bool) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return "", false
+	}
+	id := value[:i]
+	if !hmac.Equal([]byte(sm.sign(id)), []byte(value)) {
+		return "", false
+	}
+	return id, true
+}
+
+//--------------------
+// SESSION
+//--------------------
+
+// sessionData is the stored part of a session.
+type sessionData struct {
+	Values  map[string]string
+	Flashes []string
+	Expires time.Time
+}
+
+// Session contains the values of a client over multiple requests.
+// Changes are saved after the handling of the request, but the
+// cookie is set when the session is retrieved, rotated or destroyed,
+// so this has to be done before the response is written.
+type Session struct {
+	mutex     sync.Mutex
+	manager   *SessionManager
+	ctx       *Context
+	id        string
+	oldIds    []string
+	data      *sessionData
+	destroyed bool
+}
+
+// Session returns the session of the request. A new one is created
+// if the request has none or it is expired. The middleware of a
+// SessionManager has to be used.
+func (ctx *Context) Session() (*Session, error) {
+	if ctx.session != nil {
+		return ctx.session, nil
+	}
+	if ctx.sessionManager == nil {
+		return nil, errors.New("web: no session manager")
+	}
+	s, err := ctx.sessionManager.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx.session = s
+	return s, nil
+}
+
+// ID returns the id of the session.
+func (s *Session) ID() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.id
+}
+
+// Get returns a value of the session.
+func (s *Session) Get(key string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value, ok := s.data.Values[key]
+	return value, ok
+}
+
+// Set sets a value of the session.
+func (s *Session) Set(key, value string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data.Values[key] = value
+}
+
+// Delete removes a value of the session.
+func (s *Session) Delete(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.data.Values, key)
+}
+
+// AddFlash adds a message which is returned by the next
+// call of Flashes(), e.g. after a redirect.
+func (s *Session) AddFlash(message string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data.Flashes = append(s.data.Flashes, message)
+}
+
+// Flashes returns the flash messages and removes them.
+func (s *Session) Flashes() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	flashes := s.data.Flashes
+	s.data.Flashes = nil
+	return flashes
+}
+
+// Rotate changes the id of the session while keeping its values.
+// It should be called when the privileges change, e.g. at a login,
+// to prevent session fixation.
+func (s *Session) Rotate() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	id, err := newSessionId()
+	if err != nil {
+		return err
+	}
+	s.oldIds = append(s.oldIds, s.id)
+	s.id = id
+	s.manager.setCookie(s.ctx, s.id, s.manager.configuration.Lifetime)
+	return nil
+}
+
+// Destroy removes the session, e.g. at a logout.
+func (s *Session) Destroy() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.destroyed = true
+	s.manager.setCookie(s.ctx, s.id, -1)
+}
+
+// save saves the session or deletes it if it has been destroyed.
+func (s *Session) save() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	store := s.manager.configuration.Store
+	for _, id := range s.oldIds {
+		if err := store.Delete(id); err != nil {
+			return err
+		}
+	}
+	s.oldIds = nil
+	if s.destroyed {
+		return store.Delete(s.id)
+	}
+	lifetime := s.manager.configuration.Lifetime
+	s.data.Expires = time.Now().Add(lifetime)
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(s.data); err != nil {
+		return err
+	}
+	return store.Save(s.id, buf.Bytes(), lifetime)
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// newSessionId creates a new random session id.
+func newSessionId() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// EOF
@@ -0,0 +1,366 @@
+// Tideland Common Go Library - Web - Server-Sent Events
+//
+// Copyright (C) 2009-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package web
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bytes"
+	"cgl.tideland.biz/applog"
+	"cgl.tideland.biz/ebus"
+	"cgl.tideland.biz/redis"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//--------------------
+// CONST
+//--------------------
+
+const (
+	CT_EVENT_STREAM = "text/event-stream"
+
+	defaultKeepAlive = 15 * time.Second
+)
+
+// ErrStreamClosed is returned when writing to an event stream
+// after the client disconnected or the server is shutting down.
+var ErrStreamClosed = errors.New("web: event stream is closed")
+
+//--------------------
+// EVENT
+//--------------------
+
+// SSEEvent is a server-sent event. Id, Name and Retry are optional,
+// the Id is sent back by the client as Last-Event-ID when it
+// reconnects. The Retry tells the client how long to wait before
+// reconnecting.
+type SSEEvent struct {
+	Id    string
+	Name  string
+	Data  string
+	Retry time.Duration
+}
+
+// bytes returns the event in the wire format.
+func (e *SSEEvent) bytes() []byte {
+	var buf bytes.Buffer
+	if e.Id != "" {
+		fmt.Fprintf(&buf, "id: %s\n", singleLine(e.Id))
+	}
+	if e.Name != "" {
+		fmt.Fprintf(&buf, "event: %s\n", singleLine(e.Name))
+	}
+	if e.Retry > 0 {
+		fmt.Fprintf(&buf, "retry: %d\n", e.Retry/time.Millisecond)
+	}
+	data := strings.Replace(e.Data, "\r\n", "\n", -1)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&buf, "data: %s\n", line)
+	}
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
+
+//--------------------
+// EVENT STREAM
+//--------------------
+
+// EventStream writes server-sent events to a client. It stays open
+// until the client disconnects or the server is shutting down.
+type EventStream struct {
+	mutex     sync.Mutex
+	ctx       *Context
+	flusher   http.Flusher
+	keepAlive time.Duration
+	closed    bool
+}
+
+// EventStream starts an event stream as response. The headers are
+// written immediately, so it has to be called before anything else
+// is written.
+func (ctx *Context) EventStream() (*EventStream, error) {
+	flusher, ok := ctx.ResponseWriter.(http.Flusher)
+	if !ok {
+		return nil, &HTTPError{Status: http.StatusInternalServerError, Err: errors.New("web: response writer cannot flush")}
+	}
+	h := ctx.ResponseWriter.Header()
+	h.Set("Content-Type", CT_EVENT_STREAM)
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	h.Set("X-Accel-Buffering", "no")
+	ctx.ResponseWriter.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &EventStream{
+		ctx:       ctx,
+		flusher:   flusher,
+		keepAlive: defaultKeepAlive,
+	}, nil
+}
+
+// LastEventID returns the id of the last event the client has
+// received before reconnecting, or an empty string.
+func (es *EventStream) LastEventID() string {
+	return es.ctx.Request.Header.Get("Last-Event-ID")
+}
+
+// SetKeepAlive sets the interval of the comments sent by Serve()
+// to keep the connection open. The default is 15 seconds, zero
+// disables them.
+func (es *EventStream) SetKeepAlive(interval time.Duration) {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	es.keepAlive = interval
+}
+
+// Done returns a channel which is closed when the client
+// disconnects or the server is shutting down.
+func (es *EventStream) Done() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-es.ctx.Request.Context().Done():
+		case <-es.ctx.server.closingChan:
+		}
+		close(done)
+	}()
+	return done
+}
+
+// Send writes an event and flushes it to the client.
+func (es *EventStream) Send(event *SSEEvent) error {
+	return es.write(event.bytes())
+}
+
+// Comment writes a comment, which is ignored by the client.
+func (es *EventStream) Comment(comment string) error {
+	return es.write([]byte(": " + singleLine(comment) + "\n\n"))
+}
+
+// Serve sends the events of the channel until it is closed, the
+// client disconnects or the server is shutting down. In the latter
+// cases ErrStreamClosed is returned.
+func (es *EventStream) Serve(events <-chan *SSEEvent) error {
+	done := es.Done()
+	es.mutex.Lock()
+	keepAlive := es.keepAlive
+	es.mutex.Unlock()
+	var tick <-chan time.Time
+	if keepAlive > 0 {
+		ticker := time.NewTicker(keepAlive)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if err := es.Send(event); err != nil {
+				return err
+			}
+		case <-tick:
+			if err := es.Comment("keep-alive"); err != nil {
+				return err
+			}
+		case <-done:
+			es.close()
+			return ErrStreamClosed
+		}
+	}
+}
+
+// ServeSubscription sends the values of the Redis subscription as
+// events named by their channel with consecutive ids. It works like
+// Serve(), the subscription isn't stopped at the end.
+func (es *EventStream) ServeSubscription(sub *redis.Subscription) error {
+	events := make(chan *SSEEvent)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(events)
+		id := 0
+		for {
+			select {
+			case value, ok := <-sub.Values():
+				if !ok {
+					return
+				}
+				id++
+				select {
+				case events <- &SSEEvent{Id: strconv.Itoa(id), Name: value.Channel, Data: value.String()}:
+				case <-stop:
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return es.Serve(events)
+}
+
+// write writes the data and flushes it.
+func (es *EventStream) write(data []byte) error {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	if es.closed {
+		return ErrStreamClosed
+	}
+	if _, err := es.ctx.ResponseWriter.Write(data); err != nil {
+		es.closed = true
+		return ErrStreamClosed
+	}
+	es.flusher.Flush()
+	return nil
+}
+
+// close marks the stream as closed.
+func (es *EventStream) close() {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	es.closed = true
+}
+
+//--------------------
+// EVENT BUS AGENT
+//--------------------
+
+// SSEAgent is an event bus agent forwarding the events of the topics
+// it is subscribed to to the event streams it serves. The payloads of
+// the events have to be strings, the topic is the name of the event.
+// A number of the last events is kept, so that clients reconnecting
+// with a Last-Event-ID get the events they missed.
+type SSEAgent struct {
+	mutex    sync.Mutex
+	id       string
+	lastId   int
+	history  []*SSEEvent
+	size     int
+	channels map[chan *SSEEvent]bool
+	stopped  bool
+}
+
+// NewSSEAgent creates an agent keeping the last size events. It
+// has to be registered at and subscribed to the event bus.
+func NewSSEAgent(id string, size int) *SSEAgent {
+	return &SSEAgent{
+		id:       id,
+		size:     size,
+		channels: make(map[chan *SSEEvent]bool),
+	}
+}
+
+// Id returns the unique identifier of the agent.
+func (a *SSEAgent) Id() string {
+	return a.id
+}
+
+// Process forwards the event to the served event streams. Streams
+// not able to keep up lose the event.
+func (a *SSEAgent) Process(event ebus.Event) error {
+	var data string
+	if err := event.Payload(&data); err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.lastId++
+	e := &SSEEvent{Id: strconv.Itoa(a.lastId), Name: event.Topic(), Data: data}
+	a.history = append(a.history, e)
+	if len(a.history) > a.size {
+		a.history = a.history[len(a.history)-a.size:]
+	}
+	for ch := range a.channels {
+		select {
+		case ch <- e:
+		default:
+			applog.Warningf("event stream of agent %q is too slow, event %s lost", a.id, e.Id)
+		}
+	}
+	return nil
+}
+
+// Recover from an error during the processing of an event.
+func (a *SSEAgent) Recover(r interface{}, event ebus.Event) error {
+	applog.Errorf("agent %q cannot process event: %v", a.id, r)
+	return nil
+}
+
+// Stop ends all served event streams.
+func (a *SSEAgent) Stop() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.stopped = true
+	for ch := range a.channels {
+		close(ch)
+		delete(a.channels, ch)
+	}
+}
+
+// Err returns nil, the agent doesn't stop with an error.
+func (a *SSEAgent) Err() error {
+	return nil
+}
+
+// Serve sends the events missed since the Last-Event-ID of the
+// client and afterwards the new events. It works like
+// EventStream.Serve().
+func (a *SSEAgent) Serve(es *EventStream) error {
+	ch := make(chan *SSEEvent, a.size+1)
+	a.mutex.Lock()
+	if a.stopped {
+		a.mutex.Unlock()
+		return nil
+	}
+	if lastId, err := strconv.Atoi(es.LastEventID()); err == nil {
+		for _, e := range a.history {
+			if id, _ := strconv.Atoi(e.Id); id > lastId {
+				ch <- e
+			}
+		}
+	}
+	a.channels[ch] = true
+	a.mutex.Unlock()
+	defer func() {
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		delete(a.channels, ch)
+	}()
+	return es.Serve(ch)
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// Flush sends the buffered data of the response to the client, e.g.
+// for chunked feeds. It returns false if the response writer doesn't
+// support it.
+func (ctx *Context) Flush() bool {
+	flusher, ok := ctx.ResponseWriter.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+	return ok
+}
+
+// singleLine removes line breaks.
+func singleLine(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+// EOF
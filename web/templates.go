@@ -0,0 +1,225 @@
+// Tideland Common Go Library - Web - Templates
+//
+// Copyright (C) 2009-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package web
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"cgl.tideland.biz/applog"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+	"time"
+)
+
+//--------------------
+// TEMPLATE CACHE
+//--------------------
+
+// templateCacheEntry stores the parsed template and the
+// content type. Templates loaded from files also store the
+// files and their modification times for reloading.
+type templateCacheEntry struct {
+	parsedTemplate *template.Template
+	contentType    string
+	filenames      []string
+	modTimes       []time.Time
+}
+
+// templateCache stores preparsed templates.
+type templateCache struct {
+	cache map[string]*templateCacheEntry
+	sets  map[string][]string
+	funcs template.FuncMap
+	mutex sync.RWMutex
+}
+
+// newTemplateCache creates a new cache with the functions.
+func newTemplateCache(funcs template.FuncMap) *templateCache {
+	return &templateCache{
+		cache: make(map[string]*templateCacheEntry),
+		sets:  make(map[string][]string),
+		funcs: funcs,
+	}
+}
+
+// addFuncs adds functions for the templates parsed afterwards.
+func (tc *templateCache) addFuncs(funcs template.FuncMap) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	for name, f := range funcs {
+		tc.funcs[name] = f
+	}
+}
+
+// parse parses a template an stores it.
+func (tc *templateCache) parse(id, t, ct string) error {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	tmpl, err := template.New(id).Funcs(tc.funcs).Parse(t)
+	if err != nil {
+		return err
+	}
+	tc.cache[id] = &templateCacheEntry{parsedTemplate: tmpl, contentType: ct}
+	return nil
+}
+
+// loadAndParse loads a template out of the filesystem, parses and stores it.
+func (tc *templateCache) loadAndParse(id, fn, ct string) error {
+	return tc.load(id, ct, []string{fn})
+}
+
+// defineSet defines a template set. The files are parsed to check them.
+func (tc *templateCache) defineSet(set, layout string, partials []string) error {
+	filenames := append([]string{layout}, partials...)
+	tc.mutex.RLock()
+	_, _, err := parseFiles(set, tc.funcs, filenames)
+	tc.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	tc.sets[set] = filenames
+	return nil
+}
+
+// loadAndParseInSet loads a template, parses it together with the
+// files of the set and stores it.
+func (tc *templateCache) loadAndParseInSet(id, set, fn, ct string) error {
+	tc.mutex.RLock()
+	filenames, ok := tc.sets[set]
+	tc.mutex.RUnlock()
+	if !ok {
+		return fmt.Errorf("web: template set %q not found", set)
+	}
+	return tc.load(id, ct, append(append([]string{}, filenames...), fn))
+}
+
+// load parses the files and stores them as template.
+func (tc *templateCache) load(id, ct string, filenames []string) error {
+	tc.mutex.RLock()
+	tmpl, modTimes, err := parseFiles(id, tc.funcs, filenames)
+	tc.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	tc.cache[id] = &templateCacheEntry{tmpl, ct, filenames, modTimes}
+	return nil
+}
+
+// reload parses the templates again whose files have changed.
+// Templates which cannot be parsed are kept.
+func (tc *templateCache) reload() {
+	tc.mutex.RLock()
+	changed := make(map[string]*templateCacheEntry)
+	for id, entry := range tc.cache {
+		for i, fn := range entry.filenames {
+			fi, err := os.Stat(fn)
+			if err != nil || !fi.ModTime().Equal(entry.modTimes[i]) {
+				changed[id] = entry
+				break
+			}
+		}
+	}
+	tc.mutex.RUnlock()
+	for id, entry := range changed {
+		if err := tc.load(id, entry.contentType, entry.filenames); err != nil {
+			applog.Errorf("cannot reload template %q: %v", id, err)
+			continue
+		}
+		applog.Infof("reloaded template %q", id)
+	}
+}
+
+// watch reloads changed templates in the interval until
+// the stop channel is closed.
+func (tc *templateCache) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			tc.reload()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// execute executes the pre-parsed template with the data
+// and writes the result to the writer.
+func (tc *templateCache) execute(w io.Writer, id string, data interface{}) error {
+	tc.mutex.RLock()
+	entry, ok := tc.cache[id]
+	tc.mutex.RUnlock()
+	if !ok {
+		return fmt.Errorf("template %q not found", id)
+	}
+	return entry.parsedTemplate.Execute(w, data)
+}
+
+// render executes the pre-parsed template with the data. It also sets
+// the content type header.
+func (tc *templateCache) render(rw http.ResponseWriter, id string, data interface{}) {
+	tc.mutex.RLock()
+	entry, ok := tc.cache[id]
+	tc.mutex.RUnlock()
+	if !ok {
+		http.Error(rw, fmt.Sprintf("template %q not found", id), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", entry.contentType)
+	err := entry.parsedTemplate.Execute(rw, data)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// parseFiles parses the files into one template named by the id.
+// The first file is its content, the others are associated templates
+// named by their base names. They are able to define or redefine
+// further templates, so the first one can be a layout.
+func parseFiles(id string, funcs template.FuncMap, filenames []string) (*template.Template, []time.Time, error) {
+	root := template.New(id).Funcs(funcs)
+	modTimes := make([]time.Time, len(filenames))
+	for i, fn := range filenames {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return nil, nil, err
+		}
+		modTimes[i] = fi.ModTime()
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, nil, err
+		}
+		tmpl := root
+		if i > 0 {
+			tmpl = root.New(filepath.Base(fn))
+		}
+		if _, err = tmpl.Parse(string(b)); err != nil {
+			return nil, nil, err
+		}
+	}
+	return root, modTimes, nil
+}
+
+// EOF
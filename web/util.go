@@ -15,11 +15,8 @@ import (
 	"encoding/gob"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"net/url"
-	"sync"
-	"text/template"
 )
 
 //--------------------
@@ -32,6 +29,13 @@ const (
 	CT_XML   = "application/xml"
 	CT_JSON  = "application/json"
 	CT_GOB   = "application/vnd.tideland.gob"
+	CT_SML   = "application/vnd.tideland.sml"
+
+	CT_FORM      = "application/x-www-form-urlencoded"
+	CT_MULTIPART = "multipart/form-data"
+
+	CT_PROBLEM_JSON = "application/problem+json"
+	CT_PROBLEM_XML  = "application/problem+xml"
 )
 
 //--------------------
@@ -55,7 +59,12 @@ func (kv KeyValue) String() string {
 
 // HtmlInternalReference builds an internal reference out of the passed parts.
 func HtmlInternalReference(domain, resource, resourceId string, query ...KeyValue) string {
-	ref := BasePath() + domain + "/" + resource
+	return internalReference(BasePath(), domain, resource, resourceId, query...)
+}
+
+// internalReference builds an internal reference relative to the base path.
+func internalReference(basePath, domain, resource, resourceId string, query ...KeyValue) string {
+	ref := basePath + domain + "/" + resource
 	if resourceId != "" {
 		ref = ref + "/" + resourceId
 	}
@@ -86,59 +95,4 @@ func StreamAsGob(w io.Writer, h http.Header, data interface{}) error {
 	return err
 }
 
-//--------------------
-// TEMPLATE CACHE
-//--------------------
-
-// templateCacheEntry stores the parsed template and the
-// content type.
-type templateCacheEntry struct {
-	parsedTemplate *template.Template
-	contentType    string
-}
-
-// templateCache stores preparsed templates.
-type templateCache struct {
-	cache map[string]*templateCacheEntry
-	mutex sync.RWMutex
-}
-
-// newTemplateCache creates a new cache.
-func newTemplateCache() *templateCache {
-	return &templateCache{
-		cache: make(map[string]*templateCacheEntry),
-	}
-}
-
-// parse parses a template an stores it.
-func (tc *templateCache) parse(id, t, ct string) {
-	tc.mutex.Lock()
-	defer tc.mutex.Unlock()
-
-	tmpl, err := template.New(id).Parse(t)
-	if err != nil {
-		panic(err)
-	}
-	tc.cache[id] = &templateCacheEntry{tmpl, ct}
-}
-
-// loadAndParse loads a template out of the filesystem, parses and stores it.
-func (tc *templateCache) loadAndParse(id, fn, ct string) {
-	t, _ := ioutil.ReadFile(fn)
-	tc.parse(id, string(t), ct)
-}
-
-// render executes the pre-parsed template with the data. It also sets
-// the content type header.
-func (tc *templateCache) render(rw http.ResponseWriter, id string, data interface{}) {
-	tc.mutex.RLock()
-	defer tc.mutex.RUnlock()
-
-	rw.Header().Set("Content-Type", tc.cache[id].contentType)
-	err := tc.cache[id].parsedTemplate.Execute(rw, data)
-	if err != nil {
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
-	}
-}
-
 // EOF
@@ -13,11 +13,11 @@ package web
 
 import (
 	"cgl.tideland.biz/applog"
-	"cgl.tideland.biz/identifier"
-	"cgl.tideland.biz/monitoring"
-	"fmt"
+	"context"
+	"net"
 	"net/http"
-	"strings"
+	"text/template"
+	"time"
 )
 
 //--------------------
@@ -64,95 +64,28 @@ type resourceMapping map[string]handlerSlice
 type domainMapping map[string]resourceMapping
 
 //--------------------
-// SERVER
+// DEFAULT SERVER
 //--------------------
 
-// Server is the backend of the web package.
-type server struct {
-	address         string
-	basePath        string
-	defaultDomain   string
-	defaultResource string
-	domains         domainMapping
-	templateCache   *templateCache
-}
-
-// The central server.
-var srv *server
+// The default server used by the package functions.
+var srv *Server
 
-// lazyCreateServer creates the central server instance
-// configuration and work if this isn't yet done.
+// lazyCreateServer creates the default server instance
+// if this isn't yet done.
 func lazyCreateServer() {
 	if srv == nil {
-		// Create the server.
-		srv = &server{
-			basePath:        "/",
-			defaultDomain:   "default",
-			defaultResource: "default",
-			domains:         make(domainMapping),
-			templateCache:   newTemplateCache(),
-		}
-	}
-}
-
-// prepareServer prepares the server based on the passed
-// configuration information.
-func prepareServer(address, basePath string) {
-	srv.address = address
-	srv.basePath = basePath
-	// Check passed parameters.
-	if srv.address == "" {
-		srv.address = ":8080"
-	}
-	if !strings.HasSuffix(srv.basePath, "/") {
-		srv.basePath += "/"
-	}
-}
-
-// handleFunc is the main function of the web server dispatching the
-// requests to registered resource handler.
-func handleFunc(rw http.ResponseWriter, r *http.Request) {
-	ctx := newContext(rw, r)
-	resources := srv.domains[ctx.Domain]
-	if resources != nil {
-		handlers := resources[ctx.Resource]
-		if handlers != nil {
-			m := monitoring.BeginMeasuring(identifier.Identifier("web", ctx.Domain, ctx.Resource, ctx.Request.Method))
-			for _, h := range handlers {
-				if !dispatch(ctx, h) {
-					break
-				}
-			}
-			m.EndMeasuring()
-			return
-		}
-	}
-	// No valid configuration, redirect to default (if not already).
-	if ctx.Domain == srv.defaultDomain && ctx.Resource == srv.defaultResource {
-		// No default handler registered.
-		msg := fmt.Sprintf("domain '%v' and resource '%v' not found!", ctx.Domain, ctx.Resource)
-		applog.Errorf(msg)
-		http.Error(ctx.ResponseWriter, msg, http.StatusNotFound)
-	} else {
-		// Redirect to default handler.
-		applog.Warningf("domain '%v' and resource '%v' not found, redirecting to default", ctx.Domain, ctx.Resource)
-		ctx.Redirect(srv.defaultDomain, srv.defaultResource, "")
+		srv = NewServer("", "/")
 	}
 }
 
 // Dispatch the encapsulated request to the according handler methods
-// depending on the HTTP method.
+// depending on the HTTP method, or to the WebSocket handler if the
+// request asks for an upgrade. Panics are handled by the server.
 func dispatch(ctx *Context, h ResourceHandler) bool {
-	defer func() {
-		if err := recover(); err != nil {
-			// Shit happens! TODO: Better error handling.
-			msg := fmt.Sprintf("internal server error: '%v' in context: '%v'", err, ctx)
-			applog.Criticalf(msg)
-			http.Error(ctx.ResponseWriter, msg, http.StatusInternalServerError)
-		}
-	}()
-
 	applog.Infof("dispatching %s", ctx)
+	if wh, ok := h.(WebSocketResourceHandler); ok && isWebSocketUpgrade(ctx.Request) {
+		return handleWebSocket(ctx, wh)
+	}
 	switch ctx.Request.Method {
 	case "GET":
 		return h.Get(ctx)
@@ -169,69 +102,117 @@ func dispatch(ctx *Context, h ResourceHandler) bool {
 			return dh.Delete(ctx)
 		}
 	}
-	applog.Errorf("method not allowed: %s", ctx)
-	http.Error(ctx.ResponseWriter, "405 method not allowed", http.StatusMethodNotAllowed)
-	return false
+	return ctx.Error(NewHTTPError(http.StatusMethodNotAllowed, ""))
 }
 
 // StartServer has to be called with address and base path for the
 // server. The resource handlers should be registered before but can also
-// be added dynamically.
-func StartServer(address, basePath string) {
+// be added dynamically. The default server is registered at the
+// http.DefaultServeMux which is served until Shutdown() is called.
+func StartServer(address, basePath string) error {
 	lazyCreateServer()
-	prepareServer(address, basePath)
-	http.HandleFunc(srv.basePath, handleFunc)
-	http.ListenAndServe(srv.address, nil)
+	srv.prepare(address, basePath)
+	http.Handle(srv.BasePath(), srv)
+	l, err := net.Listen("tcp", srv.Address())
+	if err != nil {
+		return err
+	}
+	return srv.serve(l, http.DefaultServeMux)
+}
+
+// Shutdown gracefully stops the default server, see Server.Shutdown().
+func Shutdown(ctx context.Context) error {
+	lazyCreateServer()
+	return srv.Shutdown(ctx)
 }
 
 // SetDefault configures own default domain and resource ids.
 func SetDefault(domain, resource string) {
 	lazyCreateServer()
-	srv.defaultDomain = domain
-	srv.defaultResource = resource
+	srv.SetDefault(domain, resource)
 }
 
 // AttachToAppEngine initializes as attaches the web package to the
 // Google App Engine.
 func AttachToAppEngine(basePath string) {
 	lazyCreateServer()
-	prepareServer("", basePath)
-	http.HandleFunc(srv.basePath, handleFunc)
+	srv.prepare("", basePath)
+	http.Handle(srv.BasePath(), srv)
 }
 
 // AddResourceHandler assigns a resource handler to a domain and
-// resource id. An existing one would be overwritten.
+// resource id of the default server.
 func AddResourceHandler(domain, resource string, handler ResourceHandler) ResourceHandler {
 	lazyCreateServer()
-	// Map domain to resources.
-	resources := srv.domains[domain]
-	if resources == nil {
-		resources = make(resourceMapping)
-		srv.domains[domain] = resources
-	}
-	// Map resource to handlers.
-	handlers := resources[resource]
-	if handlers == nil {
-		handlers := make(handlerSlice, 1)
-		resources[resource] = handlers
-	}
-	// Add and init handler.
-	resources[resource] = append(handlers, handler)
-	handler.Init(domain, resource)
-	return handler
+	return srv.AddResourceHandler(domain, resource, handler)
+}
+
+// AddRoute assigns a handler function to a path pattern of the
+// default server, see Server.AddRoute().
+func AddRoute(pattern string, handler HandlerFunc, methods ...string) {
+	lazyCreateServer()
+	srv.AddRoute(pattern, handler, methods...)
+}
+
+// SetErrorRenderer sets the error renderer of the default server.
+func SetErrorRenderer(renderer ErrorRenderer) {
+	lazyCreateServer()
+	srv.SetErrorRenderer(renderer)
+}
+
+// RegisterEncoder registers an encoder at the default server,
+// see Server.RegisterEncoder().
+func RegisterEncoder(contentType string, encoder Encoder) {
+	lazyCreateServer()
+	srv.RegisterEncoder(contentType, encoder)
+}
+
+// Use adds middlewares to the default server.
+func Use(middlewares ...Middleware) {
+	lazyCreateServer()
+	srv.Use(middlewares...)
+}
+
+// AddTemplateFuncs adds template functions to the default server,
+// see Server.AddTemplateFuncs().
+func AddTemplateFuncs(funcs template.FuncMap) {
+	lazyCreateServer()
+	srv.AddTemplateFuncs(funcs)
 }
 
 // ParseTemplate parses a template and stores it together with the 
 // content type in the cache.
-func ParseTemplate(templateId, template, contentType string) {
-	srv.templateCache.parse(templateId, template, contentType)
+func ParseTemplate(templateId, template, contentType string) error {
+	lazyCreateServer()
+	return srv.ParseTemplate(templateId, template, contentType)
 }
 
 // LoadAndParseTemplate loads a file, parses a template and stores it 
 // together with the content type in the cache.
-func LoadAndParseTemplate(templateId, filename, contentType string) {
+func LoadAndParseTemplate(templateId, filename, contentType string) error {
+	lazyCreateServer()
+	return srv.LoadAndParseTemplate(templateId, filename, contentType)
+}
+
+// DefineTemplateSet defines a template set of the default server,
+// see Server.DefineTemplateSet().
+func DefineTemplateSet(setId, layout string, partials ...string) error {
+	lazyCreateServer()
+	return srv.DefineTemplateSet(setId, layout, partials...)
+}
+
+// LoadAndParseSetTemplate loads a template of a set of the default
+// server, see Server.LoadAndParseSetTemplate().
+func LoadAndParseSetTemplate(templateId, setId, filename, contentType string) error {
+	lazyCreateServer()
+	return srv.LoadAndParseSetTemplate(templateId, setId, filename, contentType)
+}
+
+// WatchTemplates reloads changed templates of the default server,
+// see Server.WatchTemplates().
+func WatchTemplates(interval time.Duration) {
 	lazyCreateServer()
-	srv.templateCache.loadAndParse(templateId, filename, contentType)
+	srv.WatchTemplates(interval)
 }
 
 // BasePath returns the configured base path of the server. It's
@@ -239,7 +220,7 @@ func LoadAndParseTemplate(templateId, filename, contentType string) {
 // start of the server.
 func BasePath() string {
 	lazyCreateServer()
-	return srv.basePath
+	return srv.BasePath()
 }
 
 // EOF
\ No newline at end of file
@@ -14,32 +14,48 @@ package web
 import (
 	"cgl.tideland.biz/applog"
 	"cgl.tideland.biz/asserts"
+	"cgl.tideland.biz/markup"
+	"cgl.tideland.biz/monitoring"
+	"cgl.tideland.biz/redis"
+	"cgl.tideland.biz/redis/redistest"
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"text/template"
+	"time"
 )
 
 //--------------------
 // HELPER FUNCTIONS
 //--------------------
 
-// Start the internal test server.
-func startTestServer() *httptest.Server {
-	lazyCreateServer()
-	prepareServer("", "")
-	return httptest.NewServer(http.HandlerFunc(handleFunc))
-}
-
 // Type for the header.
 type Hdr map[string]string
 
 // Perform any local request.
 func localDo(method string, ts *httptest.Server, path string, hdr Hdr, body []byte) ([]byte, error) {
+	_, respBody, err := localResponse(method, ts, path, hdr, body)
+	return respBody, err
+}
+
+// Perform any local request and also return the response.
+func localResponse(method string, ts *httptest.Server, path string, hdr Hdr, body []byte) (*http.Response, []byte, error) {
 	// First prepare it.
 	tr := &http.Transport{}
 	c := &http.Client{Transport: tr}
@@ -50,7 +66,7 @@ func localDo(method string, ts *httptest.Server, path string, hdr Hdr, body []by
 	}
 	req, err := http.NewRequest(method, url, bodyReader)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	for k, v := range hdr {
 		req.Header.Set(k, v)
@@ -58,11 +74,11 @@ func localDo(method string, ts *httptest.Server, path string, hdr Hdr, body []by
 	// Now do it.
 	resp, err := c.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	respBody, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
-	return respBody, err
+	return resp, respBody, err
 }
 
 //--------------------
@@ -97,15 +113,17 @@ type TestData struct {
 	Count int64
 }
 
-type TestHandler struct{}
+type TestHandler struct {
+	server *Server
+}
 
-func NewTestHandler() *TestHandler {
-	return &TestHandler{}
+func NewTestHandler(s *Server) *TestHandler {
+	return &TestHandler{s}
 }
 
 func (th *TestHandler) Init(domain, resource string) {
-	ParseTemplate("test:context:xml", TEST_TMPL_XML, "application/xml")
-	ParseTemplate("test:context:html", TEST_TMPL_HTML, "text/html")
+	th.server.ParseTemplate("test:context:xml", TEST_TMPL_XML, "application/xml")
+	th.server.ParseTemplate("test:context:html", TEST_TMPL_HTML, "text/html")
 }
 
 func (th *TestHandler) Get(ctx *Context) bool {
@@ -161,8 +179,10 @@ func (th *TestHandler) Delete(ctx *Context) bool {
 func TestGetXML(t *testing.T) {
 	assert := asserts.NewTestingAsserts(t, true)
 	// Prepare the server.
-	AddResourceHandler("test", "getxml", NewTestHandler())
-	ts := startTestServer()
+	s := NewServer("", "/")
+	s.AddResourceHandler("test", "getxml", NewTestHandler(s))
+	ts := httptest.NewServer(s)
+	defer ts.Close()
 	// Now the request.
 	body, err := localDo("GET", ts, "/test/getxml/4711", Hdr{"Accept": "application/xml"}, nil)
 	assert.Nil(err, "Local XML GET.")
@@ -173,8 +193,10 @@ func TestGetXML(t *testing.T) {
 func TestGetJSON(t *testing.T) {
 	assert := asserts.NewTestingAsserts(t, true)
 	// Prepare the server.
-	AddResourceHandler("test", "getjson", NewTestHandler())
-	ts := startTestServer()
+	s := NewServer("", "/")
+	s.AddResourceHandler("test", "getjson", NewTestHandler(s))
+	ts := httptest.NewServer(s)
+	defer ts.Close()
 	// Now the request.
 	body, err := localDo("GET", ts, "/test/getjson/4711", Hdr{"Accept": "application/json"}, nil)
 	assert.Nil(err, "Local JSON GET.")
@@ -188,8 +210,10 @@ func TestGetJSON(t *testing.T) {
 func TestPutJSON(t *testing.T) {
 	assert := asserts.NewTestingAsserts(t, true)
 	// Prepare the server.
-	AddResourceHandler("test", "putjson", NewTestHandler())
-	ts := startTestServer()
+	s := NewServer("", "/")
+	s.AddResourceHandler("test", "putjson", NewTestHandler(s))
+	ts := httptest.NewServer(s)
+	defer ts.Close()
 	// Now the request.
 	inData := map[string]interface{}{"alpha": "foo", "beta": 4711.0, "gamma": true}
 	b, _ := json.Marshal(inData)
@@ -207,8 +231,10 @@ func TestPutJSON(t *testing.T) {
 func TestPutGob(t *testing.T) {
 	assert := asserts.NewTestingAsserts(t, true)
 	// Prepare the server.
-	AddResourceHandler("test", "putgob", NewTestHandler())
-	ts := startTestServer()
+	s := NewServer("", "/")
+	s.AddResourceHandler("test", "putgob", NewTestHandler(s))
+	ts := httptest.NewServer(s)
+	defer ts.Close()
 	// Now the request.
 	inData := TestData{"test", 4711}
 	b := new(bytes.Buffer)
@@ -227,20 +253,1200 @@ func TestPutGob(t *testing.T) {
 func TestRedirectDefault(t *testing.T) {
 	assert := asserts.NewTestingAsserts(t, true)
 	// Prepare the server.
-	AddResourceHandler("default", "default", NewTestHandler())
-	ts := startTestServer()
+	s := NewServer("", "/")
+	s.AddResourceHandler("default", "default", NewTestHandler(s))
+	ts := httptest.NewServer(s)
+	defer ts.Close()
 	// Now the request.
 	body, err := localDo("GET", ts, "/x/y", Hdr{}, nil)
 	assert.Nil(err, "Local unknown GET for redirect.")
 	assert.Substring(string(body), "<dd>default</dd>", "XML result.")
 }
 
+// Test routes with parameters, wildcards and methods.
+func TestRoutes(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	// Prepare the server.
+	s := NewServer("", "/")
+	methods := []string{"GET", "put"}
+	s.AddRoute("/routes/users/{user}/items/{item}", func(ctx *Context) error {
+		ctx.ResponseWriter.Write([]byte(ctx.Parameter("user") + ":" + ctx.Parameter("item")))
+		return nil
+	}, methods...)
+	assert.Equal(methods, []string{"GET", "put"}, "Passed methods are unchanged.")
+	s.AddRoute("routes/files/*path", func(ctx *Context) error {
+		ctx.ResponseWriter.Write([]byte(ctx.Parameter("path")))
+		return nil
+	})
+	s.AddRoute("routes/failing", func(ctx *Context) error {
+		return errors.New("ouch")
+	})
+	s.AddResourceHandler("routes", "resource", NewTestHandler(s))
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	// Now the requests.
+	body, err := localDo("GET", ts, "/routes/users/alice/items/42", Hdr{}, nil)
+	assert.Nil(err, "Local route GET.")
+	assert.Equal(string(body), "alice:42", "Parameters have been matched.")
+	body, _ = localDo("PUT", ts, "/routes/users/bob/items/1/", Hdr{}, nil)
+	assert.Equal(string(body), "bob:1", "Trailing slash is ignored.")
+	resp, _, err := localResponse("DELETE", ts, "/routes/users/alice/items/42", Hdr{}, nil)
+	assert.Nil(err, "Local route DELETE.")
+	assert.Equal(resp.StatusCode, http.StatusMethodNotAllowed, "Method is not allowed.")
+	assert.Equal(resp.Header.Get("Allow"), "GET, PUT", "Allowed methods are returned.")
+	body, _ = localDo("GET", ts, "/routes/files/css/main.css", Hdr{}, nil)
+	assert.Equal(string(body), "css/main.css", "Wildcard matches the rest of the path.")
+	body, _ = localDo("GET", ts, "/routes/files", Hdr{}, nil)
+	assert.Equal(string(body), "", "Wildcard matches an empty rest.")
+	resp, body, _ = localResponse("GET", ts, "/routes/failing", Hdr{}, nil)
+	assert.Equal(resp.StatusCode, http.StatusInternalServerError, "Error leads to internal server error.")
+	assert.Equal(string(body), "500 internal server error\n", "Error is not returned.")
+	body, _ = localDo("GET", ts, "/routes/resource/4711", Hdr{"Accept": "application/xml"}, nil)
+	assert.Substring(string(body), "<resourceId>4711</resourceId>", "Resource handler still works.")
+}
+
+// Test the middleware chain.
+func TestMiddleware(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	// Prepare the server.
+	s := NewServer("", "/")
+	trace := func(name string) Middleware {
+		return func(h HandlerFunc) HandlerFunc {
+			return func(ctx *Context) error {
+				ctx.ResponseWriter.Header().Add("X-Trace", name)
+				if ctx.Request.Header.Get("X-Block") == name {
+					http.Error(ctx.ResponseWriter, "blocked by "+name, http.StatusForbidden)
+					return nil
+				}
+				return h(ctx)
+			}
+		}
+	}
+	s.Use(trace("outer"), trace("inner"))
+	s.AddRoute("middleware", func(ctx *Context) error {
+		ctx.ResponseWriter.Write([]byte("handled"))
+		return nil
+	})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	// Now the requests.
+	resp, body, err := localResponse("GET", ts, "/middleware", Hdr{}, nil)
+	assert.Nil(err, "Local middleware GET.")
+	assert.Equal(string(body), "handled", "Request has been handled.")
+	assert.Equal(resp.Header["X-Trace"], []string{"outer", "inner"}, "Middlewares have been called in order.")
+	resp, body, _ = localResponse("GET", ts, "/middleware", Hdr{"X-Block": "inner"}, nil)
+	assert.Equal(resp.StatusCode, http.StatusForbidden, "Middleware answered the request.")
+	assert.Equal(string(body), "blocked by inner\n", "Handler has not been called.")
+}
+
+// Test the handling and rendering of errors.
+func TestErrors(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	// Prepare the server.
+	s := NewServer("", "/")
+	s.AddRoute("errors/typed", func(ctx *Context) error {
+		return &HTTPError{Status: http.StatusConflict, Detail: "version <2> is outdated", Err: errors.New("internal cause")}
+	})
+	s.AddRoute("errors/percent", func(ctx *Context) error {
+		return NewHTTPError(http.StatusBadRequest, "100% is too much")
+	})
+	s.AddRoute("errors/panic", func(ctx *Context) error {
+		panic("secret internals")
+	})
+	s.AddResourceHandler("errors", "resource", NewWrapperHandler(func(rw http.ResponseWriter, r *http.Request) {
+		panic("secret internals")
+	}))
+	s.AddResourceHandler("errors", "files", NewFileServingHandler("."))
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	// Now the requests.
+	resp, body, err := localResponse("GET", ts, "/errors/typed", Hdr{"Accept": "application/json"}, nil)
+	assert.Nil(err, "Local JSON GET.")
+	assert.Equal(resp.StatusCode, http.StatusConflict, "Status of the typed error.")
+	assert.Equal(resp.Header.Get("Content-Type"), CT_PROBLEM_JSON, "Problem details content type.")
+	p := Problem{}
+	err = json.Unmarshal(body, &p)
+	assert.Nil(err, "Unmarshal of the problem details.")
+	assert.Equal(p, Problem{Title: "Conflict", Status: 409, Detail: "version <2> is outdated", Instance: "/errors/typed"}, "Problem details.")
+	_, body, _ = localResponse("GET", ts, "/errors/typed", Hdr{"Accept": "application/xml"}, nil)
+	assert.Substring(string(body), "<detail>version &lt;2&gt; is outdated</detail>", "XML problem details.")
+	_, body, _ = localResponse("GET", ts, "/errors/typed", Hdr{"Accept": "text/html"}, nil)
+	assert.Substring(string(body), "<h1>409 Conflict</h1>", "HTML error page.")
+	assert.Substring(string(body), "<p>version &lt;2&gt; is outdated</p>", "HTML detail is escaped.")
+	_, body, _ = localResponse("GET", ts, "/errors/typed", Hdr{}, nil)
+	assert.Equal(string(body), "409 conflict: version <2> is outdated\n", "Plain text error.")
+	resp, body, _ = localResponse("GET", ts, "/errors/typed", Hdr{"Accept": "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"}, nil)
+	assert.Equal(resp.Header.Get("Content-Type"), CT_HTML+"; charset=utf-8", "Browsers get the HTML error page.")
+	resp, _, _ = localResponse("GET", ts, "/errors/typed", Hdr{"Accept": "text/html;q=0.5, application/json"}, nil)
+	assert.Equal(resp.Header.Get("Content-Type"), CT_PROBLEM_JSON, "Higher value wins.")
+	resp, _, _ = localResponse("GET", ts, "/errors/typed", Hdr{"Accept": "application/xml, application/json"}, nil)
+	assert.Equal(resp.Header.Get("Content-Type"), CT_PROBLEM_XML, "Earlier content type wins for equal values.")
+	resp, body, _ = localResponse("GET", ts, "/errors/percent", Hdr{}, nil)
+	assert.Equal(string(body), "400 bad request: 100% is too much\n", "Detail without arguments isn't formatted.")
+	for _, path := range []string{"/errors/panic", "/errors/resource"} {
+		resp, body, _ = localResponse("GET", ts, path, Hdr{}, nil)
+		assert.Equal(resp.StatusCode, http.StatusInternalServerError, "Panic leads to internal server error.")
+		assert.Equal(string(body), "500 internal server error\n", "Panic is not echoed.")
+	}
+	// Own renderer.
+	s.SetErrorRenderer(func(ctx *Context, err *HTTPError) {
+		ctx.ResponseWriter.WriteHeader(err.Status)
+		ctx.ResponseWriter.Write([]byte("own renderer"))
+	})
+	defer SetErrorRenderer(RenderError)
+	resp, body, _ = localResponse("DELETE", ts, "/errors/files/web.go", Hdr{}, nil)
+	assert.Equal(resp.StatusCode, http.StatusMethodNotAllowed, "Method is not allowed.")
+	assert.Equal(string(body), "own renderer", "Own renderer has been used.")
+}
+
+// Test independent server instances.
+func TestServerInstances(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	// Prepare the servers.
+	serverA := NewServer("", "/a/")
+	serverA.AddResourceHandler("test", "instance", NewWrapperHandler(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("server a"))
+	}))
+	serverB := NewServer("", "/b")
+	serverB.AddRoute("test/instance", func(ctx *Context) error {
+		ctx.ResponseWriter.Write([]byte("server b"))
+		return nil
+	})
+	serverB.SetDefault("test", "instance")
+	tsA := httptest.NewServer(serverA)
+	defer tsA.Close()
+	tsB := httptest.NewServer(serverB)
+	defer tsB.Close()
+	// Now the requests.
+	body, err := localDo("GET", tsA, "/a/test/instance", Hdr{}, nil)
+	assert.Nil(err, "Local GET of server a.")
+	assert.Equal(string(body), "server a", "Server a handled the request.")
+	body, err = localDo("GET", tsB, "/b/test/instance", Hdr{}, nil)
+	assert.Nil(err, "Local GET of server b.")
+	assert.Equal(string(body), "server b", "Server b handled the request.")
+	resp, _, _ := localResponse("GET", tsA, "/a/test/none", Hdr{}, nil)
+	assert.Equal(resp.StatusCode, http.StatusNotFound, "Server a has no default handler.")
+	body, _ = localDo("GET", tsB, "/b/test/none", Hdr{}, nil)
+	assert.Equal(string(body), "server b", "Server b redirected to its default.")
+	for _, path := range []string{"/", "/b", "/other/test/instance"} {
+		resp, _, err := localResponse("GET", tsB, path, Hdr{}, nil)
+		assert.Nil(err, "Local GET outside of the base path "+path)
+		assert.Equal(resp.StatusCode, http.StatusNotFound, "Path outside of the base path is not found.")
+	}
+}
+
+// Test the graceful shutdown of a server.
+func TestShutdown(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	// Prepare the server.
+	started := make(chan bool)
+	release := make(chan bool)
+	s := NewServer("", "/")
+	s.AddRoute("slow", func(ctx *Context) error {
+		close(started)
+		<-release
+		ctx.ResponseWriter.Write([]byte("done"))
+		return nil
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err, "Listener has been created.")
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.Serve(l)
+	}()
+	// Start a slow request and shut down meanwhile.
+	respBody := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/slow")
+		if err != nil {
+			respBody <- err.Error()
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		respBody <- string(body)
+	}()
+	<-started
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.Shutdown(context.Background())
+	}()
+	select {
+	case <-shutdownErr:
+		assert.Fail("Shutdown returned before the request is done.")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	assert.Equal(<-respBody, "done", "Request in flight has been finished.")
+	assert.Nil(<-shutdownErr, "Shutdown has been successful.")
+	assert.Equal(<-serveErr, http.ErrServerClosed, "Serving has ended.")
+	// Requests after the shutdown.
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/slow", nil)
+	s.ServeHTTP(rec, req)
+	assert.Equal(rec.Code, http.StatusServiceUnavailable, "Server doesn't accept new requests.")
+}
+
+// Test the content negotiation.
+func TestRespond(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	// Prepare the server.
+	s := NewServer("", "/")
+	s.ParseTemplate("respond:html", "<p>{{.Id}}: {{.Count}}</p>", CT_HTML)
+	s.RegisterEncoder(CT_HTML, TemplateEncoder("respond:html"))
+	s.AddRoute("respond/data", func(ctx *Context) error {
+		return ctx.Respond(http.StatusCreated, &TestData{"foo", 4711})
+	})
+	s.AddRoute("respond/markup", func(ctx *Context) error {
+		root := markup.NewTagNode("test")
+		root.AppendTextNode("foo")
+		return ctx.Respond(http.StatusOK, root)
+	})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	// Now the requests.
+	tests := []struct {
+		path        string
+		accept      string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"/respond/data", "", 201, CT_JSON, `{"Id":"foo","Count":4711}`},
+		{"/respond/data", "application/json", 201, CT_JSON, `{"Id":"foo","Count":4711}`},
+		{"/respond/data", "application/json;q=0.5, application/xml;q=0.9", 201, CT_XML, "<TestData><Id>foo</Id><Count>4711</Count></TestData>"},
+		{"/respond/data", "text/*;q=0.8, application/json;q=0.1", 201, CT_HTML, "<p>foo: 4711</p>"},
+		{"/respond/data", "application/json;q=0, */*", 201, CT_XML, "<TestData>"},
+		{"/respond/data", "image/png", 406, CT_PLAIN + "; charset=utf-8", "406 not acceptable: available content types are"},
+		{"/respond/data", CT_SML, 406, CT_PLAIN + "; charset=utf-8", "406 not acceptable"},
+		{"/respond/markup", CT_SML, 200, CT_SML, "{test foo}"},
+	}
+	for _, test := range tests {
+		resp, body, err := localResponse("GET", ts, test.path, Hdr{"Accept": test.accept}, nil)
+		assert.Nil(err, "Local GET for "+test.accept)
+		assert.Equal(resp.StatusCode, test.status, "Status for "+test.accept)
+		assert.Equal(resp.Header.Get("Content-Type"), test.contentType, "Content type for "+test.accept)
+		assert.Equal(resp.Header.Get("Vary"), "Accept", "Vary header for "+test.accept)
+		assert.Substring(string(body), test.body, "Body for "+test.accept)
+	}
+	// Quality values.
+	cts := parseContentTypes("text/html;level=1;q=0.7, text/*;q=0.3, */*;q=0.1")
+	assert.Length(cts, 3, "All content types have been parsed.")
+	assert.Equal(cts.Value("text/html"), 0.7, "Exact match has priority.")
+	assert.Equal(cts.Value("text/plain"), 0.3, "Type range matches.")
+	assert.Equal(cts.Value("image/png"), 0.1, "Any range matches.")
+}
+
+// Test the sessions.
+func TestSessions(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	// Prepare the server.
+	sm := NewSessionManager(SessionConfiguration{Secret: []byte("secret")})
+	s := NewServer("", "/")
+	s.Use(sm.Middleware())
+	s.AddRoute("session/set/{value}", func(ctx *Context) error {
+		session, err := ctx.Session()
+		if err != nil {
+			return err
+		}
+		session.Set("value", ctx.Parameter("value"))
+		session.AddFlash("value set")
+		return nil
+	})
+	s.AddRoute("session/get", func(ctx *Context) error {
+		session, err := ctx.Session()
+		if err != nil {
+			return err
+		}
+		value, _ := session.Get("value")
+		ctx.ResponseWriter.Write([]byte(value + " " + strings.Join(session.Flashes(), ",")))
+		return nil
+	})
+	s.AddRoute("session/login", func(ctx *Context) error {
+		session, err := ctx.Session()
+		if err != nil {
+			return err
+		}
+		if err = session.Rotate(); err != nil {
+			return err
+		}
+		ctx.ResponseWriter.Write([]byte(session.ID()))
+		return nil
+	})
+	s.AddRoute("session/logout", func(ctx *Context) error {
+		session, err := ctx.Session()
+		if err != nil {
+			return err
+		}
+		session.Destroy()
+		return nil
+	})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	jar, _ := cookiejar.New(nil)
+	c := &http.Client{Jar: jar}
+	get := func(path string) string {
+		resp, err := c.Get(ts.URL + path)
+		assert.Nil(err, "Local GET of "+path)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(body)
+	}
+	// Values and flashes.
+	get("/session/set/foo")
+	assert.Equal(get("/session/get"), "foo value set", "Value and flash are returned.")
+	assert.Equal(get("/session/get"), "foo ", "Flash is returned only once.")
+	// Rotation keeps the values, but the old id is invalid.
+	oldId, _ := sm.verify(sessionCookie(jar, ts).Value)
+	newId := get("/session/login")
+	assert.Different(oldId, newId, "Session id has been rotated.")
+	assert.Equal(get("/session/get"), "foo ", "Value survived the rotation.")
+	data, err := sm.configuration.Store.Load(oldId)
+	assert.Nil(err, "Old session has been loaded.")
+	assert.Nil(data, "Old session has been deleted.")
+	// Tampered cookie starts a new session.
+	cookie := sessionCookie(jar, ts)
+	req, _ := http.NewRequest("GET", ts.URL+"/session/get", nil)
+	req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value[:len(cookie.Value)-2] + "xx"})
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(err, "Local GET with tampered cookie.")
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(string(body), " ", "Tampered cookie has no session.")
+	// Corrupt session data starts a new session.
+	corruptId, _ := sm.verify(sessionCookie(jar, ts).Value)
+	sm.configuration.Store.Save(corruptId, []byte("corrupt"), time.Minute)
+	assert.Equal(get("/session/get"), " ", "Corrupt session has been replaced.")
+	data, _ = sm.configuration.Store.Load(corruptId)
+	assert.Nil(data, "Corrupt session has been deleted.")
+	// Logout destroys the session.
+	get("/session/logout")
+	assert.Nil(sessionCookie(jar, ts), "Session cookie has been removed.")
+	data, _ = sm.configuration.Store.Load(newId)
+	assert.Nil(data, "Session has been deleted.")
+	assert.Equal(get("/session/get"), " ", "New session after logout.")
+}
+
+// Test the session stores.
+func TestSessionStores(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	dir, err := ioutil.TempDir("", "web-sessions")
+	assert.Nil(err, "Temporary directory has been created.")
+	defer os.RemoveAll(dir)
+	fileStore, err := NewFileSessionStore(dir)
+	assert.Nil(err, "File session store has been created.")
+	srv := redistest.NewServer()
+	defer srv.Close()
+	db := redis.Connect(redis.Configuration{Address: srv.Address()})
+	defer db.Close()
+	stores := map[string]SessionStore{
+		"memory": NewMemorySessionStore(),
+		"file":   fileStore,
+		"redis":  NewRedisSessionStore(db, "session:"),
+	}
+	for name, store := range stores {
+		data, err := store.Load("missing")
+		assert.Nil(err, "Missing session loaded from "+name)
+		assert.Nil(data, "Missing session has no data in "+name)
+		assert.Nil(store.Save("abc", []byte("data"), time.Minute), "Session saved in "+name)
+		data, err = store.Load("abc")
+		assert.Nil(err, "Session loaded from "+name)
+		assert.Equal(string(data), "data", "Session data of "+name)
+		assert.Nil(store.Delete("abc"), "Session deleted from "+name)
+		data, _ = store.Load("abc")
+		assert.Nil(data, "Session has been deleted from "+name)
+		assert.Nil(store.Delete("abc"), "Missing session deleted from "+name)
+	}
+	// Expiration by the stores.
+	stores["memory"].Save("short", []byte("data"), 10*time.Millisecond)
+	stores["redis"].Save("short", []byte("data"), 10*time.Millisecond)
+	stores["file"].Save("short", []byte("data"), 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	for _, name := range []string{"memory", "redis", "file"} {
+		data, _ := stores[name].Load("short")
+		assert.Nil(data, "Session expired in "+name)
+	}
+	_, err = os.Stat(filepath.Join(dir, "session-short"))
+	assert.True(os.IsNotExist(err), "Expired session file has been removed.")
+	// Expired session files are swept.
+	fileStore.Save("swept", []byte("data"), 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	fileStore.lastSweep = time.Now().Add(-2 * time.Minute)
+	fileStore.Save("kept", []byte("data"), time.Minute)
+	fns, _ := filepath.Glob(filepath.Join(dir, "session-*"))
+	assert.Equal(fns, []string{filepath.Join(dir, "session-kept")}, "Only the valid session file is left.")
+	// Invalid ids for files.
+	_, err = fileStore.Load("../passwd")
+	assert.ErrorMatch(err, "web: invalid session id .*", "Path is no valid session id.")
+}
+
+// sessionCookie returns the session cookie of the jar.
+func sessionCookie(jar http.CookieJar, ts *httptest.Server) *http.Cookie {
+	u, _ := url.Parse(ts.URL)
+	for _, cookie := range jar.Cookies(u) {
+		if cookie.Name == "session" {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// Test the authentication.
+func TestAuthentication(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	// Prepare the server.
+	basic := NewBasicAuthenticator("test", func(username, password string) (*Principal, error) {
+		if username == "alice" && password == "secret" {
+			return &Principal{Name: "alice", Roles: []string{"admin"}}, nil
+		}
+		return nil, nil
+	})
+	bearer := NewBearerAuthenticator("test", func(token string) (*Principal, error) {
+		switch token {
+		case "bob-token":
+			return &Principal{Name: "bob", Roles: []string{"user"}}, nil
+		case "broken":
+			return nil, errors.New("token backend down")
+		}
+		return nil, nil
+	})
+	signed := NewHMACAuthenticator(HMACConfiguration{
+		Keys: func(keyId string) ([]byte, error) {
+			if keyId == "carol" {
+				return []byte("carol-key"), nil
+			}
+			return nil, nil
+		},
+		Window:      time.Minute,
+		MaxBodySize: 16,
+	})
+	s := NewServer("", "/")
+	s.Use(Authenticate(basic, bearer, signed))
+	s.AddRoute("auth/whoami", func(ctx *Context) error {
+		body, _ := ioutil.ReadAll(ctx.Request.Body)
+		ctx.ResponseWriter.Write(append([]byte(ctx.Principal.Name), body...))
+		return nil
+	})
+	s.AddRoute("auth/admin", RequireRoles("admin")(func(ctx *Context) error {
+		ctx.ResponseWriter.Write([]byte("admin"))
+		return nil
+	}))
+	s.AddResourceHandler("auth", "resource", NewWrapperHandler(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("resource"))
+	}))
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	do := func(r *http.Request) (*http.Response, string) {
+		resp, err := http.DefaultClient.Do(r)
+		assert.Nil(err, "Local request.")
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+	// Missing and invalid credentials.
+	req, _ := http.NewRequest("GET", ts.URL+"/auth/resource", nil)
+	resp, _ := do(req)
+	assert.Equal(resp.StatusCode, http.StatusUnauthorized, "Resource handler needs authentication.")
+	assert.Equal(resp.Header["Www-Authenticate"], []string{`Basic realm="test"`, `Bearer realm="test"`, HMAC_SCHEME}, "Challenges are set.")
+	req.SetBasicAuth("alice", "wrong")
+	resp, _ = do(req)
+	assert.Equal(resp.StatusCode, http.StatusUnauthorized, "Wrong password is rejected.")
+	req.Header.Set("Authorization", "Bearer broken")
+	resp, _ = do(req)
+	assert.Equal(resp.StatusCode, http.StatusInternalServerError, "Validation error is internal.")
+	// Basic and bearer.
+	req.SetBasicAuth("alice", "secret")
+	resp, body := do(req)
+	assert.Equal(body, "resource", "Resource handler is called.")
+	req, _ = http.NewRequest("GET", ts.URL+"/auth/admin", nil)
+	req.SetBasicAuth("alice", "secret")
+	_, body = do(req)
+	assert.Equal(body, "admin", "Alice is admin.")
+	req.Header.Set("Authorization", "Bearer bob-token")
+	resp, _ = do(req)
+	assert.Equal(resp.StatusCode, http.StatusForbidden, "Bob is no admin.")
+	req, _ = http.NewRequest("GET", ts.URL+"/auth/whoami", nil)
+	req.Header.Set("Authorization", "bearer bob-token")
+	_, body = do(req)
+	assert.Equal(body, "bob", "Bob is authenticated.")
+	// Signed requests.
+	newSigned := func(keyId, key string) *http.Request {
+		req, _ := http.NewRequest("POST", ts.URL+"/auth/whoami?x=1", strings.NewReader(" signed"))
+		assert.Nil(SignRequest(req, keyId, []byte(key)), "Request has been signed.")
+		return req
+	}
+	req = newSigned("carol", "carol-key")
+	authHeader := req.Header.Get("Authorization")
+	resp, body = do(req)
+	assert.Equal(body, "carol signed", "Signed request is authenticated and body is readable.")
+	req, _ = http.NewRequest("POST", ts.URL+"/auth/whoami?x=1", strings.NewReader(" signed"))
+	req.Header.Set("Authorization", authHeader)
+	resp, body = do(req)
+	assert.Equal(resp.StatusCode, http.StatusUnauthorized, "Replayed request is rejected.")
+	assert.Substring(body, "replayed", "Replay is reported.")
+	req = newSigned("carol", "carol-key")
+	req.Body = ioutil.NopCloser(strings.NewReader(" SIGNED"))
+	resp, _ = do(req)
+	assert.Equal(resp.StatusCode, http.StatusUnauthorized, "Tampered body is rejected.")
+	resp, _ = do(newSigned("carol", "wrong-key"))
+	assert.Equal(resp.StatusCode, http.StatusUnauthorized, "Wrong key is rejected.")
+	resp, _ = do(newSigned("dave", "dave-key"))
+	assert.Equal(resp.StatusCode, http.StatusUnauthorized, "Unknown key id is rejected.")
+	req, _ = http.NewRequest("POST", ts.URL+"/auth/whoami", strings.NewReader(strings.Repeat("x", 17)))
+	SignRequest(req, "carol", []byte("carol-key"))
+	resp, _ = do(req)
+	assert.Equal(resp.StatusCode, http.StatusRequestEntityTooLarge, "Too large body is rejected.")
+	// Unknown keys are rejected before reading the body.
+	req, _ = http.NewRequest("POST", ts.URL+"/auth/whoami", strings.NewReader(strings.Repeat("x", 17)))
+	SignRequest(req, "dave", []byte("dave-key"))
+	resp, _ = do(req)
+	assert.Equal(resp.StatusCode, http.StatusUnauthorized, "Unknown key id with large body is rejected.")
+	// Nonces are swept once per window.
+	ha := signed.(*hmacAuthenticator)
+	ha.mutex.Lock()
+	ha.nonces["carol:stale"] = time.Now().Add(-3 * time.Minute)
+	ha.lastSweep = time.Now().Add(-2 * time.Minute)
+	ha.mutex.Unlock()
+	_, body = do(newSigned("carol", "carol-key"))
+	assert.Equal(body, "carol signed", "Signed request is authenticated.")
+	assert.False(ha.knowsNonce("carol:stale"), "Stale nonce has been swept.")
+	req = newSigned("carol", "carol-key")
+	stamp := parseAuthParams(strings.TrimPrefix(req.Header.Get("Authorization"), HMAC_SCHEME))["ts"]
+	old := strconv.FormatInt(time.Now().Add(-2*time.Minute).Unix(), 10)
+	req.Header.Set("Authorization", strings.Replace(req.Header.Get("Authorization"), stamp, old, 1))
+	resp, body = do(req)
+	assert.Equal(resp.StatusCode, http.StatusUnauthorized, "Old request is rejected.")
+	assert.Substring(body, "timestamp", "Old timestamp is reported.")
+}
+
+// Test the binding and validation.
+func TestBinding(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	// Prepare the server.
+	type bindData struct {
+		Id     int           `path:"id" validate:"required,min=1"`
+		Domain string        `path:"domain"`
+		Name   string        `json:"name" xml:"name" form:"name" validate:"required,min=3,max=10"`
+		Email  string        `json:"email" xml:"email" form:"email" validate:"pattern=^[^@,]+@[^@,]+$"`
+		Tags   []string      `query:"tag" validate:"max=2"`
+		Limit  int           `query:"limit" validate:"min=1,max=100"`
+		Wait   time.Duration `query:"wait"`
+	}
+	s := NewServer("", "/")
+	s.AddRoute("bind/{id}", func(ctx *Context) error {
+		var data bindData
+		if err := ctx.Bind(&data); err != nil {
+			return err
+		}
+		return ctx.Respond(http.StatusOK, &data)
+	})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	// Valid requests.
+	resp, body, err := localResponse("POST", ts, "/bind/5?tag=a&tag=b&limit=10&wait=2s", Hdr{"Content-Type": CT_JSON}, []byte(`{"name":"alice","email":"alice@example.com"}`))
+	assert.Nil(err, "Local POST with JSON.")
+	assert.Equal(resp.StatusCode, http.StatusOK, "JSON request is valid.")
+	assert.Equal(string(body), `{"Id":5,"Domain":"bind","name":"alice","email":"alice@example.com","Tags":["a","b"],"Limit":10,"Wait":2000000000}`, "All sources are bound.")
+	_, body, _ = localResponse("POST", ts, "/bind/6", Hdr{"Content-Type": CT_FORM}, []byte("name=bob&email=bob%40example.com"))
+	assert.Substring(string(body), `"Id":6,"Domain":"bind","name":"bob","email":"bob@example.com"`, "Form is bound.")
+	_, body, _ = localResponse("PUT", ts, "/bind/7", Hdr{"Content-Type": CT_XML}, []byte("<bindData><name>carol</name></bindData>"))
+	assert.Substring(string(body), `"Id":7,"Domain":"bind","name":"carol","email":""`, "XML is bound, optional field may be empty.")
+	// Invalid requests.
+	resp, body, _ = localResponse("POST", ts, "/bind/0?tag=a&tag=b&tag=c&limit=x", Hdr{"Content-Type": CT_JSON, "Accept": CT_JSON}, []byte(`{"name":"al","email":"alice"}`))
+	assert.Equal(resp.StatusCode, http.StatusUnprocessableEntity, "Invalid fields are unprocessable.")
+	var p Problem
+	assert.Nil(json.Unmarshal(body, &p), "Problem has been unmarshalled.")
+	assert.Equal(p.InvalidParams, []InvalidParam{
+		{"limit", `invalid integer "x"`},
+		{"id", "is required"},
+		{"name", "must have at least 3 characters"},
+		{"email", `must match "^[^@,]+@[^@,]+$"`},
+		{"tag", "must have at most 2 elements"},
+	}, "All invalid fields are reported.")
+	resp, body, _ = localResponse("POST", ts, "/bind/5", Hdr{"Content-Type": CT_JSON}, []byte(`{"name":`))
+	assert.Equal(resp.StatusCode, http.StatusBadRequest, "Invalid JSON is a bad request.")
+	resp, body, _ = localResponse("POST", ts, "/bind/5", Hdr{"Content-Type": CT_PLAIN}, []byte("name"))
+	assert.Equal(resp.StatusCode, http.StatusUnsupportedMediaType, "Plain text is not supported.")
+	resp, body, _ = localResponse("GET", ts, "/bind/5", Hdr{}, nil)
+	assert.Equal(resp.StatusCode, http.StatusUnprocessableEntity, "Missing body fails validation.")
+	assert.Equal(string(body), "422 unprocessable entity: invalid parameters\nname: is required\n", "Invalid params are rendered as text.")
+}
+
+// Test the server-sent events.
+func TestEventStream(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	// Prepare the server.
+	srv := redistest.NewServer()
+	defer srv.Close()
+	db := redis.Connect(redis.Configuration{Address: srv.Address()})
+	defer db.Close()
+	agent := NewSSEAgent("sse", 10)
+	s := NewServer("", "/")
+	s.AddRoute("sse/agent", func(ctx *Context) error {
+		es, err := ctx.EventStream()
+		if err != nil {
+			return err
+		}
+		es.SetKeepAlive(20 * time.Millisecond)
+		agent.Serve(es)
+		return nil
+	})
+	subscribed := make(chan bool)
+	s.AddRoute("sse/redis", func(ctx *Context) error {
+		sub, err := db.Subscribe("sse")
+		if err != nil {
+			return err
+		}
+		defer sub.Stop()
+		es, err := ctx.EventStream()
+		if err != nil {
+			return err
+		}
+		es.Send(&SSEEvent{Retry: time.Second, Data: "line 1\nline 2"})
+		subscribed <- true
+		es.ServeSubscription(sub)
+		return nil
+	})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	open := func(path, lastEventId string) (*http.Response, *bufio.Reader) {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		if lastEventId != "" {
+			req.Header.Set("Last-Event-ID", lastEventId)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(err, "Event stream has been opened.")
+		assert.Equal(resp.Header.Get("Content-Type"), CT_EVENT_STREAM, "Content type is event stream.")
+		return resp, bufio.NewReader(resp.Body)
+	}
+	// Events of the agent with resumption and keep-alive.
+	for i := 1; i <= 3; i++ {
+		assert.Nil(agent.Process(&testEvent{fmt.Sprintf("event %d", i), "topic"}), "Event has been processed.")
+	}
+	resp, r := open("/sse/agent", "1")
+	assert.Equal(readEvent(r), "id: 2\nevent: topic\ndata: event 2\n", "Missed event 2 is sent.")
+	assert.Equal(readEvent(r), "id: 3\nevent: topic\ndata: event 3\n", "Missed event 3 is sent.")
+	assert.Equal(readEvent(r), ": keep-alive\n", "Keep-alive comment is sent.")
+	agent.Process(&testEvent{"event 4", "topic"})
+	for event := readEvent(r); event != "id: 4\nevent: topic\ndata: event 4\n"; event = readEvent(r) {
+		assert.Equal(event, ": keep-alive\n", "Only keep-alives are sent before event 4.")
+	}
+	// Disconnect of the client.
+	resp.Body.Close()
+	for i := 0; i < 100 && agentStreams(agent) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(agentStreams(agent), 0, "Disconnected stream has been removed.")
+	// Values of a Redis subscription.
+	resp, r = open("/sse/redis", "")
+	<-subscribed
+	assert.Equal(readEvent(r), "retry: 1000\ndata: line 1\ndata: line 2\n", "Retry and multiline data are sent.")
+	// Publish until the subscription is active.
+	for n := 0; n == 0; {
+		n, _ = db.Publish("sse", "hello")
+	}
+	assert.Equal(readEvent(r), "id: 1\nevent: sse\ndata: hello\n", "Published value is sent.")
+	// Shutdown closes the streams.
+	resp, r = open("/sse/agent", "")
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-shutdownErr:
+		assert.Nil(err, "Shutdown has been successful.")
+	case <-time.After(5 * time.Second):
+		assert.Fail("Shutdown is blocked by the event stream.")
+	}
+	resp.Body.Close()
+}
+
+// testEvent is an event bus event with a string payload.
+type testEvent struct {
+	payload string
+	topic   string
+}
+
+func (e *testEvent) Payload(value interface{}) error {
+	*value.(*string) = e.payload
+	return nil
+}
+
+func (e *testEvent) Topic() string {
+	return e.topic
+}
+
+// readEvent reads the lines of an event until the empty line.
+func readEvent(r *bufio.Reader) string {
+	event := ""
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil || line == "\n" {
+			return event
+		}
+		event += line
+	}
+}
+
+// agentStreams returns the number of streams served by the agent.
+func agentStreams(a *SSEAgent) int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return len(a.channels)
+}
+
+// Test the WebSocket handling.
+func TestWebSocket(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	// Prepare the server.
+	wsh := &WebSocketTestHandler{make(chan error, 10)}
+	s := NewServer("", "/")
+	s.AddResourceHandler("ws", "echo", wsh)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	// Standard requests and invalid upgrades.
+	body, err := localDo("GET", ts, "/ws/echo", Hdr{}, nil)
+	assert.Nil(err, "Local GET without upgrade.")
+	assert.Equal(string(body), "no websocket", "Standard GET is handled.")
+	resp, _, _ := localResponse("GET", ts, "/ws/echo", Hdr{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "8"}, nil)
+	assert.Equal(resp.StatusCode, http.StatusUpgradeRequired, "Old version is rejected.")
+	// Messages.
+	c, r := wsDial(assert, ts, "/ws/echo")
+	wsWrite(c, 0x81, []byte("hello"))
+	assert.Equal(wsRead(r), "1:HELLO", "Text message is echoed.")
+	wsWrite(c, 0x82, []byte{1, 2, 3})
+	assert.Equal(wsRead(r), "2:\x01\x02\x03", "Binary message is echoed.")
+	wsWrite(c, 0x01, []byte("frag"))
+	wsWrite(c, 0x89, []byte("ping"))
+	wsWrite(c, 0x80, []byte("mented"))
+	assert.Equal(wsRead(r), "10:ping", "Ping is answered between fragments.")
+	assert.Equal(wsRead(r), "1:FRAGMENTED", "Fragments are joined.")
+	large := bytes.Repeat([]byte("x"), 70000)
+	wsWrite(c, 0x82, large)
+	assert.Equal(wsRead(r), "2:"+string(large), "Large message is echoed.")
+	// Keep-alive and close.
+	wsWrite(c, 0x81, []byte("keep-alive"))
+	assert.Equal(wsRead(r), "9:", "Server sends pings.")
+	wsWrite(c, 0x8a, nil)
+	wsWrite(c, 0x88, []byte{0x03, 0xe8})
+	frame := wsRead(r)
+	for frame == "9:" {
+		frame = wsRead(r)
+	}
+	assert.Equal(frame, "8:\x03\xe8", "Close is answered.")
+	err = <-wsh.errs
+	assert.True(IsWebSocketCloseError(err), "Handler got the close error.")
+	assert.Equal(err.(*WebSocketCloseError).Code, CloseNormal, "Client closed normally.")
+	c.Close()
+	// Protocol error.
+	c, r = wsDial(assert, ts, "/ws/echo")
+	c.Write([]byte{0x81, 0x02, 'h', 'i'})
+	assert.Equal(wsRead(r), "8:\x03\xeaframe not masked", "Unmasked frame is a protocol error.")
+	assert.Equal(<-wsh.errs, &WebSocketCloseError{CloseProtocolError, "frame not masked"}, "Handler got the protocol error.")
+	c.Close()
+	// Shutdown closes the connection.
+	c, r = wsDial(assert, ts, "/ws/echo")
+	defer c.Close()
+	go s.Shutdown(context.Background())
+	assert.Equal(wsRead(r), "8:\x03\xe9server is shutting down", "Server is going away.")
+	err = <-wsh.errs
+	assert.Equal(err.(*WebSocketCloseError).Code, CloseGoingAway, "Handler got the shutdown.")
+}
+
+// WebSocketTestHandler echoes WebSocket messages.
+type WebSocketTestHandler struct {
+	errs chan error
+}
+
+func (wsh *WebSocketTestHandler) Init(domain, resource string) {}
+
+func (wsh *WebSocketTestHandler) Get(ctx *Context) bool {
+	ctx.ResponseWriter.Write([]byte("no websocket"))
+	return true
+}
+
+func (wsh *WebSocketTestHandler) WebSocket(ctx *Context, conn *WebSocketConn) {
+	for {
+		mt, data, err := conn.ReadMessage()
+		if err != nil {
+			wsh.errs <- err
+			return
+		}
+		switch {
+		case string(data) == "keep-alive":
+			conn.KeepAlive(10 * time.Millisecond)
+		case mt == TextMessage:
+			conn.WriteMessage(mt, bytes.ToUpper(data))
+		default:
+			conn.WriteMessage(mt, data)
+		}
+	}
+}
+
+// wsDial opens a WebSocket connection.
+func wsDial(assert *asserts.Asserts, ts *httptest.Server, path string) (net.Conn, *bufio.Reader) {
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	assert.Nil(err, "Connection has been opened.")
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	fmt.Fprintf(c, "GET %s HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", path, key)
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, nil)
+	assert.Nil(err, "Handshake response has been read.")
+	assert.Equal(resp.StatusCode, http.StatusSwitchingProtocols, "Protocol has been switched.")
+	assert.Equal(resp.Header.Get("Sec-WebSocket-Accept"), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", "Key has been accepted.")
+	return c, r
+}
+
+// wsWrite writes a masked frame.
+func wsWrite(c net.Conn, b0 byte, payload []byte) {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{b0}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 0x80|126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		frame = append(frame, 0x80|127, 0, 0, 0, 0, byte(len(payload)>>24), byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload)))
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	c.Write(frame)
+}
+
+// wsRead reads an unmasked frame and returns opcode and payload.
+func wsRead(r *bufio.Reader) string {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err.Error()
+	}
+	length := int(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		length = int(ext[0])<<8 | int(ext[1])
+	case 127:
+		var ext [8]byte
+		io.ReadFull(r, ext[:])
+		length = 0
+		for _, b := range ext {
+			length = length<<8 | int(b)
+		}
+	}
+	payload := make([]byte, length)
+	io.ReadFull(r, payload)
+	return fmt.Sprintf("%d:%s", header[0]&0x0f, payload)
+}
+
+// Test the templates with sets, functions and reloading.
+func TestTemplates(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	dir, err := ioutil.TempDir("", "web-templates")
+	assert.Nil(err, "Temporary directory has been created.")
+	defer os.RemoveAll(dir)
+	write := func(name, content string) string {
+		fn := dir + "/" + name
+		assert.Nil(ioutil.WriteFile(fn, []byte(content), 0600), "Template file has been written.")
+		return fn
+	}
+	layout := write("layout.html", `<html><title>{{template "title" .}}</title>{{template "nav.html" .}}{{template "content" .}}</html>`)
+	nav := write("nav.html", `<a href="{{HtmlInternalReference "pages" "page" .Id (KeyValue "a" "b c")}}">{{shout "nav"}}</a>`)
+	page := write("page.html", `{{define "title"}}Page {{.Id}}{{end}}{{define "content"}}<p>{{.Count}}</p>{{end}}`)
+	// Prepare the server.
+	s := NewServer("", "/base")
+	s.AddTemplateFuncs(template.FuncMap{"shout": strings.ToUpper})
+	assert.ErrorMatch(s.LoadAndParseTemplate("missing", dir+"/missing.html", CT_HTML), ".*no such file.*", "Missing file is an error.")
+	assert.ErrorMatch(s.ParseTemplate("invalid", "{{.Id", CT_HTML), ".*unclosed action.*", "Invalid template is an error.")
+	assert.ErrorMatch(s.LoadAndParseSetTemplate("page", "none", page, CT_HTML), "web: template set \"none\" not found", "Unknown set is an error.")
+	assert.Nil(s.DefineTemplateSet("site", layout, nav), "Template set has been defined.")
+	assert.Nil(s.LoadAndParseSetTemplate("page", "site", page, CT_HTML), "Page has been loaded.")
+	s.AddRoute("page", func(ctx *Context) error {
+		ctx.RenderTemplate("page", &TestData{"foo", 4711})
+		return nil
+	})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	// Now the requests.
+	resp, body, err := localResponse("GET", ts, "/base/page", Hdr{}, nil)
+	assert.Nil(err, "Local GET of the page.")
+	assert.Equal(resp.Header.Get("Content-Type"), CT_HTML, "Content type of the template.")
+	assert.Equal(string(body), `<html><title>Page foo</title><a href="/base/pages/page/foo?a=b+c">NAV</a><p>4711</p></html>`, "Page is rendered in layout.")
+	// Reload changed partial, keep template with errors.
+	s.WatchTemplates(10 * time.Millisecond)
+	defer s.Shutdown(context.Background())
+	later := time.Now().Add(time.Second)
+	write("nav.html", `<nav/>`)
+	os.Chtimes(nav, later, later)
+	for i := 0; i < 100 && !strings.Contains(string(body), "<nav/>"); i++ {
+		time.Sleep(10 * time.Millisecond)
+		_, body, _ = localResponse("GET", ts, "/base/page", Hdr{}, nil)
+	}
+	assert.Equal(string(body), `<html><title>Page foo</title><nav/><p>4711</p></html>`, "Changed partial has been reloaded.")
+	later = later.Add(time.Second)
+	write("page.html", `{{define "content"}}{{.Count`)
+	os.Chtimes(page, later, later)
+	time.Sleep(50 * time.Millisecond)
+	_, body, _ = localResponse("GET", ts, "/base/page", Hdr{}, nil)
+	assert.Equal(string(body), `<html><title>Page foo</title><nav/><p>4711</p></html>`, "Invalid change is not loaded.")
+}
+
+// Test the caching of responses.
+func TestCaching(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	// Prepare the server.
+	counter := 0
+	modified := time.Date(2012, time.May, 1, 12, 0, 0, 0, time.UTC)
+	s := NewServer("", "/")
+	s.Use(func(h HandlerFunc) HandlerFunc {
+		return func(ctx *Context) error {
+			err := h(ctx)
+			// Changes after writing must not reach the cache.
+			if values := ctx.ResponseWriter.Header()["X-Values"]; len(values) > 0 {
+				values[0] = "changed"
+			}
+			return err
+		}
+	}, Caching(CacheConfiguration{MaxAge: time.Minute, TTL: time.Hour}))
+	s.AddRoute("cache/counter", func(ctx *Context) error {
+		if ctx.Request.Method == "GET" || ctx.Request.Method == "HEAD" {
+			counter++
+		}
+		fmt.Fprintf(ctx.ResponseWriter, "count %d", counter)
+		return nil
+	})
+	s.AddRoute("cache/modified", func(ctx *Context) error {
+		if ctx.NotModified("v1", modified) {
+			return nil
+		}
+		counter++
+		ctx.ResponseWriter.Write([]byte("modified"))
+		return nil
+	})
+	s.AddRoute("cache/private", func(ctx *Context) error {
+		counter++
+		ctx.ResponseWriter.Header().Set("Cache-Control", "private, max-age=60")
+		fmt.Fprintf(ctx.ResponseWriter, "count %d", counter)
+		return nil
+	})
+	s.AddRoute("cache/vary", func(ctx *Context) error {
+		counter++
+		hdr := ctx.ResponseWriter.Header()
+		hdr.Set("Vary", "Accept-Language")
+		hdr["X-Values"] = []string{"a", "b"}
+		fmt.Fprintf(ctx.ResponseWriter, "%s %d", ctx.Request.Header.Get("Accept-Language"), counter)
+		return nil
+	})
+	s.AddRoute("cache/missing", func(ctx *Context) error {
+		counter++
+		return NewHTTPError(http.StatusNotFound, "missing")
+	})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	// Cached responses and ETags.
+	resp, body, err := localResponse("GET", ts, "/cache/counter", Hdr{}, nil)
+	assert.Nil(err, "Local GET of the counter.")
+	assert.Equal(string(body), "count 1", "Response has been computed.")
+	assert.Equal(resp.Header.Get("Cache-Control"), "public, max-age=60", "Cache control is set.")
+	etag := resp.Header.Get("ETag")
+	assert.Match(etag, `^"[0-9a-f]{32}"$`, "ETag is set.")
+	_, body, _ = localResponse("GET", ts, "/cache/counter", Hdr{}, nil)
+	assert.Equal(string(body), "count 1", "Response is cached.")
+	_, body, _ = localResponse("GET", ts, "/cache/counter?page=2", Hdr{}, nil)
+	assert.Equal(string(body), "count 2", "Query has its own entry.")
+	resp, body, _ = localResponse("GET", ts, "/cache/counter", Hdr{"If-None-Match": `"other", ` + etag}, nil)
+	assert.Equal(resp.StatusCode, http.StatusNotModified, "Matching ETag is not modified.")
+	assert.Equal(string(body), "", "Not modified has no body.")
+	resp, body, _ = localResponse("HEAD", ts, "/cache/counter", Hdr{}, nil)
+	assert.Equal(resp.StatusCode, http.StatusOK, "HEAD is answered.")
+	assert.Equal(counter, 3, "HEAD has its own entry.")
+	headETag := resp.Header.Get("ETag")
+	resp, body, _ = localResponse("HEAD", ts, "/cache/counter", Hdr{}, nil)
+	assert.Equal(resp.Header.Get("ETag"), headETag, "HEAD is cached.")
+	assert.Equal(string(body), "", "HEAD has no body.")
+	assert.Equal(counter, 3, "Cached HEAD isn't computed again.")
+	_, body, _ = localResponse("PUT", ts, "/cache/counter", Hdr{}, nil)
+	assert.Equal(string(body), "count 3", "PUT is not cached.")
+	resp, body, _ = localResponse("GET", ts, "/cache/counter", Hdr{"If-None-Match": etag}, nil)
+	assert.Equal(resp.StatusCode, http.StatusOK, "Changed response is sent after invalidation.")
+	assert.Equal(string(body), "count 4", "Response has been computed again.")
+	_, _, _ = localResponse("HEAD", ts, "/cache/counter", Hdr{}, nil)
+	assert.Equal(counter, 5, "HEAD has been invalidated too.")
+	// Requests with credentials or a session aren't cached.
+	_, body, _ = localResponse("GET", ts, "/cache/counter", Hdr{"Authorization": "Bearer token"}, nil)
+	assert.Equal(string(body), "count 6", "Request with authorization is computed.")
+	_, body, _ = localResponse("GET", ts, "/cache/counter", Hdr{"Cookie": "session=abc"}, nil)
+	assert.Equal(string(body), "count 7", "Request with session is computed.")
+	_, body, _ = localResponse("GET", ts, "/cache/counter", Hdr{}, nil)
+	assert.Equal(string(body), "count 4", "Other requests are still cached.")
+	req, _ := http.NewRequest("GET", ts.URL+"/cache/counter", nil)
+	req.Host = "other.example.com"
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(err, "Local GET for another host.")
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(string(body), "count 8", "Other host has its own entry.")
+	// Private responses aren't cached.
+	_, body, _ = localResponse("GET", ts, "/cache/private", Hdr{}, nil)
+	assert.Equal(string(body), "count 9", "Private response is computed.")
+	_, body, _ = localResponse("GET", ts, "/cache/private", Hdr{}, nil)
+	assert.Equal(string(body), "count 10", "Private response isn't cached.")
+	// The headers the response varies by are part of the key.
+	_, body, _ = localResponse("GET", ts, "/cache/vary", Hdr{"Accept-Language": "de"}, nil)
+	assert.Equal(string(body), "de 11", "Response for the language is computed.")
+	_, body, _ = localResponse("GET", ts, "/cache/vary", Hdr{"Accept-Language": "en"}, nil)
+	assert.Equal(string(body), "en 12", "Response for the other language is computed.")
+	resp, body, _ = localResponse("GET", ts, "/cache/vary", Hdr{"Accept-Language": "de"}, nil)
+	assert.Equal(string(body), "de 11", "Response for the language is cached.")
+	assert.Equal(resp.Header["X-Values"], []string{"a", "b"}, "Cached headers are returned.")
+	resp, _, _ = localResponse("GET", ts, "/cache/vary", Hdr{"Accept-Language": "de"}, nil)
+	assert.Equal(resp.Header["X-Values"], []string{"a", "b"}, "Cached headers aren't changed by the response.")
+	// Last modification by the handler.
+	resp, body, _ = localResponse("GET", ts, "/cache/modified", Hdr{}, nil)
+	assert.Equal(string(body), "modified", "Modified response.")
+	assert.Equal(resp.Header.Get("Last-Modified"), "Tue, 01 May 2012 12:00:00 GMT", "Last modification is set.")
+	assert.Equal(resp.Header.Get("ETag"), `"v1"`, "Own ETag is kept.")
+	count := counter
+	resp, _, _ = localResponse("GET", ts, "/cache/modified", Hdr{"If-Modified-Since": "Wed, 02 May 2012 12:00:00 GMT"}, nil)
+	assert.Equal(resp.StatusCode, http.StatusNotModified, "Not modified since.")
+	resp, _, _ = localResponse("GET", ts, "/cache/modified?x", Hdr{"If-None-Match": `"v1"`}, nil)
+	assert.Equal(resp.StatusCode, http.StatusNotModified, "Handler answered not modified.")
+	assert.Equal(counter, count, "Handler didn't compute the response.")
+	// Errors are not cached.
+	for i := 0; i < 2; i++ {
+		resp, _, _ = localResponse("GET", ts, "/cache/missing", Hdr{}, nil)
+		assert.Equal(resp.StatusCode, http.StatusNotFound, "Error is returned.")
+	}
+	assert.Equal(counter, count+2, "Errors are not cached.")
+}
+
+// Test the rate and concurrency limits.
+func TestLimits(t *testing.T) {
+	assert := asserts.NewTestingAsserts(t, true)
+	// Monitoring values are global, so compare to the values before.
+	readVariable := func(id string) int64 {
+		if v, err := monitoring.ReadVariable(id); err == nil {
+			return v.ActValue
+		}
+		return 0
+	}
+	waitVariable := func(id string, value int64) bool {
+		for i := 0; i < 100; i++ {
+			if readVariable(id) == value {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+	allowed := readVariable("web:ratelimit:test:allowed")
+	rejected := readVariable("web:ratelimit:test:rejected")
+	// Rate limit per API key.
+	s := NewServer("", "/")
+	s.Use(RateLimit(RateLimitConfiguration{
+		Name:  "test",
+		Rate:  0.5,
+		Burst: 2,
+		Key:   KeyByHeader("X-Api-Key"),
+	}))
+	s.AddResourceHandler("limits", "rate", NewWrapperHandler(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("ok"))
+	}))
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	for i := 0; i < 2; i++ {
+		resp, _, err := localResponse("GET", ts, "/limits/rate", Hdr{"X-Api-Key": "a"}, nil)
+		assert.Nil(err, "Local GET within the burst.")
+		assert.Equal(resp.StatusCode, http.StatusOK, "Request is allowed.")
+	}
+	resp, _, _ := localResponse("GET", ts, "/limits/rate", Hdr{"X-Api-Key": "a"}, nil)
+	assert.Equal(resp.StatusCode, http.StatusTooManyRequests, "Request exceeds the limit.")
+	assert.Equal(resp.Header.Get("Retry-After"), "2", "Retry after the next token.")
+	resp, _, _ = localResponse("GET", ts, "/limits/rate", Hdr{"X-Api-Key": "b"}, nil)
+	assert.Equal(resp.StatusCode, http.StatusOK, "Other client is allowed.")
+	assert.True(waitVariable("web:ratelimit:test:allowed", allowed+3), "Allowed requests are counted.")
+	assert.True(waitVariable("web:ratelimit:test:rejected", rejected+1), "Rejected requests are counted.")
+	// Concurrency limit per resource.
+	rejected = readVariable("web:concurrency:rejected")
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	s = NewServer("", "/")
+	s.Use(ConcurrencyLimit(ConcurrencyConfiguration{
+		Resources:    map[string]int{"limits/slow": 1},
+		QueueTimeout: 100 * time.Millisecond,
+	}))
+	s.AddResourceHandler("limits", "slow", NewWrapperHandler(func(rw http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+		rw.Write([]byte("slow"))
+	}))
+	s.AddResourceHandler("limits", "fast", NewWrapperHandler(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("fast"))
+	}))
+	cts := httptest.NewServer(s)
+	defer cts.Close()
+	done := make(chan string)
+	go func() {
+		_, body, _ := localResponse("GET", cts, "/limits/slow", Hdr{}, nil)
+		done <- string(body)
+	}()
+	<-entered
+	assert.True(waitVariable("web:concurrency:limits:slow", 1), "Active request is counted.")
+	resp, _, _ = localResponse("GET", cts, "/limits/slow", Hdr{}, nil)
+	assert.Equal(resp.StatusCode, http.StatusServiceUnavailable, "Queued request timed out.")
+	assert.Equal(resp.Header.Get("Retry-After"), "1", "Retry after the queue timeout.")
+	resp, body, _ := localResponse("GET", cts, "/limits/fast", Hdr{}, nil)
+	assert.Equal(string(body), "fast", "Unlimited resource is handled.")
+	close(release)
+	assert.Equal(<-done, "slow", "Active request is finished.")
+	assert.True(waitVariable("web:concurrency:limits:slow", 0), "Finished request is not counted anymore.")
+	assert.True(waitVariable("web:concurrency:rejected", rejected+1), "Rejected requests are counted.")
+	// Without queue timeout requests are only rejected if the limit is reached.
+	s = NewServer("", "/")
+	s.Use(ConcurrencyLimit(ConcurrencyConfiguration{Max: 1}))
+	s.AddRoute("limits/{id}/slow", func(ctx *Context) error {
+		entered <- struct{}{}
+		<-release
+		return nil
+	})
+	s.AddResourceHandler("limits", "fast", NewWrapperHandler(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("fast"))
+	}))
+	zts := httptest.NewServer(s)
+	defer zts.Close()
+	for i := 0; i < 50; i++ {
+		resp, _, _ = localResponse("GET", zts, "/limits/fast", Hdr{}, nil)
+		assert.Equal(resp.StatusCode, http.StatusOK, "Sequential requests are not rejected.")
+	}
+	release = make(chan struct{})
+	go func() {
+		localResponse("GET", zts, "/limits/1/slow", Hdr{}, nil)
+		close(done)
+	}()
+	<-entered
+	resp, _, _ = localResponse("GET", zts, "/limits/2/slow", Hdr{}, nil)
+	assert.Equal(resp.StatusCode, http.StatusServiceUnavailable, "Request on the same route is rejected immediately.")
+	assert.True(waitVariable("web:concurrency:limits:id:slow", 1), "Active request is counted per route.")
+	resp, _, _ = localResponse("GET", zts, "/limits/fast", Hdr{}, nil)
+	assert.Equal(resp.StatusCode, http.StatusOK, "Other resource is not limited by the route.")
+	close(release)
+	<-done
+	// Unregistered resources get no limits.
+	localResponse("GET", zts, "/unknown/resource", Hdr{}, nil)
+	_, err := monitoring.ReadVariable("web:concurrency:unknown:resource")
+	assert.NotNil(err, "No variable for unregistered resource.")
+}
+
 // Test the wrapper handler.
 func TestWrapperHandler(t *testing.T) {
 	assert := asserts.NewTestingAsserts(t, true)
 	// Prepare the server.
-	AddResourceHandler("test", "wrapper", NewWrapperHandler(http.NotFound))
-	ts := startTestServer()
+	s := NewServer("", "/")
+	s.AddResourceHandler("test", "wrapper", NewWrapperHandler(http.NotFound))
+	ts := httptest.NewServer(s)
+	defer ts.Close()
 	// Now the request.
 	body, err := localDo("GET", ts, "/test/wrapper", Hdr{}, nil)
 	assert.Nil(err, "Local wrapper GET.")
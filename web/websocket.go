@@ -0,0 +1,452 @@
+// Tideland Common Go Library - Web - WebSocket
+//
+// Copyright (C) 2009-2012 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package web
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bufio"
+	"cgl.tideland.biz/applog"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+//--------------------
+// CONST
+//--------------------
+
+// MessageType is the type of a WebSocket message.
+type MessageType int
+
+const (
+	TextMessage   MessageType = 1
+	BinaryMessage MessageType = 2
+)
+
+// Opcodes of the control frames.
+const (
+	opContinuation = 0
+	opClose        = 8
+	opPing         = 9
+	opPong         = 10
+)
+
+// Status codes of closing WebSockets.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	CloseMessageTooBig   = 1009
+)
+
+// websocketGUID is used to compute the accept key of the handshake.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// defaultReadLimit is the default maximum size of a message.
+const defaultReadLimit = 1 << 20
+
+//--------------------
+// ERRORS
+//--------------------
+
+// WebSocketCloseError is returned when the WebSocket has been closed
+// by the client or because of a protocol error.
+type WebSocketCloseError struct {
+	Code   int
+	Reason string
+}
+
+// Error returns the error in a readable form.
+func (e *WebSocketCloseError) Error() string {
+	return fmt.Sprintf("web: websocket closed with %d %s", e.Code, e.Reason)
+}
+
+// IsWebSocketCloseError checks if the passed error signals
+// a closed WebSocket.
+func IsWebSocketCloseError(err error) bool {
+	_, ok := err.(*WebSocketCloseError)
+	return ok
+}
+
+//--------------------
+// HANDLER
+//--------------------
+
+// WebSocketResourceHandler is the additional interface for handlers
+// accepting WebSocket connections. GET requests asking for an upgrade
+// to the WebSocket protocol are passed to WebSocket() after the
+// handshake. The connection is closed when the method returns.
+type WebSocketResourceHandler interface {
+	WebSocket(ctx *Context, conn *WebSocketConn)
+}
+
+// isWebSocketUpgrade checks if the request asks for
+// an upgrade to the WebSocket protocol.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return r.Method == "GET" &&
+		headerContains(r.Header, "Connection", "upgrade") &&
+		headerContains(r.Header, "Upgrade", "websocket")
+}
+
+// handleWebSocket performs the handshake and passes the
+// connection to the handler.
+func handleWebSocket(ctx *Context, wh WebSocketResourceHandler) bool {
+	conn, err := upgrade(ctx)
+	if err != nil {
+		return ctx.Error(err)
+	}
+	go func() {
+		select {
+		case <-ctx.server.closingChan:
+			conn.Close(CloseGoingAway, "server is shutting down")
+		case <-conn.Done():
+		}
+	}()
+	wh.WebSocket(ctx, conn)
+	conn.Close(CloseNormal, "")
+	conn.wait()
+	return false
+}
+
+// upgrade performs the handshake with the client.
+func upgrade(ctx *Context) (*WebSocketConn, error) {
+	r := ctx.Request
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		ctx.ResponseWriter.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, NewHTTPError(http.StatusUpgradeRequired, "websocket version 13 required")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, NewHTTPError(http.StatusBadRequest, "invalid websocket key")
+	}
+	hj, ok := ctx.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, &HTTPError{Status: http.StatusInternalServerError, Err: errors.New("web: response writer cannot be hijacked")}
+	}
+	netConn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, &HTTPError{Status: http.StatusInternalServerError, Err: err}
+	}
+	h := sha1.New()
+	io.WriteString(h, key+websocketGUID)
+	accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", accept)
+	if err = brw.Flush(); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return newWebSocketConn(netConn, brw.Reader), nil
+}
+
+//--------------------
+// CONNECTION
+//--------------------
+
+// WebSocketConn is the server side of a WebSocket connection. Reading
+// and writing may be done concurrently, but only by one goroutine each.
+// Pings of the client are answered automatically.
+type WebSocketConn struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	writeMutex sync.Mutex
+	mutex      sync.Mutex
+	readLimit  int64
+	lastPong   time.Time
+	closeErr   *WebSocketCloseError
+	done       chan struct{}
+	wg         sync.WaitGroup
+}
+
+// newWebSocketConn creates the connection.
+func newWebSocketConn(conn net.Conn, reader *bufio.Reader) *WebSocketConn {
+	return &WebSocketConn{
+		conn:      conn,
+		reader:    reader,
+		readLimit: defaultReadLimit,
+		lastPong:  time.Now(),
+		done:      make(chan struct{}),
+	}
+}
+
+// RemoteAddr returns the address of the client.
+func (c *WebSocketConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetReadLimit sets the maximum size of a message read. Larger
+// messages close the connection. The default is 1 MB.
+func (c *WebSocketConn) SetReadLimit(limit int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.readLimit = limit
+}
+
+// ReadMessage reads the next text or binary message. Fragmented
+// messages are joined. If the client closes the connection a
+// WebSocketCloseError is returned.
+func (c *WebSocketConn) ReadMessage() (MessageType, []byte, error) {
+	c.mutex.Lock()
+	limit := c.readLimit
+	c.mutex.Unlock()
+	var messageType MessageType
+	var message []byte
+	for {
+		fin, opcode, payload, err := c.readFrame(limit - int64(len(message)))
+		if err != nil {
+			return 0, nil, c.fail(err)
+		}
+		switch opcode {
+		case opPing:
+			if err = c.writeFrame(opPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			c.mutex.Lock()
+			c.lastPong = time.Now()
+			c.mutex.Unlock()
+			continue
+		case opClose:
+			closeErr := &WebSocketCloseError{Code: CloseNoStatus}
+			if len(payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(payload))
+				closeErr.Reason = string(payload[2:])
+			}
+			c.Close(closeErr.Code, "")
+			return 0, nil, closeErr
+		case opContinuation:
+			if messageType == 0 {
+				return 0, nil, c.fail(&WebSocketCloseError{CloseProtocolError, "unexpected continuation"})
+			}
+		case int(TextMessage), int(BinaryMessage):
+			if messageType != 0 {
+				return 0, nil, c.fail(&WebSocketCloseError{CloseProtocolError, "unfinished message"})
+			}
+			messageType = MessageType(opcode)
+		default:
+			return 0, nil, c.fail(&WebSocketCloseError{CloseProtocolError, "unknown opcode"})
+		}
+		message = append(message, payload...)
+		if fin {
+			if messageType == TextMessage && !utf8.Valid(message) {
+				return 0, nil, c.fail(&WebSocketCloseError{CloseInvalidPayload, "invalid utf-8"})
+			}
+			return messageType, message, nil
+		}
+	}
+}
+
+// WriteMessage writes a text or binary message.
+func (c *WebSocketConn) WriteMessage(messageType MessageType, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("web: invalid message type %d", messageType)
+	}
+	return c.writeFrame(int(messageType), data)
+}
+
+// Ping sends a ping to the client.
+func (c *WebSocketConn) Ping(data []byte) error {
+	return c.writeFrame(opPing, data)
+}
+
+// KeepAlive sends pings in the interval. If no pong has been received
+// in the interval since the last ping the connection is closed. Pongs
+// are only received while reading.
+func (c *WebSocketConn) KeepAlive(interval time.Duration) {
+	c.Go(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var lastPing time.Time
+		for {
+			select {
+			case <-ticker.C:
+				c.mutex.Lock()
+				lastPong := c.lastPong
+				c.mutex.Unlock()
+				if !lastPing.IsZero() && lastPong.Before(lastPing) {
+					c.Close(CloseGoingAway, "keep-alive timeout")
+					return
+				}
+				lastPing = time.Now()
+				if c.Ping(nil) != nil {
+					return
+				}
+			case <-c.done:
+				return
+			}
+		}
+	})
+}
+
+// Go runs the function in a goroutine belonging to the connection.
+// It should return when Done() is closed, the handling of the
+// connection ends after all these goroutines.
+func (c *WebSocketConn) Go(f func()) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		f()
+	}()
+}
+
+// Done returns a channel which is closed when the connection is closed.
+func (c *WebSocketConn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close sends a close frame with the code and reason and closes the
+// connection. Closing a closed connection does nothing.
+func (c *WebSocketConn) Close(code int, reason string) error {
+	c.mutex.Lock()
+	if c.closeErr != nil {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.closeErr = &WebSocketCloseError{code, reason}
+	close(c.done)
+	c.mutex.Unlock()
+	var payload []byte
+	if code != CloseNoStatus {
+		payload = make([]byte, 2, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		payload = append(payload, reason...)
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.writeFrame(opClose, payload)
+	return c.conn.Close()
+}
+
+// fail closes the connection after a protocol error. Reading a
+// connection closed by the server returns its close error.
+func (c *WebSocketConn) fail(err error) error {
+	c.mutex.Lock()
+	closed := c.closeErr
+	c.mutex.Unlock()
+	if closed != nil {
+		return closed
+	}
+	if closeErr, ok := err.(*WebSocketCloseError); ok {
+		applog.Warningf("closing websocket of %s: %v", c.conn.RemoteAddr(), err)
+		c.Close(closeErr.Code, closeErr.Reason)
+		return err
+	}
+	c.Close(CloseGoingAway, "")
+	return err
+}
+
+// wait waits for the goroutines of the connection.
+func (c *WebSocketConn) wait() {
+	c.wg.Wait()
+}
+
+// readFrame reads a frame from the client.
+func (c *WebSocketConn) readFrame(limit int64) (bool, int, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := int(header[0] & 0x0f)
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, &WebSocketCloseError{CloseProtocolError, "reserved bits set"}
+	}
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, &WebSocketCloseError{CloseProtocolError, "frame not masked"}
+	}
+	length := int64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	if opcode >= opClose && (length > 125 || !fin) {
+		return false, 0, nil, &WebSocketCloseError{CloseProtocolError, "invalid control frame"}
+	}
+	if opcode < opClose && (length < 0 || length > limit) {
+		return false, 0, nil, &WebSocketCloseError{CloseMessageTooBig, "message too big"}
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame writes an unfragmented and unmasked frame.
+func (c *WebSocketConn) writeFrame(opcode int, payload []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | byte(opcode)
+	switch length := len(payload); {
+	case length < 126:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// headerContains checks if a comma separated header
+// contains the token, ignoring the case.
+func headerContains(h http.Header, key, token string) bool {
+	for _, value := range h[http.CanonicalHeaderKey(key)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// EOF